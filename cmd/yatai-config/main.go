@@ -0,0 +1,175 @@
+// Command yatai-config prints the config a yatai component resolves, with
+// secrets redacted, and diffs it against an earlier snapshot:
+//
+//	yatai-config snapshot -component yatai-deployment -format yaml > before.yaml
+//	yatai-config diff before.yaml after.yaml
+//	yatai-config diff before.yaml
+//	yatai-config images
+//
+// diff with a single snapshot compares it against the live cluster, images
+// lists the internal images which are not pinned to a digest. The secrets are
+// redacted with the key of YATAI_SNAPSHOT_REDACTION_KEY, or a random key of
+// the process when it is not set, in which case diff only tells whether the
+// secrets of a saved snapshot got set or unset. The key in use is recorded
+// under redaction_key in the snapshot. The environment variables of the
+// component are read from the environment the command runs in, run it in the
+// component pod to see exactly what it uses.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/bentoml/yatai-common/config"
+	"github.com/bentoml/yatai-common/consts"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  %[1]s snapshot [flags]
+  %[1]s diff [flags] OLD [NEW]
+  %[1]s images
+
+Run "%[1]s snapshot -h" for the flags.
+`, os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "snapshot":
+		err = runSnapshot(context.Background(), os.Args[2:])
+	case "diff":
+		err = runDiff(context.Background(), os.Args[2:])
+	case "images":
+		err = runImages()
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type options struct {
+	kubeconfig string
+	component  string
+	format     string
+}
+
+func parseFlags(name string, args []string) (opts *options, rest []string, err error) {
+	opts = &options{}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&opts.kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"), "path to the kubeconfig, the in-cluster config is used when empty")
+	flags.StringVar(&opts.component, "component", consts.YataiDeploymentComponentName, "the yatai component whose config is resolved")
+	flags.StringVar(&opts.format, "format", config.SnapshotFormatYAML, "output format, json or yaml")
+	err = flags.Parse(args)
+	rest = flags.Args()
+	return
+}
+
+func takeLiveSnapshot(ctx context.Context, opts *options) (snapshot *config.Snapshot, err error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", opts.kubeconfig)
+	if err != nil {
+		err = errors.Wrap(err, "failed to load kubeconfig")
+		return
+	}
+	cliset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		err = errors.Wrap(err, "failed to create kubernetes clientset")
+		return
+	}
+	snapshot = config.TakeSnapshot(ctx, config.NewClientsetGetter(cliset), opts.component)
+	return
+}
+
+func readSnapshot(path string) (snapshot *config.Snapshot, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read snapshot %s", path)
+		return
+	}
+	return config.UnmarshalSnapshot(content)
+}
+
+func runSnapshot(ctx context.Context, args []string) error {
+	opts, _, err := parseFlags("snapshot", args)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := takeLiveSnapshot(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	content, err := snapshot.Marshal(opts.format)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(content)
+	return err
+}
+
+func runDiff(ctx context.Context, args []string) error {
+	opts, paths, err := parseFlags("diff", args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 1 && len(paths) != 2 {
+		return errors.New("diff takes one or two snapshots")
+	}
+
+	from, err := readSnapshot(paths[0])
+	if err != nil {
+		return err
+	}
+
+	var to *config.Snapshot
+	if len(paths) == 2 {
+		to, err = readSnapshot(paths[1])
+	} else {
+		to, err = takeLiveSnapshot(ctx, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	changes := config.DiffSnapshots(from, to)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if len(changes) != 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func runImages() error {
+	images, err := config.LoadInternalImages()
+	if err != nil {
+		return err
+	}
+
+	mutable := config.VerifyInternalImages(images)
+	for _, image := range mutable {
+		fmt.Printf("%s: %s: %s\n", image.Field, image.Image, image.Reason)
+	}
+	if len(mutable) != 0 {
+		os.Exit(1)
+	}
+	return nil
+}
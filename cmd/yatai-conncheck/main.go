@@ -0,0 +1,158 @@
+// Command yatai-conncheck checks the connectivity to the services yatai is
+// configured with and the RBAC permissions of its service account,
+// concurrently, and exits 1 when any check fails:
+//
+//	yatai-conncheck -format json -timeout 1m
+//	yatai-conncheck -redis-addr redis:6379 -s3-stages put_get,multipart,presigned
+//
+// The config is resolved like the yatai components do, from the environment
+// and the shared env secrets, so it can run as a Helm pre-install hook with
+// the same environment as the component.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/bentoml/yatai-common/config"
+	"github.com/bentoml/yatai-common/conncheck"
+	"github.com/bentoml/yatai-common/consts"
+)
+
+func main() {
+	code, err := run(context.Background(), os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	os.Exit(code)
+}
+
+func run(ctx context.Context, args []string) (code int, err error) {
+	flags := flag.NewFlagSet("yatai-conncheck", flag.ContinueOnError)
+	kubeconfig := flags.String("kubeconfig", os.Getenv("KUBECONFIG"), "path to the kubeconfig, the in-cluster config is used when empty")
+	format := flags.String("format", "text", "output format, text or json")
+	timeout := flags.Duration("timeout", conncheck.DefaultProbeTimeout, "deadline of each probe")
+	s3Stages := flags.String("s3-stages", string(conncheck.S3StagePutGet), "comma separated S3 stages to run")
+	s3LeastPrivilege := flags.Bool("s3-least-privilege", true, "never create the S3 bucket")
+	s3ReadOnly := flags.Bool("s3-read-only", false, "only run the S3 stages which do not write")
+	yataiComponent := flags.String("yatai-component", consts.YataiDeploymentComponentName, "component whose api token the Yatai API server is probed with, the Yatai API server is not probed when empty")
+	registryCAFile := flags.String("registry-ca-file", "", "PEM bundle of the CAs to trust for the docker registry in addition to the system ones")
+	kubeWatcher := flags.Bool("kube-watcher", false, "check the permissions of the config watcher, which lists and watches secrets and configmaps")
+	kubeTenancy := flags.Bool("kube-tenancy", false, "check the permissions of the tenant overlays")
+	kubeNamespaceDiscovery := flags.Bool("kube-namespace-discovery", false, "check the permissions of the globs and the label selector of the bento deployment namespaces")
+	redisAddr := flags.String("redis-addr", "", "comma separated addresses of the Redis server, the cluster seeds or the sentinels, Redis is not probed when empty")
+	redisUsername := flags.String("redis-username", "", "ACL user of the Redis server, the default user when empty")
+	redisPassword := flags.String("redis-password", os.Getenv("REDIS_PASSWORD"), "password of the Redis server")
+	redisCluster := flags.Bool("redis-cluster", false, "whether Redis runs in cluster mode")
+	redisSentinelMaster := flags.String("redis-sentinel-master", "", "name of the master to discover through the sentinels at redis-addr")
+	redisSentinelPassword := flags.String("redis-sentinel-password", os.Getenv("REDIS_SENTINEL_PASSWORD"), "password of the sentinels")
+	redisTLS := flags.Bool("redis-tls", false, "connect to Redis over TLS")
+	redisTLSCAFile := flags.String("redis-tls-ca-file", "", "PEM bundle of the CAs to trust for Redis in addition to the system ones")
+	redisTLSServerName := flags.String("redis-tls-server-name", "", "server name to verify the Redis certificate against")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if *format != "text" && *format != "json" {
+		err = errors.Errorf("unknown format %s, must be text or json", *format)
+		return
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		err = errors.Wrap(err, "failed to load kubeconfig")
+		return
+	}
+	cliset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		err = errors.Wrap(err, "failed to create kubernetes clientset")
+		return
+	}
+
+	opts := conncheck.ProbesOptions{
+		S3: conncheck.S3TestOptions{
+			LeastPrivilege: *s3LeastPrivilege,
+			ReadOnly:       *s3ReadOnly,
+		},
+		RegistryCAFile: *registryCAFile,
+		YataiComponent: *yataiComponent,
+		KubeClient:     cliset,
+		KubeFeatures: conncheck.KubeFeatures{
+			Watcher:            *kubeWatcher,
+			Tenancy:            *kubeTenancy,
+			NamespaceDiscovery: *kubeNamespaceDiscovery,
+		},
+	}
+	for _, stage := range strings.Split(*s3Stages, ",") {
+		stage = strings.TrimSpace(stage)
+		if stage == "" {
+			continue
+		}
+		if !isS3Stage(stage) {
+			err = errors.Errorf("unknown s3 stage %s", stage)
+			return
+		}
+		opts.S3.Stages = append(opts.S3.Stages, conncheck.S3Stage(stage))
+	}
+	if *redisAddr != "" {
+		addrs := strings.Split(*redisAddr, ",")
+		opts.Redis = &conncheck.RedisConfig{
+			Addr:               addrs[0],
+			Addrs:              addrs[1:],
+			Username:           *redisUsername,
+			Password:           *redisPassword,
+			Cluster:            *redisCluster,
+			SentinelMasterName: *redisSentinelMaster,
+			SentinelPassword:   *redisSentinelPassword,
+			TLS:                *redisTLS,
+			TLSCAFile:          *redisTLSCAFile,
+			TLSServerName:      *redisTLSServerName,
+		}
+	}
+
+	// the config is resolved under the deadline of a probe, an unreachable
+	// api server would block it otherwise
+	resolveCtx, cancel := context.WithTimeout(ctx, *timeout)
+	probes := conncheck.ProbesFromConfig(resolveCtx, config.NewClientsetGetter(cliset).GetSecret, opts)
+	cancel()
+
+	runner := conncheck.NewRunner(*timeout, probes...)
+	report := runner.Run(ctx)
+
+	if *format == "json" {
+		err = report.WriteJSON(os.Stdout)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	code = report.ExitCode()
+
+	// the probes are closed once no check uses them, the ones of a check
+	// which does not return are left open as the process exits anyway
+	waitCtx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	if runner.Wait(waitCtx) == nil {
+		for _, probe := range probes {
+			if closer, ok := probe.(io.Closer); ok {
+				_ = closer.Close()
+			}
+		}
+	}
+	return
+}
+
+func isS3Stage(stage string) bool {
+	for _, s := range conncheck.S3Stages {
+		if string(s) == stage {
+			return true
+		}
+	}
+	return false
+}
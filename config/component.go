@@ -0,0 +1,125 @@
+package config
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+// Component declares where the config of a yatai component lives.
+type Component struct {
+	Name string
+	// NamespaceEnvKey is the env var, and the key of the shared env Secret,
+	// holding the namespace the component runs in.
+	NamespaceEnvKey  string
+	DefaultNamespace string
+	// SharedEnvSecretName is the Secret in the yatai system namespace shared
+	// by the component with the other components.
+	SharedEnvSecretName string
+	// EnvSecretName is the Secret in the component namespace holding the env
+	// of the component, such as its YATAI_API_TOKEN.
+	EnvSecretName string
+}
+
+var (
+	componentsLock sync.RWMutex
+	components     = map[string]Component{}
+)
+
+func init() {
+	MustRegisterComponent(Component{
+		Name:                consts.YataiImageBuilderComponentName,
+		NamespaceEnvKey:     consts.EnvYataiImageBuilderNamespace,
+		DefaultNamespace:    consts.DefaultKubeNamespaceYataiImageBuilderComponent,
+		SharedEnvSecretName: consts.KubeSecretNameYataiImageBuilderSharedEnv,
+		EnvSecretName:       consts.KubeSecretNameYataiImageBuilderEnv,
+	})
+	MustRegisterComponent(Component{
+		Name:                consts.YataiDeploymentComponentName,
+		NamespaceEnvKey:     consts.EnvYataiDeploymentNamespace,
+		DefaultNamespace:    consts.DefaultKubeNamespaceYataiDeploymentComponent,
+		SharedEnvSecretName: consts.KubeSecretNameYataiDeploymentSharedEnv,
+		EnvSecretName:       consts.KubeSecretNameYataiDeploymentEnv,
+	})
+}
+
+// RegisterComponent makes a component resolvable by GetYataiConfig,
+// GetComponentNamespace and the Watcher. Components can not be registered twice.
+func RegisterComponent(component Component) error {
+	if component.Name == "" || component.NamespaceEnvKey == "" || component.DefaultNamespace == "" || component.SharedEnvSecretName == "" || component.EnvSecretName == "" {
+		return errors.Errorf("component %q must declare all of its fields", component.Name)
+	}
+
+	componentsLock.Lock()
+	defer componentsLock.Unlock()
+	if _, ok := components[component.Name]; ok {
+		return errors.Errorf("component %s is already registered", component.Name)
+	}
+	components[component.Name] = component
+	return nil
+}
+
+// MustRegisterComponent is RegisterComponent which panics on error, for use in init.
+func MustRegisterComponent(component Component) {
+	if err := RegisterComponent(component); err != nil {
+		panic(err)
+	}
+}
+
+func GetComponent(name string) (component Component, err error) {
+	componentsLock.RLock()
+	defer componentsLock.RUnlock()
+	component, ok := components[name]
+	if !ok {
+		err = errors.Wrapf(consts.ErrNotFound, "invalid yatai component name %s", name)
+	}
+	return
+}
+
+// GetComponents returns the registered components sorted by name.
+func GetComponents() []Component {
+	componentsLock.RLock()
+	defer componentsLock.RUnlock()
+	result := make([]Component, 0, len(components))
+	for _, component := range components {
+		result = append(result, component)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+type componentNamespaceConfig struct {
+	Namespace string `env:"NAMESPACE" secret:"NAMESPACE"`
+}
+
+// GetComponentNamespace returns the namespace of a registered component from
+// its namespace env var, then from its shared env Secret, then its default.
+func GetComponentNamespace(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), name string) (namespace string, err error) {
+	component, err := GetComponent(name)
+	if err != nil {
+		return
+	}
+
+	keys := map[string]string{"NAMESPACE": component.NamespaceEnvKey}
+	conf := &componentNamespaceConfig{}
+	_, err = NewLoader(
+		RenameKeys(NewEnvSource(), keys),
+		RenameKeys(NewSecretSource(secretGetter, GetYataiSystemNamespaceFromEnv(), component.SharedEnvSecretName), keys),
+	).Load(ctx, conf)
+	if err != nil {
+		return
+	}
+
+	namespace = conf.Namespace
+	if namespace == "" {
+		namespace = component.DefaultNamespace
+	}
+	return
+}
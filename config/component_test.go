@@ -0,0 +1,106 @@
+package config
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+func registerTestComponent(t *testing.T, component Component) {
+	t.Helper()
+	if err := RegisterComponent(component); err != nil {
+		t.Fatalf("register component failed: %v", err)
+	}
+	t.Cleanup(func() {
+		componentsLock.Lock()
+		defer componentsLock.Unlock()
+		delete(components, component.Name)
+	})
+}
+
+func TestRegisteredComponentResolvesYataiConfig(t *testing.T) {
+	unsetYataiEnv(t)
+	t.Setenv("YATAI_MODEL_SEEDER_NAMESPACE", "")
+
+	registerTestComponent(t, Component{
+		Name:                "yatai-model-seeder",
+		NamespaceEnvKey:     "YATAI_MODEL_SEEDER_NAMESPACE",
+		DefaultNamespace:    "yatai-model-seeder",
+		SharedEnvSecretName: "yatai-model-seeder-shared-env",
+		EnvSecretName:       "yatai-model-seeder-env",
+	})
+
+	secrets := fakeSecrets{
+		"yatai-system/yatai-common-env": {Data: map[string][]byte{
+			"YATAI_ENDPOINT":     []byte("https://yatai.example.com"),
+			"YATAI_CLUSTER_NAME": []byte("default"),
+		}},
+		"yatai-system/yatai-model-seeder-shared-env": {Data: map[string][]byte{
+			"YATAI_MODEL_SEEDER_NAMESPACE": []byte("seeders"),
+		}},
+		"seeders/yatai-model-seeder-env": {Data: map[string][]byte{
+			"YATAI_API_TOKEN": []byte("seeder-token"),
+		}},
+	}
+
+	namespace, err := GetComponentNamespace(context.Background(), secrets.get, "yatai-model-seeder")
+	if err != nil {
+		t.Fatalf("get component namespace failed: %v", err)
+	}
+	if namespace != "seeders" {
+		t.Fatalf("namespace is %s, expected seeders", namespace)
+	}
+
+	conf, err := GetYataiConfigWithConfigMap(context.Background(), secrets.get, fakeConfigMaps{}.get, "yatai-model-seeder", false)
+	if err != nil {
+		t.Fatalf("get yatai config failed: %v", err)
+	}
+	if conf.ApiToken != "seeder-token" {
+		t.Fatalf("api token is %q, expected seeder-token", conf.ApiToken)
+	}
+
+	t.Setenv("YATAI_MODEL_SEEDER_NAMESPACE", "seeders-from-env")
+	namespace, err = GetComponentNamespace(context.Background(), secrets.get, "yatai-model-seeder")
+	if err != nil {
+		t.Fatalf("get component namespace failed: %v", err)
+	}
+	if namespace != "seeders-from-env" {
+		t.Fatalf("namespace is %s, expected seeders-from-env", namespace)
+	}
+}
+
+func TestComponentNamespaceDefault(t *testing.T) {
+	t.Setenv(consts.EnvYataiImageBuilderNamespace, "")
+
+	secrets := fakeSecrets{
+		"yatai-system/yatai-image-builder-shared-env": {Data: map[string][]byte{}},
+	}
+	namespace, err := GetYataiImageBuilderNamespace(context.Background(), secrets.get)
+	if err != nil {
+		t.Fatalf("get namespace failed: %v", err)
+	}
+	if namespace != consts.DefaultKubeNamespaceYataiImageBuilderComponent {
+		t.Fatalf("namespace is %s, expected the default", namespace)
+	}
+}
+
+func TestRegisterComponentErrors(t *testing.T) {
+	component, err := GetComponent(consts.YataiDeploymentComponentName)
+	if err != nil {
+		t.Fatalf("get component failed: %v", err)
+	}
+	if err := RegisterComponent(component); err == nil {
+		t.Fatal("registering a component twice should fail")
+	}
+	if err := RegisterComponent(Component{Name: "incomplete"}); err == nil {
+		t.Fatal("registering an incomplete component should fail")
+	}
+
+	_, err = GetComponent("unknown")
+	if !errors.Is(err, consts.ErrNotFound) {
+		t.Fatalf("unexpected error for an unknown component: %v", err)
+	}
+}
@@ -3,12 +3,12 @@ package config
 import (
 	"context"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/bentoml/yatai-common/consts"
@@ -18,176 +18,180 @@ func GetYataiSystemNamespaceFromEnv() string {
 	return getEnv(consts.EnvYataiSystemNamespace, consts.DefaultKubeNamespaceYataiSystem)
 }
 
-func GetYataiImageBuilderNamespace(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (namespace string, err error) {
-	namespace = os.Getenv(consts.EnvYataiImageBuilderNamespace)
-	if namespace != "" {
-		return
-	}
-
-	yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
-	yataiImageBuilderSharedEnvSecretName := consts.KubeSecretNameYataiImageBuilderSharedEnv
-
-	secret, err := secretGetter(ctx, yataiSystemNamespace, yataiImageBuilderSharedEnvSecretName)
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			err = errors.Wrapf(err, "secret %s not found in namespace %s", yataiImageBuilderSharedEnvSecretName, yataiSystemNamespace)
-		}
-		return
-	}
+type imageBuildersNamespaceConfig struct {
+	Namespace string `env:"IMAGE_BUILDERS_NAMESPACE" secret:"IMAGE_BUILDERS_NAMESPACE" default:"yatai-builders"`
+}
 
-	namespace = string(secret.Data[consts.EnvYataiImageBuilderNamespace])
-	if namespace == "" {
-		namespace = consts.DefaultKubeNamespaceYataiImageBuilderComponent
-	}
+type bentoDeploymentNamespacesConfig struct {
+	Namespaces []string `env:"BENTO_DEPLOYMENT_NAMESPACES" secret:"BENTO_DEPLOYMENT_NAMESPACES" default:"yatai"`
+	Selector   string   `env:"BENTO_DEPLOYMENT_NAMESPACE_SELECTOR" secret:"BENTO_DEPLOYMENT_NAMESPACE_SELECTOR"`
+}
 
-	return
+func GetYataiImageBuilderNamespace(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (namespace string, err error) {
+	return GetComponentNamespace(ctx, secretGetter, consts.YataiImageBuilderComponentName)
 }
 
 func GetYataiDeploymentNamespace(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (namespace string, err error) {
-	namespace = os.Getenv(consts.EnvYataiDeploymentNamespace)
-	if namespace != "" {
-		return
-	}
+	return GetComponentNamespace(ctx, secretGetter, consts.YataiDeploymentComponentName)
+}
 
-	yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
-	yataiDeploymentSharedEnvSecretName := consts.KubeSecretNameYataiDeploymentSharedEnv
+func GetImageBuildersNamespace(ctx context.Context, cliset kubernetes.Interface) (namespace string, err error) {
+	return getImageBuildersNamespace(ctx, NewClientsetGetter(cliset).GetSecret)
+}
+
+func getImageBuildersNamespace(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (namespace string, err error) {
+	conf := &imageBuildersNamespaceConfig{}
+	_, err = NewLoader(
+		NewEnvSource(),
+		NewSecretSource(secretGetter, GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiImageBuilderSharedEnv),
+	).Load(ctx, conf)
+	namespace = conf.Namespace
+	return
+}
 
-	secret, err := secretGetter(ctx, yataiSystemNamespace, yataiDeploymentSharedEnvSecretName)
+// GetBentoDeploymentNamespaces returns BENTO_DEPLOYMENT_NAMESPACES as is, use
+// NamespaceResolver.BentoDeploymentNamespaces to expand its globs and the
+// BENTO_DEPLOYMENT_NAMESPACE_SELECTOR label selector.
+func GetBentoDeploymentNamespaces(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (namespaces []string, err error) {
+	conf, err := getBentoDeploymentNamespacesConfig(ctx, secretGetter)
 	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			err = errors.Wrapf(err, "secret %s not found in namespace %s", yataiDeploymentSharedEnvSecretName, yataiSystemNamespace)
-		}
 		return
 	}
-
-	namespace = string(secret.Data[consts.EnvYataiDeploymentNamespace])
-	if namespace == "" {
-		namespace = consts.DefaultKubeNamespaceYataiDeploymentComponent
-	}
-
+	namespaces = conf.Namespaces
 	return
 }
 
-func GetImageBuildersNamespace(ctx context.Context, cliset *kubernetes.Clientset) (namespace string, err error) {
-	namespace = os.Getenv(consts.EnvImageBuildersNamespace)
-	if namespace != "" {
+// getBentoDeploymentNamespacesConfig only reads the yatai-deployment shared
+// env secret when BENTO_DEPLOYMENT_NAMESPACES is not set in the environment,
+// the selector is then only read from the environment too.
+func getBentoDeploymentNamespacesConfig(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (conf *bentoDeploymentNamespacesConfig, err error) {
+	conf = &bentoDeploymentNamespacesConfig{}
+	provenance, err := NewLoader(NewEnvSource()).Load(ctx, conf)
+	if err != nil || provenance["Namespaces"].Source != SourceNameDefault {
 		return
 	}
 
-	yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
-	yataiImageBuilderSharedEnvSecretName := consts.KubeSecretNameYataiImageBuilderSharedEnv
+	conf = &bentoDeploymentNamespacesConfig{}
+	_, err = NewLoader(
+		NewEnvSource(),
+		NewSecretSource(secretGetter, GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiDeploymentSharedEnv),
+	).Load(ctx, conf)
+	return
+}
 
-	secret, err := cliset.CoreV1().Secrets(yataiSystemNamespace).Get(ctx, yataiImageBuilderSharedEnvSecretName, metav1.GetOptions{})
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			err = errors.Wrapf(err, "secret %s not found in namespace %s", yataiImageBuilderSharedEnvSecretName, yataiSystemNamespace)
-		}
-		return
-	}
+type S3Config struct {
+	Endpoint   string `yaml:"endpoint" env:"S3_ENDPOINT" secret:"S3_ENDPOINT"`
+	AccessKey  string `yaml:"access_key" env:"S3_ACCESS_KEY" secret:"S3_ACCESS_KEY"`
+	SecretKey  string `yaml:"secret_key" env:"S3_SECRET_KEY" secret:"S3_SECRET_KEY" ref:"true" redact:"true"`
+	Region     string `yaml:"region" env:"S3_REGION" secret:"S3_REGION"`
+	BucketName string `yaml:"bucket_name" env:"S3_BUCKET_NAME" secret:"S3_BUCKET_NAME"`
+	// Prefix is prepended to the object keys in the bucket
+	Prefix string `yaml:"prefix" env:"S3_PREFIX" secret:"S3_PREFIX"`
+	Secure bool   `yaml:"secure" env:"S3_SECURE" secret:"S3_SECURE"`
+
+	CredentialMode     S3CredentialMode `yaml:"credential_mode" env:"S3_CREDENTIAL_MODE" secret:"S3_CREDENTIAL_MODE" default:"static"`
+	CredentialEndpoint string           `yaml:"credential_endpoint" env:"S3_CREDENTIAL_ENDPOINT" secret:"S3_CREDENTIAL_ENDPOINT"`
+
+	provenance Provenance
+}
 
-	namespace = string(secret.Data[consts.EnvImageBuildersNamespace])
-	if namespace == "" {
-		namespace = consts.DefaultKubeNamespaceImageBuilders
-	}
+// Provenance returns where each field of the config was loaded from.
+func (c *S3Config) Provenance() Provenance {
+	return c.provenance
+}
 
-	return
+func GetS3Config(ctx context.Context) (conf *S3Config, err error) {
+	return GetS3ConfigWithSecret(ctx, nil)
 }
 
-func GetBentoDeploymentNamespaces(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (namespaces []string, err error) {
-	namespaces_ := os.Getenv(consts.EnvBentoDeploymentNamespaces)
-	if namespaces_ != "" {
-		namespaces = strings.Split(namespaces_, ",")
+// GetS3ConfigWithSecret is like GetS3Config, but when S3 is not configured by the
+// environment or the config file it falls back to the yatai-image-builder shared
+// env secret.
+func GetS3ConfigWithSecret(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (conf *S3Config, err error) {
+	sources := localSources(FileSectionS3)
+
+	conf = &S3Config{}
+	conf.provenance, err = NewLoader(sources...).WithSecretGetter(secretGetter).Load(ctx, conf)
+	if err != nil {
 		return
 	}
 
-	yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
-	yataiDeploymentSharedEnvSecretName := consts.KubeSecretNameYataiDeploymentSharedEnv
-
-	secret, err := secretGetter(ctx, yataiSystemNamespace, yataiDeploymentSharedEnvSecretName)
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			err = errors.Wrapf(err, "secret %s not found in namespace %s", yataiDeploymentSharedEnvSecretName, yataiSystemNamespace)
+	// the shared env secret is only consulted when S3 is not configured locally
+	if secretGetter != nil && !conf.configured() {
+		sources = append(sources, NewSecretSource(secretGetter, GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiImageBuilderSharedEnv))
+		conf = &S3Config{}
+		conf.provenance, err = NewLoader(sources...).WithSecretGetter(secretGetter).Load(ctx, conf)
+		if err != nil {
+			return
 		}
-		return
 	}
 
-	namespaces_ = string(secret.Data[consts.EnvBentoDeploymentNamespaces])
-	if namespaces_ == "" {
-		namespaces = []string{consts.DefaultKubeNamespaceBentoDeployment}
-	} else {
-		namespaces = strings.Split(namespaces_, ",")
+	if !conf.configured() {
+		err = errors.Wrapf(consts.ErrNotFound, "the environment variable %s is not set", consts.EnvS3Endpoint)
 	}
 
 	return
 }
 
-type S3Config struct {
-	Endpoint   string `yaml:"endpoint"`
-	AccessKey  string `yaml:"access_key"`
-	SecretKey  string `yaml:"secret_key"`
-	Region     string `yaml:"region"`
-	BucketName string `yaml:"bucket_name"`
-	Secure     bool   `yaml:"secure"`
+// configured reports whether S3 is configured, the endpoint is optional in the
+// gcs-hmac mode.
+func (c *S3Config) configured() bool {
+	return c.Endpoint != "" || c.CredentialMode == S3CredentialModeGCSHMAC
 }
 
-func GetS3Config(ctx context.Context) (conf *S3Config, err error) {
-	conf = &S3Config{}
-	conf.Endpoint = os.Getenv(consts.EnvS3Endpoint)
-	conf.AccessKey = os.Getenv(consts.EnvS3AccessKey)
-	conf.SecretKey = os.Getenv(consts.EnvS3SecretKey)
-	conf.Region = os.Getenv(consts.EnvS3Region)
-	conf.BucketName = os.Getenv(consts.EnvS3BucketName)
-	conf.Secure = os.Getenv(consts.EnvS3Secure) == "true"
-
-	if conf.Endpoint == "" {
-		err = errors.Wrapf(consts.ErrNotFound, "the environment variable %s is not set", consts.EnvS3Endpoint)
-	}
-
-	return
+type DockerRegistryConfig struct {
+	BentoRepositoryName string `yaml:"bento_repository_name" env:"DOCKER_REGISTRY_BENTO_REPOSITORY_NAME" secret:"DOCKER_REGISTRY_BENTO_REPOSITORY_NAME"`
+	ModelRepositoryName string `yaml:"model_repository_name" env:"DOCKER_REGISTRY_MODEL_REPOSITORY_NAME" secret:"DOCKER_REGISTRY_MODEL_REPOSITORY_NAME"`
+	Server              string `yaml:"server" env:"DOCKER_REGISTRY_SERVER" secret:"DOCKER_REGISTRY_SERVER"`
+	InClusterServer     string `yaml:"in_cluster_server" env:"DOCKER_REGISTRY_IN_CLUSTER_SERVER" secret:"DOCKER_REGISTRY_IN_CLUSTER_SERVER"`
+	Username            string `yaml:"username" env:"DOCKER_REGISTRY_USERNAME" secret:"DOCKER_REGISTRY_USERNAME"`
+	Password            string `yaml:"password" env:"DOCKER_REGISTRY_PASSWORD" secret:"DOCKER_REGISTRY_PASSWORD" ref:"true" redact:"true"`
+	Secure              bool   `yaml:"secure" env:"DOCKER_REGISTRY_SECURE" secret:"DOCKER_REGISTRY_SECURE"`
+
+	// CABundle is a PEM bundle of the CAs the certificate of the registry is
+	// verified against in addition to the system ones
+	CABundle           string `yaml:"ca_bundle" env:"DOCKER_REGISTRY_CA_BUNDLE" secret:"DOCKER_REGISTRY_CA_BUNDLE"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" env:"DOCKER_REGISTRY_INSECURE_SKIP_VERIFY" secret:"DOCKER_REGISTRY_INSECURE_SKIP_VERIFY"`
+
+	// AWSECRWithIAMRole replaces the username and password with an ECR
+	// authorization token obtained with the IAM credentials of the pod
+	AWSECRWithIAMRole bool   `yaml:"aws_ecr_with_iam_role" env:"AWS_ECR_WITH_IAM_ROLE" secret:"AWS_ECR_WITH_IAM_ROLE"`
+	AWSECRRegion      string `yaml:"aws_ecr_region" env:"AWS_ECR_REGION" secret:"AWS_ECR_REGION"`
+
+	provenance          Provenance
+	credentialsExpireAt time.Time
 }
 
-type DockerRegistryConfig struct {
-	BentoRepositoryName string `yaml:"bento_repository_name"`
-	ModelRepositoryName string `yaml:"model_repository_name"`
-	Server              string `yaml:"server"`
-	InClusterServer     string `yaml:"in_cluster_server"`
-	Username            string `yaml:"username"`
-	Password            string `yaml:"password"`
-	Secure              bool   `yaml:"secure"`
+// Provenance returns where each field of the config was loaded from.
+func (c *DockerRegistryConfig) Provenance() Provenance {
+	return c.provenance
 }
 
 func GetDockerRegistryConfig(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (conf *DockerRegistryConfig, err error) {
-	conf = &DockerRegistryConfig{}
-	conf.BentoRepositoryName = os.Getenv(consts.EnvDockerRegistryBentoRepositoryName)
-	conf.ModelRepositoryName = os.Getenv(consts.EnvDockerRegistryModelRepositoryName)
-	conf.Server = os.Getenv(consts.EnvDockerRegistryServer)
-	conf.InClusterServer = os.Getenv(consts.EnvDockerRegistryInClusterServer)
-	conf.Username = os.Getenv(consts.EnvDockerRegistryUsername)
-	conf.Password = os.Getenv(consts.EnvDockerRegistryPassword)
-	conf.Secure = os.Getenv(consts.EnvDockerRegistrySecure) == "true"
+	sources := localSources(FileSectionDockerRegistry)
 
-	if conf.Server == "" {
-		yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
-		yataiImageBuilderSharedEnvSecretName := consts.KubeSecretNameYataiImageBuilderSharedEnv
-
-		var secret *corev1.Secret
+	conf = &DockerRegistryConfig{}
+	conf.provenance, err = NewLoader(sources...).WithSecretGetter(secretGetter).Load(ctx, conf)
+	if err != nil {
+		return
+	}
 
-		secret, err = secretGetter(ctx, yataiSystemNamespace, yataiImageBuilderSharedEnvSecretName)
+	// the shared env secret is only consulted when the registry is not configured locally
+	if conf.Server == "" && !conf.AWSECRWithIAMRole {
+		sources = append(sources, NewSecretSource(secretGetter, GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiImageBuilderSharedEnv))
+		conf = &DockerRegistryConfig{}
+		conf.provenance, err = NewLoader(sources...).WithSecretGetter(secretGetter).Load(ctx, conf)
 		if err != nil {
-			if k8serrors.IsNotFound(err) {
-				err = errors.Wrapf(err, "secret %s not found in namespace %s", yataiImageBuilderSharedEnvSecretName, yataiSystemNamespace)
-			}
 			return
 		}
+	}
 
-		conf.BentoRepositoryName = string(secret.Data[consts.EnvDockerRegistryBentoRepositoryName])
-		conf.ModelRepositoryName = string(secret.Data[consts.EnvDockerRegistryModelRepositoryName])
-		conf.Server = string(secret.Data[consts.EnvDockerRegistryServer])
-		conf.InClusterServer = string(secret.Data[consts.EnvDockerRegistryInClusterServer])
-		conf.Username = string(secret.Data[consts.EnvDockerRegistryUsername])
-		conf.Password = string(secret.Data[consts.EnvDockerRegistryPassword])
-		conf.Secure = string(secret.Data[consts.EnvDockerRegistrySecure]) == "true"
-
+	if conf.AWSECRWithIAMRole {
+		err = conf.resolveECRCredentials(ctx, DefaultECRAuthorizationTokenGetter)
+		if err != nil {
+			err = errors.Wrap(err, "failed to resolve ecr credentials")
+			return
+		}
 	}
 
 	if conf.Server == "" {
@@ -198,68 +202,119 @@ func GetDockerRegistryConfig(ctx context.Context, secretGetter func(ctx context.
 }
 
 type YataiConfig struct {
-	Endpoint    string `yaml:"endpoint"`
-	ClusterName string `yaml:"cluster_name"`
-	ApiToken    string `yaml:"api_token"`
+	Endpoint    string `yaml:"endpoint" env:"YATAI_ENDPOINT" configmap:"endpoint" secret:"YATAI_ENDPOINT"`
+	ClusterName string `yaml:"cluster_name" env:"YATAI_CLUSTER_NAME" configmap:"cluster-name" secret:"YATAI_CLUSTER_NAME"`
+	ApiToken    string `yaml:"api_token" env:"YATAI_API_TOKEN" secret:"YATAI_API_TOKEN" ref:"true" redact:"true"`
+
+	provenance Provenance
+}
+
+// Provenance returns where each field of the config was loaded from.
+func (c *YataiConfig) Provenance() Provenance {
+	return c.provenance
+}
+
+// yataiConfigMapTokenRef names the Secret holding the api token in the yatai
+// ConfigMap.
+type yataiConfigMapTokenRef struct {
+	SecretName string `configmap:"api-token-secret-name"`
+	SecretKey  string `configmap:"api-token-secret-key" default:"YATAI_API_TOKEN"`
 }
 
+// GetYataiConfig is GetYataiConfigWithConfigMap without a ConfigMap getter,
+// the yatai ConfigMap is skipped.
 func GetYataiConfig(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), yataiComponentName string, ignoreEnv bool) (conf *YataiConfig, err error) {
-	conf = &YataiConfig{}
+	return GetYataiConfigWithConfigMap(ctx, secretGetter, nil, yataiComponentName, ignoreEnv)
+}
+
+// GetYataiConfigWithConfigMap is like GetYataiConfig, but the fields which are
+// not configured by the environment or the config file are first read from
+// the yatai ConfigMap in the yatai system namespace: endpoint, cluster-name,
+// and the api token from the api-token-secret-key (YATAI_API_TOKEN by default)
+// of the Secret named by api-token-secret-name in the same namespace. The
+// Secrets GetYataiConfig reads are only consulted for the fields still missing,
+// so clusters without the ConfigMap resolve the same config as before. The
+// ConfigMap is skipped when configMapGetter is nil or reading it is forbidden.
+func GetYataiConfigWithConfigMap(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), configMapGetter func(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error), yataiComponentName string, ignoreEnv bool) (conf *YataiConfig, err error) {
+	var sources []Source
 	if !ignoreEnv {
-		conf.Endpoint = os.Getenv(consts.EnvYataiEndpoint)
-		conf.ClusterName = os.Getenv(consts.EnvYataiClusterName)
-		conf.ApiToken = os.Getenv(consts.EnvYataiApiToken)
+		sources = localSources(FileSectionYatai)
 	}
 
-	yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
+	local := &YataiConfig{}
+	_, err = NewLoader(sources...).WithSecretGetter(secretGetter).Load(ctx, local)
+	if err != nil {
+		return
+	}
 
-	if conf.Endpoint == "" {
-		var secret *corev1.Secret
-		secret, err = secretGetter(ctx, yataiSystemNamespace, consts.KubeSecretNameYataiCommonEnv)
-		if err != nil {
-			if k8serrors.IsNotFound(err) {
-				err = errors.Wrapf(err, "secret %s not found in namespace %s", consts.KubeSecretNameYataiCommonEnv, yataiSystemNamespace)
+	if configMapGetter != nil && (local.Endpoint == "" || local.ClusterName == "" || local.ApiToken == "") {
+		yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
+		configMap := Optional(NewConfigMapSource(func(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+			configMap, err := configMapGetter(ctx, namespace, name)
+			// the components deployed before the ConfigMap may not be granted
+			// reading it, they resolve the config from the Secrets as before
+			if k8serrors.IsForbidden(err) {
+				return nil, k8serrors.NewNotFound(corev1.Resource("configmaps"), name)
 			}
-			return
-		}
-		conf.Endpoint = string(secret.Data[consts.EnvYataiEndpoint])
-		conf.ClusterName = string(secret.Data[consts.EnvYataiClusterName])
-	}
+			return configMap, err
+		}, yataiSystemNamespace, consts.KubeConfigMapNameYataiConfig))
+		sources = append(sources, configMap)
 
-	if conf.ApiToken == "" {
-		var secret *corev1.Secret
-		var secretName string
-		var secretNamespace string
-		if yataiComponentName == consts.YataiImageBuilderComponentName {
-			secretName = consts.KubeSecretNameYataiImageBuilderEnv
-			secretNamespace, err = GetYataiImageBuilderNamespace(ctx, secretGetter)
+		if local.ApiToken == "" {
+			tokenRef := &yataiConfigMapTokenRef{}
+			_, err = NewLoader(configMap).Load(ctx, tokenRef)
 			if err != nil {
-				err = errors.Wrapf(err, "failed to get namespace for %s", yataiComponentName)
 				return
 			}
-		} else if yataiComponentName == consts.YataiDeploymentComponentName {
-			secretName = consts.KubeSecretNameYataiDeploymentEnv
-			secretNamespace, err = GetYataiDeploymentNamespace(ctx, secretGetter)
-			if err != nil {
-				err = errors.Wrapf(err, "failed to get namespace for %s", yataiComponentName)
-				return
+			if tokenRef.SecretName != "" {
+				tokenSecret := NewSecretSource(secretGetter, yataiSystemNamespace, tokenRef.SecretName)
+				sources = append(sources, RenameKeys(tokenSecret, map[string]string{consts.EnvYataiApiToken: tokenRef.SecretKey}))
 			}
-		} else {
-			err = errors.Errorf("invalid yatai component name %s", yataiComponentName)
+		}
+
+		local = &YataiConfig{}
+		_, err = NewLoader(sources...).WithSecretGetter(secretGetter).Load(ctx, local)
+		if err != nil {
 			return
 		}
-		secret, err = secretGetter(ctx, secretNamespace, secretName)
+	}
+
+	// each missing field is filled from the secrets on its own, e.g. the
+	// cluster name when the ConfigMap only sets the endpoint
+	commonEnvKeys := make([]string, 0, 2)
+	if local.Endpoint == "" {
+		commonEnvKeys = append(commonEnvKeys, consts.EnvYataiEndpoint)
+	}
+	if local.ClusterName == "" {
+		commonEnvKeys = append(commonEnvKeys, consts.EnvYataiClusterName)
+	}
+	if len(commonEnvKeys) != 0 && secretGetter != nil {
+		commonEnvSecret := NewSecretSource(secretGetter, GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiCommonEnv)
+		if local.Endpoint != "" {
+			// the cluster name is optional, the secret may not exist
+			commonEnvSecret = Optional(commonEnvSecret)
+		}
+		sources = append(sources, OnlyKeys(commonEnvSecret, commonEnvKeys...))
+	}
+
+	if local.ApiToken == "" {
+		var component Component
+		component, err = GetComponent(yataiComponentName)
 		if err != nil {
-			if k8serrors.IsNotFound(err) {
-				err = errors.Errorf("the secret %s in namespace %s does not exist", secretName, secretNamespace)
-			} else {
-				err = errors.Wrapf(err, "failed to get secret %s in namespace %s", secretName, secretNamespace)
-			}
 			return
 		}
-		conf.ApiToken = string(secret.Data[consts.EnvYataiApiToken])
+		var secretNamespace string
+		secretNamespace, err = GetComponentNamespace(ctx, secretGetter, yataiComponentName)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to get namespace for %s", yataiComponentName)
+			return
+		}
+		envSecret := NewSecretSource(secretGetter, secretNamespace, component.EnvSecretName)
+		sources = append(sources, OnlyKeys(envSecret, consts.EnvYataiApiToken))
 	}
 
+	conf = &YataiConfig{}
+	conf.provenance, err = NewLoader(sources...).WithSecretGetter(secretGetter).Load(ctx, conf)
 	return
 }
 
@@ -281,15 +336,12 @@ type InternalImages struct {
 	Buildah            string
 }
 
+// GetInternalImages is LoadInternalImages for callers which can not handle an
+// error, the images it fails to rewrite or pin are logged and used as they are.
 func GetInternalImages() (conf *InternalImages) {
-	conf = &InternalImages{}
-	conf.BentoDownloader = getEnv(consts.EnvInternalImagesBentoDownloader, consts.InternalImagesBentoDownloaderDefault)
-	conf.Curl = getEnv(consts.EnvInternalImagesCurl, consts.InternalImagesCurlDefault)
-	conf.Kaniko = getEnv(consts.EnvInternalImagesKaniko, consts.InternalImagesKanikoDefault)
-	conf.MetricsTransformer = getEnv(consts.EnvInternalImagesMetricsTransformer, consts.InternalImagesMetricsTransformerDefault)
-	conf.Buildkit = getEnv(consts.EnvInternalImagesBuildkit, consts.InternalImagesBuildkitDefault)
-	conf.BuildkitRootless = getEnv(consts.EnvInternalImagesBuildkitRootless, consts.InternalImagesBuildkitRootlessDefault)
-	conf.Buildah = getEnv(consts.EnvInternalImagesBuildah, consts.InternalImagesBuildahDefault)
-
+	conf, err := LoadInternalImages()
+	if err != nil {
+		logrus.Warnf("failed to load internal images: %v", err)
+	}
 	return
 }
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+type fakeConfigMaps map[string]*corev1.ConfigMap
+
+func (f fakeConfigMaps) get(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+	configMap, ok := f[namespace+"/"+name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	return configMap, nil
+}
+
+func unsetYataiEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("YATAI_ENDPOINT", "")
+	t.Setenv("YATAI_CLUSTER_NAME", "")
+	t.Setenv("YATAI_API_TOKEN", "")
+	t.Setenv("YATAI_DEPLOYMENT_NAMESPACE", "")
+}
+
+func TestGetYataiConfigFromConfigMap(t *testing.T) {
+	unsetYataiEnv(t)
+
+	configMaps := fakeConfigMaps{
+		"yatai-system/yatai": {Data: map[string]string{
+			consts.KubeConfigMapKeyYataiConfigEndpoint:           "https://yatai.example.com",
+			consts.KubeConfigMapKeyYataiConfigClusterName:        "default",
+			consts.KubeConfigMapKeyYataiConfigApiTokenSecretName: "yatai-api-token",
+			consts.KubeConfigMapKeyYataiConfigApiTokenSecretKey:  "token",
+		}},
+	}
+	// no yatai-common-env nor component env secret
+	secrets := fakeSecrets{
+		"yatai-system/yatai-api-token": {Data: map[string][]byte{"token": []byte("token-from-configmap-secret")}},
+	}
+
+	conf, err := GetYataiConfigWithConfigMap(context.Background(), secrets.get, configMaps.get, consts.YataiDeploymentComponentName, false)
+	if err != nil {
+		t.Fatalf("get yatai config failed: %v", err)
+	}
+	if conf.Endpoint != "https://yatai.example.com" || conf.ClusterName != "default" || conf.ApiToken != "token-from-configmap-secret" {
+		t.Fatalf("unexpected yatai config %+v", conf)
+	}
+	if origin := conf.Provenance()["Endpoint"]; origin.Source != "configmap:yatai-system/yatai" {
+		t.Fatalf("endpoint provenance is %s", origin)
+	}
+	if origin := conf.Provenance()["ApiToken"]; origin.Source != "secret:yatai-system/yatai-api-token" {
+		t.Fatalf("api token provenance is %s", origin)
+	}
+}
+
+func TestGetYataiConfigWithoutConfigMapUsesSecrets(t *testing.T) {
+	unsetYataiEnv(t)
+
+	secrets := fakeSecrets{
+		"yatai-system/yatai-common-env": {Data: map[string][]byte{
+			"YATAI_ENDPOINT":     []byte("https://yatai.example.com"),
+			"YATAI_CLUSTER_NAME": []byte("default"),
+		}},
+		"yatai-system/yatai-deployment-shared-env": {Data: map[string][]byte{}},
+		"yatai-deployment/yatai-deployment-env": {Data: map[string][]byte{
+			"YATAI_API_TOKEN": []byte("token-from-env-secret"),
+		}},
+	}
+
+	forbidden := func(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+		return nil, k8serrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, name, nil)
+	}
+	getters := map[string]func(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error){
+		"missing":   fakeConfigMaps{}.get,
+		"forbidden": forbidden,
+		"nil":       nil,
+	}
+	for name, getter := range getters {
+		conf, err := GetYataiConfigWithConfigMap(context.Background(), secrets.get, getter, consts.YataiDeploymentComponentName, false)
+		if err != nil {
+			t.Fatalf("%s: get yatai config failed: %v", name, err)
+		}
+		if conf.Endpoint != "https://yatai.example.com" || conf.ClusterName != "default" || conf.ApiToken != "token-from-env-secret" {
+			t.Fatalf("%s: unexpected yatai config %+v", name, conf)
+		}
+	}
+}
+
+func TestGetYataiConfigFillsMissingFieldsFromSecrets(t *testing.T) {
+	unsetYataiEnv(t)
+
+	configMaps := fakeConfigMaps{
+		"yatai-system/yatai": {Data: map[string]string{
+			consts.KubeConfigMapKeyYataiConfigEndpoint: "https://yatai.example.com",
+		}},
+	}
+	secrets := fakeSecrets{
+		"yatai-system/yatai-common-env": {Data: map[string][]byte{
+			"YATAI_ENDPOINT":     []byte("https://stale.example.com"),
+			"YATAI_CLUSTER_NAME": []byte("default"),
+		}},
+		"yatai-system/yatai-deployment-shared-env": {Data: map[string][]byte{}},
+		"yatai-deployment/yatai-deployment-env": {Data: map[string][]byte{
+			"YATAI_API_TOKEN": []byte("token-from-env-secret"),
+		}},
+	}
+
+	conf, err := GetYataiConfigWithConfigMap(context.Background(), secrets.get, configMaps.get, consts.YataiDeploymentComponentName, false)
+	if err != nil {
+		t.Fatalf("get yatai config failed: %v", err)
+	}
+	if conf.Endpoint != "https://yatai.example.com" || conf.ClusterName != "default" || conf.ApiToken != "token-from-env-secret" {
+		t.Fatalf("unexpected yatai config %+v", conf)
+	}
+	if origin := conf.Provenance()["ClusterName"]; origin.Source != "secret:yatai-system/yatai-common-env" {
+		t.Fatalf("cluster name provenance is %s", origin)
+	}
+}
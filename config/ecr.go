@@ -0,0 +1,129 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/pkg/errors"
+)
+
+// ECRAuthorizationToken is the docker login of an ECR registry, it is valid for
+// 12 hours.
+type ECRAuthorizationToken struct {
+	Username  string
+	Password  string
+	Server    string
+	ExpiresAt time.Time
+}
+
+// ECRAuthorizationTokenGetter exchanges IAM credentials for an ECR authorization token.
+type ECRAuthorizationTokenGetter interface {
+	GetAuthorizationToken(ctx context.Context, region string) (*ECRAuthorizationToken, error)
+}
+
+// DefaultECRAuthorizationTokenGetter is used by GetDockerRegistryConfig when
+// AWS_ECR_WITH_IAM_ROLE is true.
+var DefaultECRAuthorizationTokenGetter ECRAuthorizationTokenGetter = NewAWSECRAuthorizationTokenGetter()
+
+type awsECRAuthorizationTokenGetter struct{}
+
+// NewAWSECRAuthorizationTokenGetter calls the ECR API with the credentials found
+// by the default AWS credential chain: the environment, the shared config
+// files, IRSA web identity and the EC2 instance profile.
+func NewAWSECRAuthorizationTokenGetter() ECRAuthorizationTokenGetter {
+	return awsECRAuthorizationTokenGetter{}
+}
+
+func (awsECRAuthorizationTokenGetter) GetAuthorizationToken(ctx context.Context, region string) (token *ECRAuthorizationToken, err error) {
+	opts := make([]func(*awsconfig.LoadOptions) error, 0, 1)
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	awsConf, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		err = errors.Wrap(err, "failed to load aws config")
+		return
+	}
+
+	out, err := ecr.NewFromConfig(awsConf).GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		err = errors.Wrap(err, "failed to get ecr authorization token")
+		return
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		err = errors.New("ecr returned no authorization data")
+		return
+	}
+
+	data := out.AuthorizationData[0]
+	token, err = parseECRAuthorizationToken(*data.AuthorizationToken)
+	if err != nil {
+		return
+	}
+	if data.ProxyEndpoint != nil {
+		token.Server = strings.TrimPrefix(strings.TrimPrefix(*data.ProxyEndpoint, "https://"), "http://")
+	}
+	if data.ExpiresAt != nil {
+		token.ExpiresAt = *data.ExpiresAt
+	}
+	return
+}
+
+// parseECRAuthorizationToken decodes a base64 encoded user:password token.
+func parseECRAuthorizationToken(encoded string) (token *ECRAuthorizationToken, err error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		err = errors.Wrap(err, "failed to base64 decode ecr authorization token")
+		return
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		err = errors.New("ecr authorization token is not in the user:password format")
+		return
+	}
+	token = &ECRAuthorizationToken{
+		Username: username,
+		Password: password,
+	}
+	return
+}
+
+func (c *DockerRegistryConfig) resolveECRCredentials(ctx context.Context, tokenGetter ECRAuthorizationTokenGetter) (err error) {
+	token, err := tokenGetter.GetAuthorizationToken(ctx, c.AWSECRRegion)
+	if err != nil {
+		return
+	}
+
+	if c.provenance == nil {
+		c.provenance = make(Provenance)
+	}
+	c.Username = token.Username
+	c.Password = token.Password
+	c.credentialsExpireAt = token.ExpiresAt
+	c.provenance["Username"] = Origin{Source: "ecr", raw: token.Username}
+	c.provenance["Password"] = Origin{Source: "ecr"}
+	if c.Server == "" {
+		c.Server = token.Server
+		c.provenance["Server"] = Origin{Source: "ecr", raw: token.Server}
+	}
+	return
+}
+
+// CredentialsExpireAt returns when the username and password stop working, it
+// is zero for static credentials.
+func (c *DockerRegistryConfig) CredentialsExpireAt() time.Time {
+	return c.credentialsExpireAt
+}
+
+// withoutECRCredentials returns a copy of the config without the username and
+// password of the ecr authorization token.
+func (c *DockerRegistryConfig) withoutECRCredentials() *DockerRegistryConfig {
+	conf := *c
+	conf.Username = ""
+	conf.Password = ""
+	return &conf
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+type fakeECRAuthorizationTokenGetter struct {
+	token   *ECRAuthorizationToken
+	regions []string
+}
+
+func (f *fakeECRAuthorizationTokenGetter) GetAuthorizationToken(ctx context.Context, region string) (*ECRAuthorizationToken, error) {
+	f.regions = append(f.regions, region)
+	return f.token, nil
+}
+
+func TestParseECRAuthorizationToken(t *testing.T) {
+	token, err := parseECRAuthorizationToken(base64.StdEncoding.EncodeToString([]byte("AWS:ecr-password")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Username != "AWS" || token.Password != "ecr-password" {
+		t.Fatalf("unexpected token %+v", token)
+	}
+
+	if _, err = parseECRAuthorizationToken(base64.StdEncoding.EncodeToString([]byte("no-separator"))); err == nil {
+		t.Fatal("expected an error for a token without a separator")
+	}
+}
+
+func TestGetDockerRegistryConfigWithECR(t *testing.T) {
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+	t.Setenv("DOCKER_REGISTRY_USERNAME", "")
+	t.Setenv("DOCKER_REGISTRY_PASSWORD", "")
+	t.Setenv("AWS_ECR_WITH_IAM_ROLE", "true")
+	t.Setenv("AWS_ECR_REGION", "us-west-2")
+
+	expiresAt := time.Now().Add(12 * time.Hour)
+	fake := &fakeECRAuthorizationTokenGetter{token: &ECRAuthorizationToken{
+		Username:  "AWS",
+		Password:  "ecr-password",
+		Server:    "123456789012.dkr.ecr.us-west-2.amazonaws.com",
+		ExpiresAt: expiresAt,
+	}}
+	defaultGetter := DefaultECRAuthorizationTokenGetter
+	DefaultECRAuthorizationTokenGetter = fake
+	defer func() {
+		DefaultECRAuthorizationTokenGetter = defaultGetter
+	}()
+
+	// the shared env secret must not be needed in ECR mode
+	conf, err := GetDockerRegistryConfig(context.Background(), fakeSecrets{}.get)
+	if err != nil {
+		t.Fatalf("get docker registry config failed: %v", err)
+	}
+
+	if conf.Server != "123456789012.dkr.ecr.us-west-2.amazonaws.com" || conf.Username != "AWS" || conf.Password != "ecr-password" {
+		t.Fatalf("unexpected config %+v", conf)
+	}
+	if !conf.CredentialsExpireAt().Equal(expiresAt) {
+		t.Fatalf("credentials expire at %s", conf.CredentialsExpireAt())
+	}
+	if len(fake.regions) != 1 || fake.regions[0] != "us-west-2" {
+		t.Fatalf("unexpected regions %v", fake.regions)
+	}
+	if conf.Provenance()["Password"].Source != "ecr" {
+		t.Fatalf("unexpected provenance %s", conf.Provenance())
+	}
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+const (
+	TagYAML = "yaml"
+
+	FileSectionS3             = "s3"
+	FileSectionDockerRegistry = "docker_registry"
+	FileSectionYatai          = "yatai"
+)
+
+var envPlaceholderRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// interpolateEnv replaces ${VAR} and ${VAR:-default} placeholders with the
+// value of the environment variable.
+func interpolateEnv(s string) string {
+	return envPlaceholderRegexp.ReplaceAllStringFunc(s, func(placeholder string) string {
+		match := envPlaceholderRegexp.FindStringSubmatch(placeholder)
+		if value := os.Getenv(match[1]); value != "" {
+			return value
+		}
+		return match[2]
+	})
+}
+
+type yamlFileSource struct {
+	path    string
+	section string
+
+	fetched bool
+	data    map[string]string
+}
+
+// NewYAMLFileSource reads values from a section of a YAML config file, fields
+// are looked up by their yaml tag:
+//
+//	s3:
+//	  endpoint: minio.example.com
+//	  secret_key: ${S3_SECRET_KEY}
+//	docker_registry:
+//	  server: registry.example.com
+//	yatai:
+//	  endpoint: https://yatai.example.com
+func NewYAMLFileSource(path, section string) Source {
+	return &yamlFileSource{
+		path:    path,
+		section: section,
+	}
+}
+
+func (s *yamlFileSource) Name() string {
+	return fmt.Sprintf("file:%s#%s", s.path, s.section)
+}
+
+func (s *yamlFileSource) Tag() string {
+	return TagYAML
+}
+
+func (s *yamlFileSource) Lookup(ctx context.Context, key string) (value string, found bool, err error) {
+	if !s.fetched {
+		s.data, err = readYAMLFileSection(s.path, s.section)
+		if err != nil {
+			return
+		}
+		s.fetched = true
+	}
+	value = s.data[key]
+	found = value != ""
+	return
+}
+
+func readYAMLFileSection(path, section string) (data map[string]string, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read config file %s", path)
+		return
+	}
+
+	sections := make(map[string]map[string]interface{})
+	err = yaml.Unmarshal(content, &sections)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to yaml unmarshal config file %s", path)
+		return
+	}
+
+	data = make(map[string]string, len(sections[section]))
+	for key, value := range sections[section] {
+		if value == nil {
+			continue
+		}
+		raw := fmt.Sprint(value)
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			// nested values are handed over as yaml for fields which parse them
+			var content []byte
+			content, err = yaml.Marshal(value)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to yaml marshal %s.%s in config file %s", section, key, path)
+				return
+			}
+			raw = string(content)
+		}
+		data[key] = strings.TrimSpace(interpolateEnv(raw))
+	}
+	return
+}
+
+// localSources returns the sources which do not need a cluster, in order of
+// precedence: the environment, then the config file named by YATAI_CONFIG_FILE.
+func localSources(section string) []Source {
+	sources := []Source{NewEnvSource()}
+	if path := os.Getenv(consts.EnvYataiConfigFile); path != "" {
+		sources = append(sources, NewYAMLFileSource(path, section))
+	}
+	return sources
+}
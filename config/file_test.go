@@ -0,0 +1,87 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testConfigFile = `
+s3:
+  endpoint: minio.example.com
+  access_key: yatai
+  secret_key: ${TEST_S3_SECRET_KEY}
+  bucket_name: ${TEST_S3_BUCKET_NAME:-yatai}
+  secure: true
+docker_registry:
+  server: registry.example.com
+  bento_repository_name: bentos
+yatai:
+  endpoint: https://yatai.example.com
+  cluster_name: default
+  api_token: token-from-file
+`
+
+func writeTestConfigFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfigFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGetS3ConfigFromFile(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", writeTestConfigFile(t))
+	t.Setenv("TEST_S3_SECRET_KEY", "interpolated")
+	t.Setenv("S3_ENDPOINT", "")
+	t.Setenv("S3_ACCESS_KEY", "from-env")
+
+	conf, err := GetS3Config(context.Background())
+	if err != nil {
+		t.Fatalf("get s3 config failed: %v", err)
+	}
+
+	if conf.Endpoint != "minio.example.com" {
+		t.Fatalf("endpoint is %s", conf.Endpoint)
+	}
+	if conf.AccessKey != "from-env" {
+		t.Fatalf("the environment should take precedence over the file, access key is %s", conf.AccessKey)
+	}
+	if conf.SecretKey != "interpolated" {
+		t.Fatalf("secret key is %s", conf.SecretKey)
+	}
+	if conf.BucketName != "yatai" {
+		t.Fatalf("bucket name is %s", conf.BucketName)
+	}
+	if !conf.Secure {
+		t.Fatal("secure is false")
+	}
+	if origin := conf.Provenance()["Endpoint"]; origin.Key != "endpoint" {
+		t.Fatalf("unexpected provenance %s", origin)
+	}
+}
+
+func TestGetDockerRegistryAndYataiConfigFromFileWithoutCluster(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", writeTestConfigFile(t))
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+	t.Setenv("YATAI_ENDPOINT", "")
+	t.Setenv("YATAI_API_TOKEN", "")
+
+	registry, err := GetDockerRegistryConfig(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("get docker registry config failed: %v", err)
+	}
+	if registry.Server != "registry.example.com" || registry.BentoRepositoryName != "bentos" {
+		t.Fatalf("unexpected docker registry config %+v", registry)
+	}
+
+	yatai, err := GetYataiConfig(context.Background(), nil, "yatai-deployment", false)
+	if err != nil {
+		t.Fatalf("get yatai config failed: %v", err)
+	}
+	if yatai.Endpoint != "https://yatai.example.com" || yatai.ClusterName != "default" || yatai.ApiToken != "token-from-file" {
+		t.Fatalf("unexpected yatai config %+v", yatai)
+	}
+}
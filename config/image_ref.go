@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/bentoml/yatai-common/consts"
+	"github.com/bentoml/yatai-common/imageref"
+)
+
+// BentoImageRef returns the canonical reference of the image built for a bento
+// version, inCluster picks the in-cluster server of the registry when it has one.
+func (c *DockerRegistryConfig) BentoImageRef(bentoName, bentoVersion string, inCluster bool) (*imageref.Reference, error) {
+	repository := c.BentoRepositoryName
+	if repository == "" {
+		repository = consts.DefaultDockerRegistryBentoRepositoryName
+	}
+	return c.imageRef(repository, fmt.Sprintf("yatai.%s.%s", bentoName, bentoVersion), inCluster)
+}
+
+// ModelImageRef returns the canonical reference of the image built for a
+// model version, inCluster picks the in-cluster server of the registry when it
+// has one.
+func (c *DockerRegistryConfig) ModelImageRef(modelName, modelVersion string, inCluster bool) (*imageref.Reference, error) {
+	repository := c.ModelRepositoryName
+	if repository == "" {
+		repository = consts.DefaultDockerRegistryModelRepositoryName
+	}
+	return c.imageRef(repository, fmt.Sprintf("yatai.model.%s.%s", modelName, modelVersion), inCluster)
+}
+
+func (c *DockerRegistryConfig) imageRef(repository, tag string, inCluster bool) (ref *imageref.Reference, err error) {
+	registry := c.Server
+	if inCluster && c.InClusterServer != "" {
+		registry = c.InClusterServer
+	}
+	// the servers are configured with or without a scheme
+	registry = strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	registry = strings.TrimSuffix(registry, "/")
+	if registry == "" {
+		err = errors.Wrap(consts.ErrNotFound, "docker registry server")
+		return
+	}
+
+	return imageref.ParseNormalized(fmt.Sprintf("%s/%s:%s", registry, repository, imageref.SanitizeTag(tag)))
+}
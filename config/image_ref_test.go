@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestBentoAndModelImageRef(t *testing.T) {
+	dockerRegistry := &DockerRegistryConfig{
+		Server:              "https://registry.example.com/",
+		InClusterServer:     "registry.yatai-system.svc.cluster.local:5000",
+		BentoRepositoryName: "bentos",
+	}
+
+	ref, err := dockerRegistry.BentoImageRef("iris_classifier", "x6sj6xbnkgqo2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.String() != "registry.example.com/bentos:yatai.iris_classifier.x6sj6xbnkgqo2" {
+		t.Fatalf("bento image ref is %s", ref)
+	}
+
+	ref, err = dockerRegistry.ModelImageRef("iris", "v1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.String() != "registry.yatai-system.svc.cluster.local:5000/yatai-models:yatai.model.iris.v1" {
+		t.Fatalf("model image ref is %s", ref)
+	}
+
+	if _, err = (&DockerRegistryConfig{}).BentoImageRef("iris", "v1", false); err == nil {
+		t.Fatal("expected an error without a registry server")
+	}
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/bentoml/yatai-common/consts"
+	"github.com/bentoml/yatai-common/imageref"
+)
+
+// floatingTags are tags which are expected to move to a new image on every
+// release of the upstream project, variants like master-rootless included.
+var floatingTags = map[string]struct{}{
+	"":       {},
+	"latest": {},
+	"master": {},
+	"main":   {},
+}
+
+// LoadInternalImages returns the internal images, each read from its env var
+// or defaulted, then:
+//
+//   - rewritten by the first of the INTERNAL_IMAGES_REWRITE_RULES matching it,
+//     a comma separated list of from=to prefix rules such as
+//     quay.io/bentoml=registry.local/bentoml
+//   - or, if no rule matches, moved to the INTERNAL_IMAGES_REGISTRY_MIRROR
+//     registry (which may have a path, like harbor.local/quay-proxy)
+//   - pinned to the digest listed for its original image in
+//     INTERNAL_IMAGES_DIGESTS_FILE, a yaml or json map from image to digest
+//
+// conf is never nil, on error it holds the images which could be resolved.
+func LoadInternalImages() (conf *InternalImages, err error) {
+	conf = &InternalImages{}
+	conf.BentoDownloader = getEnv(consts.EnvInternalImagesBentoDownloader, consts.InternalImagesBentoDownloaderDefault)
+	conf.Curl = getEnv(consts.EnvInternalImagesCurl, consts.InternalImagesCurlDefault)
+	conf.Kaniko = getEnv(consts.EnvInternalImagesKaniko, consts.InternalImagesKanikoDefault)
+	conf.MetricsTransformer = getEnv(consts.EnvInternalImagesMetricsTransformer, consts.InternalImagesMetricsTransformerDefault)
+	conf.Buildkit = getEnv(consts.EnvInternalImagesBuildkit, consts.InternalImagesBuildkitDefault)
+	conf.BuildkitRootless = getEnv(consts.EnvInternalImagesBuildkitRootless, consts.InternalImagesBuildkitRootlessDefault)
+	conf.Buildah = getEnv(consts.EnvInternalImagesBuildah, consts.InternalImagesBuildahDefault)
+
+	rules, err := parseImageRewriteRules(os.Getenv(consts.EnvInternalImagesRewriteRules))
+	if err != nil {
+		return
+	}
+	mirror := strings.TrimSuffix(os.Getenv(consts.EnvInternalImagesRegistryMirror), "/")
+
+	var digests map[string]string
+	if path := os.Getenv(consts.EnvInternalImagesDigestsFile); path != "" {
+		digests, err = readImageDigests(path)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, image := range conf.images() {
+		original := *image
+		*image, err = rewriteImage(original, rules, mirror)
+		if err != nil {
+			*image = original
+			return
+		}
+		if digest, ok := digests[original]; ok && !strings.Contains(*image, "@") {
+			*image = *image + "@" + digest
+		}
+	}
+	return
+}
+
+func (c *InternalImages) images() map[string]*string {
+	return map[string]*string{
+		"BentoDownloader":    &c.BentoDownloader,
+		"Curl":               &c.Curl,
+		"Kaniko":             &c.Kaniko,
+		"MetricsTransformer": &c.MetricsTransformer,
+		"Buildkit":           &c.Buildkit,
+		"BuildkitRootless":   &c.BuildkitRootless,
+		"Buildah":            &c.Buildah,
+	}
+}
+
+type imageRewriteRule struct {
+	from string
+	to   string
+}
+
+func parseImageRewriteRules(s string) (rules []imageRewriteRule, err error) {
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(rule, "=")
+		from = strings.TrimSuffix(strings.TrimSpace(from), "/")
+		to = strings.TrimSuffix(strings.TrimSpace(to), "/")
+		if !ok || from == "" || to == "" {
+			err = errors.Errorf("invalid rule %q in %s, expected from=to", rule, consts.EnvInternalImagesRewriteRules)
+			return
+		}
+		rules = append(rules, imageRewriteRule{from: from, to: to})
+	}
+	return
+}
+
+func readImageDigests(path string) (digests map[string]string, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read internal images digests file %s", path)
+		return
+	}
+	err = yaml.Unmarshal(content, &digests)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to yaml unmarshal internal images digests file %s", path)
+	}
+	return
+}
+
+func rewriteImage(image string, rules []imageRewriteRule, mirror string) (string, error) {
+	for _, rule := range rules {
+		// rules match whole path components only
+		if image == rule.from || strings.HasPrefix(image, rule.from+"/") || strings.HasPrefix(image, rule.from+":") || strings.HasPrefix(image, rule.from+"@") {
+			return rule.to + strings.TrimPrefix(image, rule.from), nil
+		}
+	}
+	if mirror == "" {
+		return image, nil
+	}
+	ref, err := imageref.Parse(image)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to move internal image %s to %s", image, consts.EnvInternalImagesRegistryMirror)
+	}
+	// the mirror keeps the tag as given, Normalize defaults it to latest
+	tag := ref.Tag
+	ref.Normalize()
+	ref.Registry, ref.Tag = mirror, tag
+	return ref.String(), nil
+}
+
+// MutableImage is an internal image which is not pinned to a digest.
+type MutableImage struct {
+	Field  string
+	Image  string
+	Reason string
+}
+
+// VerifyInternalImages returns the internal images which are referenced by a
+// tag only, sorted by field. Those may change under a running cluster.
+func VerifyInternalImages(conf *InternalImages) []MutableImage {
+	mutable := make([]MutableImage, 0)
+	for field, image := range conf.images() {
+		if strings.Contains(*image, "@") {
+			continue
+		}
+		tag := ""
+		if ref, err := imageref.Parse(*image); err == nil {
+			tag = ref.Tag
+		}
+		reason := "tag " + tag + " is not pinned to a digest"
+		base, _, _ := strings.Cut(tag, "-")
+		if _, ok := floatingTags[base]; ok {
+			if tag == "" {
+				tag = "latest"
+			}
+			reason = "floating tag " + tag + " is not pinned to a digest"
+		}
+		mutable = append(mutable, MutableImage{Field: field, Image: *image, Reason: reason})
+	}
+	sort.Slice(mutable, func(i, j int) bool {
+		return mutable[i].Field < mutable[j].Field
+	})
+	return mutable
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+func unsetInternalImagesEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range []string{
+		consts.EnvInternalImagesBentoDownloader,
+		consts.EnvInternalImagesCurl,
+		consts.EnvInternalImagesKaniko,
+		consts.EnvInternalImagesMetricsTransformer,
+		consts.EnvInternalImagesBuildkit,
+		consts.EnvInternalImagesBuildkitRootless,
+		consts.EnvInternalImagesBuildah,
+	} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func TestLoadInternalImagesRewritesAndPins(t *testing.T) {
+	unsetInternalImagesEnv(t)
+	t.Setenv("INTERNAL_IMAGES_KANIKO", "gcr.io/kaniko-project/executor:v1.9.1")
+	t.Setenv("INTERNAL_IMAGES_BUILDAH", "buildah")
+	t.Setenv("INTERNAL_IMAGES_REWRITE_RULES", "quay.io/bentoml/curl=registry.local/tools/curl, gcr.io=registry.local/gcr")
+	t.Setenv("INTERNAL_IMAGES_REGISTRY_MIRROR", "harbor.local/proxy/")
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+	path := filepath.Join(t.TempDir(), "digests.yaml")
+	if err := os.WriteFile(path, []byte(consts.InternalImagesBuildkitDefault+": "+digest+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("INTERNAL_IMAGES_DIGESTS_FILE", path)
+
+	conf, err := LoadInternalImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"Curl":            "registry.local/tools/curl:0.0.1",
+		"Kaniko":          "registry.local/gcr/kaniko-project/executor:v1.9.1",
+		"BentoDownloader": "harbor.local/proxy/bentoml/bento-downloader:0.0.3",
+		"Buildkit":        "harbor.local/proxy/bentoml/buildkit:master@" + digest,
+		"Buildah":         "harbor.local/proxy/library/buildah",
+	}
+	images := conf.images()
+	for field, image := range expected {
+		if *images[field] != image {
+			t.Fatalf("%s is %s, expected %s", field, *images[field], image)
+		}
+	}
+
+	mutable := VerifyInternalImages(conf)
+	fields := make([]string, 0, len(mutable))
+	for _, image := range mutable {
+		fields = append(fields, image.Field)
+	}
+	if strings.Join(fields, ",") != "BentoDownloader,Buildah,BuildkitRootless,Curl,Kaniko,MetricsTransformer" {
+		t.Fatalf("unexpected mutable images %v", mutable)
+	}
+	for _, image := range mutable {
+		if image.Field == "BuildkitRootless" && !strings.HasPrefix(image.Reason, "floating tag") {
+			t.Fatalf("buildkit:master-rootless should be reported as a floating tag, got %q", image.Reason)
+		}
+	}
+}
+
+func TestLoadInternalImagesInvalidRule(t *testing.T) {
+	unsetInternalImagesEnv(t)
+	t.Setenv("INTERNAL_IMAGES_REWRITE_RULES", "quay.io")
+
+	conf, err := LoadInternalImages()
+	if err == nil {
+		t.Fatal("expected an error for a rule without a target")
+	}
+	if conf.Curl != consts.InternalImagesCurlDefault {
+		t.Fatalf("the images should fall back to their defaults, curl is %s", conf.Curl)
+	}
+}
@@ -0,0 +1,438 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+type SecretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)
+
+type ConfigMapGetter func(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error)
+
+const (
+	TagEnv       = "env"
+	TagSecret    = "secret"
+	TagConfigMap = "configmap"
+	TagDefault   = "default"
+
+	SourceNameDefault = "default"
+)
+
+// Source is a place configuration values are read from. Each source looks a
+// field up by the key declared in the struct tag returned by Tag.
+type Source interface {
+	Name() string
+	Tag() string
+	Lookup(ctx context.Context, key string) (value string, found bool, err error)
+}
+
+// Origin records where the value of a single field came from.
+type Origin struct {
+	Source string `json:"source" yaml:"source"`
+	Key    string `json:"key,omitempty" yaml:"key,omitempty"`
+	// Ref is the reference the value was resolved from, if any
+	Ref string `json:"ref,omitempty" yaml:"ref,omitempty"`
+	// ResourceVersion is the version of the Secret or ConfigMap the value
+	// was read from, a writer can expect it to be unchanged
+	ResourceVersion string `json:"resource_version,omitempty" yaml:"resource_version,omitempty"`
+
+	raw string
+}
+
+func (o Origin) String() string {
+	s := o.Source
+	if o.Key != "" {
+		s = fmt.Sprintf("%s from %s", o.Key, o.Source)
+	}
+	if o.Ref != "" {
+		s = fmt.Sprintf("%s via %s", s, o.Ref)
+	}
+	return s
+}
+
+// Provenance maps a struct field name to the origin of its value.
+type Provenance map[string]Origin
+
+func (p Provenance) String() string {
+	fields := make([]string, 0, len(p))
+	for field := range p {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	lines := make([]string, 0, len(fields))
+	for _, field := range fields {
+		lines = append(lines, fmt.Sprintf("%s: %s", field, p[field]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type envSource struct{}
+
+func NewEnvSource() Source {
+	return envSource{}
+}
+
+func (envSource) Name() string {
+	return "env"
+}
+
+func (envSource) Tag() string {
+	return TagEnv
+}
+
+func (envSource) Lookup(ctx context.Context, key string) (value string, found bool, err error) {
+	value = os.Getenv(key)
+	found = value != ""
+	return
+}
+
+type secretSource struct {
+	getter    SecretGetter
+	namespace string
+	name      string
+
+	fetched bool
+	data    map[string][]byte
+	version string
+}
+
+// NewSecretSource reads values from the data of a Secret. The Secret is only
+// fetched when a field is not resolved by an earlier source.
+func NewSecretSource(getter SecretGetter, namespace, name string) Source {
+	return &secretSource{
+		getter:    getter,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func (s *secretSource) Name() string {
+	return fmt.Sprintf("secret:%s/%s", s.namespace, s.name)
+}
+
+func (s *secretSource) Tag() string {
+	return TagSecret
+}
+
+func (s *secretSource) Lookup(ctx context.Context, key string) (value string, found bool, err error) {
+	if !s.fetched {
+		var secret *corev1.Secret
+		secret, err = s.getter(ctx, s.namespace, s.name)
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				err = errors.Wrapf(err, "secret %s not found in namespace %s", s.name, s.namespace)
+			}
+			return
+		}
+		s.fetched = true
+		s.data = secret.Data
+		s.version = secret.ResourceVersion
+	}
+	value = string(s.data[key])
+	found = value != ""
+	return
+}
+
+func (s *secretSource) resourceVersion() string {
+	return s.version
+}
+
+type configMapSource struct {
+	getter    ConfigMapGetter
+	namespace string
+	name      string
+
+	fetched bool
+	data    map[string]string
+	version string
+}
+
+// NewConfigMapSource reads values from the data of a ConfigMap. The ConfigMap is
+// only fetched when a field is not resolved by an earlier source.
+func NewConfigMapSource(getter ConfigMapGetter, namespace, name string) Source {
+	return &configMapSource{
+		getter:    getter,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func (s *configMapSource) Name() string {
+	return fmt.Sprintf("configmap:%s/%s", s.namespace, s.name)
+}
+
+func (s *configMapSource) Tag() string {
+	return TagConfigMap
+}
+
+func (s *configMapSource) Lookup(ctx context.Context, key string) (value string, found bool, err error) {
+	if !s.fetched {
+		var configMap *corev1.ConfigMap
+		configMap, err = s.getter(ctx, s.namespace, s.name)
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				err = errors.Wrapf(err, "configmap %s not found in namespace %s", s.name, s.namespace)
+			}
+			return
+		}
+		s.fetched = true
+		s.data = configMap.Data
+		s.version = configMap.ResourceVersion
+	}
+	value = strings.TrimSpace(s.data[key])
+	found = value != ""
+	return
+}
+
+func (s *configMapSource) resourceVersion() string {
+	return s.version
+}
+
+type dirSource struct {
+	dir string
+}
+
+// NewDirSource reads values from a directory holding one file per key, which
+// is how a Secret is laid out when it is mounted as a volume.
+func NewDirSource(dir string) Source {
+	return dirSource{dir: dir}
+}
+
+func (s dirSource) Name() string {
+	return fmt.Sprintf("file:%s", s.dir)
+}
+
+func (s dirSource) Tag() string {
+	return TagSecret
+}
+
+func (s dirSource) Lookup(ctx context.Context, key string) (value string, found bool, err error) {
+	content, err := os.ReadFile(filepath.Join(s.dir, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = errors.Wrapf(err, "failed to read %s from %s", key, s.dir)
+		}
+		return
+	}
+	value = strings.TrimSpace(string(content))
+	found = value != ""
+	return
+}
+
+type onlyKeysSource struct {
+	Source
+	keys map[string]struct{}
+}
+
+// OnlyKeys restricts a source to the given keys, any other key is reported as
+// not found without consulting the source.
+func OnlyKeys(source Source, keys ...string) Source {
+	s := &onlyKeysSource{
+		Source: source,
+		keys:   make(map[string]struct{}, len(keys)),
+	}
+	for _, key := range keys {
+		s.keys[key] = struct{}{}
+	}
+	return s
+}
+
+func (s *onlyKeysSource) Lookup(ctx context.Context, key string) (value string, found bool, err error) {
+	if _, ok := s.keys[key]; !ok {
+		return
+	}
+	return s.Source.Lookup(ctx, key)
+}
+
+func (s *onlyKeysSource) resourceVersion() string {
+	return sourceResourceVersion(s.Source)
+}
+
+type renameKeysSource struct {
+	Source
+	keys map[string]string
+}
+
+// RenameKeys looks the keys of the map up in the source under the key they map
+// to, any other key is reported as not found without consulting the source.
+func RenameKeys(source Source, keys map[string]string) Source {
+	return &renameKeysSource{
+		Source: source,
+		keys:   keys,
+	}
+}
+
+func (s *renameKeysSource) Lookup(ctx context.Context, key string) (value string, found bool, err error) {
+	renamed, ok := s.keys[key]
+	if !ok {
+		return
+	}
+	return s.Source.Lookup(ctx, renamed)
+}
+
+func (s *renameKeysSource) resourceVersion() string {
+	return sourceResourceVersion(s.Source)
+}
+
+type optionalSource struct {
+	Source
+	missing bool
+}
+
+// Optional makes a missing Secret or ConfigMap look like an empty one instead
+// of failing the load.
+func Optional(source Source) Source {
+	return &optionalSource{Source: source}
+}
+
+func (s *optionalSource) Lookup(ctx context.Context, key string) (value string, found bool, err error) {
+	if s.missing {
+		return
+	}
+	value, found, err = s.Source.Lookup(ctx, key)
+	if k8serrors.IsNotFound(err) {
+		s.missing = true
+		err = nil
+	}
+	return
+}
+
+func (s *optionalSource) resourceVersion() string {
+	return sourceResourceVersion(s.Source)
+}
+
+// sourceResourceVersion is the resource version of the object a source read,
+// empty for the sources which do not read an object.
+func sourceResourceVersion(source Source) string {
+	versioned, ok := source.(interface{ resourceVersion() string })
+	if !ok {
+		return ""
+	}
+	return versioned.resourceVersion()
+}
+
+// Loader resolves the fields of a config struct from an ordered list of
+// sources. For every exported field the first source which has a value for
+// the key in its tag wins, otherwise the `default` tag is used. Fields tagged
+// with `ref:"true"` may hold a reference which is resolved to the actual value.
+type Loader struct {
+	sources      []Source
+	secretGetter SecretGetter
+}
+
+func NewLoader(sources ...Source) *Loader {
+	return &Loader{sources: sources}
+}
+
+// WithSecretGetter sets the getter used to resolve secret:// references.
+func (l *Loader) WithSecretGetter(secretGetter SecretGetter) *Loader {
+	l.secretGetter = secretGetter
+	return l
+}
+
+func (l *Loader) Load(ctx context.Context, out interface{}) (provenance Provenance, err error) {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		err = errors.Errorf("config loader expects a pointer to a struct, got %T", out)
+		return
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	provenance = make(Provenance, rt.NumField())
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		var origin Origin
+		var found bool
+		origin, found, err = l.lookup(ctx, field)
+		if err != nil {
+			return
+		}
+		if !found {
+			continue
+		}
+
+		if field.Tag.Get(TagRef) == "true" && isRef(origin.raw) {
+			origin.Ref = origin.raw
+			origin.raw, err = resolveRef(ctx, l.secretGetter, origin.Ref)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to resolve %s from %s", field.Name, origin)
+				return
+			}
+		}
+
+		err = setFieldValue(rv.Field(i), origin.raw)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to set %s from %s", field.Name, origin)
+			return
+		}
+		provenance[field.Name] = origin
+	}
+
+	return
+}
+
+func (l *Loader) lookup(ctx context.Context, field reflect.StructField) (origin Origin, found bool, err error) {
+	for _, source := range l.sources {
+		key, _, _ := strings.Cut(field.Tag.Get(source.Tag()), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		var value string
+		value, found, err = source.Lookup(ctx, key)
+		if err != nil {
+			return
+		}
+		if found {
+			origin = Origin{Source: source.Name(), Key: key, ResourceVersion: sourceResourceVersion(source), raw: value}
+			return
+		}
+	}
+
+	value, ok := field.Tag.Lookup(TagDefault)
+	if ok {
+		origin = Origin{Source: SourceNameDefault, raw: value}
+		found = true
+	}
+	return
+}
+
+func setFieldValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		v.SetBool(raw == "true")
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return errors.Errorf("unsupported slice type %s", v.Type())
+		}
+		items := make([]string, 0)
+		for _, item := range strings.Split(raw, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return errors.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type fakeSecrets map[string]*corev1.Secret
+
+func (f fakeSecrets) get(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	secret, ok := f[namespace+"/"+name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	return secret, nil
+}
+
+type testLoaderConfig struct {
+	Endpoint   string   `env:"TEST_ENDPOINT" secret:"TEST_ENDPOINT"`
+	Username   string   `env:"TEST_USERNAME" secret:"TEST_USERNAME" default:"anonymous"`
+	Secure     bool     `env:"TEST_SECURE" secret:"TEST_SECURE"`
+	Namespaces []string `secret:"TEST_NAMESPACES" default:"yatai"`
+	Ignored    string
+}
+
+func TestLoaderPrecedenceAndProvenance(t *testing.T) {
+	t.Setenv("TEST_ENDPOINT", "from-env")
+
+	secrets := fakeSecrets{
+		"yatai-system/test": {Data: map[string][]byte{
+			"TEST_ENDPOINT":   []byte("from-secret"),
+			"TEST_SECURE":     []byte("true"),
+			"TEST_NAMESPACES": []byte("a, b,,c"),
+		}},
+	}
+
+	conf := &testLoaderConfig{}
+	provenance, err := NewLoader(NewEnvSource(), NewSecretSource(secrets.get, "yatai-system", "test")).Load(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	if conf.Endpoint != "from-env" {
+		t.Fatalf("endpoint is %s", conf.Endpoint)
+	}
+	if !conf.Secure {
+		t.Fatal("secure is false")
+	}
+	if conf.Username != "anonymous" {
+		t.Fatalf("username is %s", conf.Username)
+	}
+	if !reflect.DeepEqual(conf.Namespaces, []string{"a", "b", "c"}) {
+		t.Fatalf("namespaces is %v", conf.Namespaces)
+	}
+
+	expected := map[string]string{
+		"Endpoint":   "TEST_ENDPOINT from env",
+		"Secure":     "TEST_SECURE from secret:yatai-system/test",
+		"Username":   "default",
+		"Namespaces": "TEST_NAMESPACES from secret:yatai-system/test",
+	}
+	for field, origin := range expected {
+		if provenance[field].String() != origin {
+			t.Fatalf("provenance of %s is %q, want %q", field, provenance[field], origin)
+		}
+	}
+	if _, ok := provenance["Ignored"]; ok {
+		t.Fatal("untagged field has a provenance")
+	}
+}
+
+func TestLoaderSecretIsLazy(t *testing.T) {
+	t.Setenv("TEST_ENDPOINT", "from-env")
+	t.Setenv("TEST_USERNAME", "admin")
+	t.Setenv("TEST_SECURE", "true")
+
+	type onlyEnvFields struct {
+		Endpoint string `env:"TEST_ENDPOINT" secret:"TEST_ENDPOINT"`
+		Username string `env:"TEST_USERNAME" secret:"TEST_USERNAME"`
+	}
+
+	conf := &onlyEnvFields{}
+	_, err := NewLoader(NewEnvSource(), NewSecretSource(fakeSecrets{}.get, "yatai-system", "missing")).Load(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("the secret should not be fetched: %v", err)
+	}
+
+	_, err = NewLoader(NewEnvSource(), NewSecretSource(fakeSecrets{}.get, "yatai-system", "missing")).Load(context.Background(), &testLoaderConfig{})
+	if !k8serrors.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestLoaderOnlyKeysAndDirSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "TEST_USERNAME"), []byte("mounted\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := fakeSecrets{
+		"yatai-system/test": {Data: map[string][]byte{
+			"TEST_ENDPOINT": []byte("from-secret"),
+			"TEST_USERNAME": []byte("from-secret"),
+		}},
+	}
+
+	conf := &testLoaderConfig{}
+	provenance, err := NewLoader(
+		NewDirSource(dir),
+		OnlyKeys(NewSecretSource(secrets.get, "yatai-system", "test"), "TEST_ENDPOINT"),
+	).Load(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	if conf.Username != "mounted" {
+		t.Fatalf("username is %s", conf.Username)
+	}
+	if provenance["Username"].Source != "file:"+dir {
+		t.Fatalf("username provenance is %s", provenance["Username"])
+	}
+	if conf.Endpoint != "from-secret" {
+		t.Fatalf("endpoint is %s", conf.Endpoint)
+	}
+}
+
+func TestGetDockerRegistryConfigFromSecret(t *testing.T) {
+	t.Setenv("YATAI_SYSTEM_NAMESPACE", "yatai-system")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+	t.Setenv("DOCKER_REGISTRY_USERNAME", "")
+
+	secrets := fakeSecrets{
+		"yatai-system/yatai-image-builder-shared-env": {Data: map[string][]byte{
+			"DOCKER_REGISTRY_SERVER":   []byte("registry.example.com"),
+			"DOCKER_REGISTRY_USERNAME": []byte("robot"),
+			"DOCKER_REGISTRY_SECURE":   []byte("true"),
+		}},
+	}
+
+	conf, err := GetDockerRegistryConfig(context.Background(), secrets.get)
+	if err != nil {
+		t.Fatalf("get docker registry config failed: %v", err)
+	}
+	if conf.Server != "registry.example.com" || conf.Username != "robot" || !conf.Secure {
+		t.Fatalf("unexpected config %+v", conf)
+	}
+	if conf.Provenance()["Server"].Source != "secret:yatai-system/yatai-image-builder-shared-env" {
+		t.Fatalf("unexpected provenance %s", conf.Provenance())
+	}
+}
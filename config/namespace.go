@@ -0,0 +1,339 @@
+package config
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+// ClusterGetter reads the objects configs are resolved from.
+type ClusterGetter interface {
+	GetSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error)
+	GetConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error)
+	ListSecrets(ctx context.Context, namespace string, selector labels.Selector) ([]*corev1.Secret, error)
+	GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error)
+	ListNamespaces(ctx context.Context, selector labels.Selector) ([]*corev1.Namespace, error)
+}
+
+type clientsetGetter struct {
+	cliset kubernetes.Interface
+}
+
+// NewClientsetGetter returns a ClusterGetter which calls the API server.
+func NewClientsetGetter(cliset kubernetes.Interface) ClusterGetter {
+	return &clientsetGetter{
+		cliset: cliset,
+	}
+}
+
+func (g *clientsetGetter) GetSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	return g.cliset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (g *clientsetGetter) GetConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+	return g.cliset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (g *clientsetGetter) ListSecrets(ctx context.Context, namespace string, selector labels.Selector) ([]*corev1.Secret, error) {
+	list, err := g.cliset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]*corev1.Secret, 0, len(list.Items))
+	for i := range list.Items {
+		secrets = append(secrets, &list.Items[i])
+	}
+	return secrets, nil
+}
+
+func (g *clientsetGetter) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	return g.cliset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (g *clientsetGetter) ListNamespaces(ctx context.Context, selector labels.Selector) ([]*corev1.Namespace, error) {
+	list, err := g.cliset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]*corev1.Namespace, 0, len(list.Items))
+	for i := range list.Items {
+		namespaces = append(namespaces, &list.Items[i])
+	}
+	return namespaces, nil
+}
+
+type listerGetter struct {
+	secretLister    corev1listers.SecretLister
+	configMapLister corev1listers.ConfigMapLister
+	namespaceLister corev1listers.NamespaceLister
+}
+
+// NewListerGetter returns a ClusterGetter which reads informer caches.
+func NewListerGetter(secretLister corev1listers.SecretLister, configMapLister corev1listers.ConfigMapLister, namespaceLister corev1listers.NamespaceLister) ClusterGetter {
+	return &listerGetter{
+		secretLister:    secretLister,
+		configMapLister: configMapLister,
+		namespaceLister: namespaceLister,
+	}
+}
+
+func (g *listerGetter) GetSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	return g.secretLister.Secrets(namespace).Get(name)
+}
+
+func (g *listerGetter) GetConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+	return g.configMapLister.ConfigMaps(namespace).Get(name)
+}
+
+func (g *listerGetter) ListSecrets(ctx context.Context, namespace string, selector labels.Selector) ([]*corev1.Secret, error) {
+	return g.secretLister.Secrets(namespace).List(selector)
+}
+
+func (g *listerGetter) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	return g.namespaceLister.Get(name)
+}
+
+func (g *listerGetter) ListNamespaces(ctx context.Context, selector labels.Selector) ([]*corev1.Namespace, error) {
+	return g.namespaceLister.List(selector)
+}
+
+type namespaceCacheEntry struct {
+	namespaces []string
+	expireAt   time.Time
+}
+
+const (
+	namespaceCacheKeyComponentPrefix = "component:"
+	namespaceCacheKeyImageBuilders   = "image-builders"
+	namespaceCacheKeyBentoDeployment = "bento-deployment"
+)
+
+// NamespaceResolver resolves the namespaces of the yatai components and
+// caches them for ttl, a ttl of zero caches them until Invalidate is called,
+// which InvalidateOn does whenever the shared env secrets or the namespaces
+// change.
+type NamespaceResolver struct {
+	getter ClusterGetter
+	ttl    time.Duration
+
+	lock  sync.Mutex
+	cache map[string]namespaceCacheEntry
+}
+
+func NewNamespaceResolver(getter ClusterGetter, ttl time.Duration) *NamespaceResolver {
+	return &NamespaceResolver{
+		getter: getter,
+		ttl:    ttl,
+		cache:  make(map[string]namespaceCacheEntry),
+	}
+}
+
+func (r *NamespaceResolver) YataiImageBuilderNamespace(ctx context.Context) (string, error) {
+	return r.ComponentNamespace(ctx, consts.YataiImageBuilderComponentName)
+}
+
+func (r *NamespaceResolver) YataiDeploymentNamespace(ctx context.Context) (string, error) {
+	return r.ComponentNamespace(ctx, consts.YataiDeploymentComponentName)
+}
+
+// ComponentNamespace returns the namespace of a registered component.
+func (r *NamespaceResolver) ComponentNamespace(ctx context.Context, name string) (string, error) {
+	return r.resolveOne(ctx, namespaceCacheKeyComponentPrefix+name, func(ctx context.Context) (string, error) {
+		return GetComponentNamespace(ctx, r.getter.GetSecret, name)
+	})
+}
+
+func (r *NamespaceResolver) ImageBuildersNamespace(ctx context.Context) (string, error) {
+	return r.resolveOne(ctx, namespaceCacheKeyImageBuilders, func(ctx context.Context) (string, error) {
+		return getImageBuildersNamespace(ctx, r.getter.GetSecret)
+	})
+}
+
+// BentoDeploymentNamespaces returns the namespaces bentos are deployed to.
+// Entries of BENTO_DEPLOYMENT_NAMESPACES are namespace names or globs like
+// "team-*", and BENTO_DEPLOYMENT_NAMESPACE_SELECTOR adds the namespaces
+// matching a label selector. Names are kept whether the namespace exists or
+// not, globs and the selector only match existing namespaces.
+func (r *NamespaceResolver) BentoDeploymentNamespaces(ctx context.Context) (namespaces []string, err error) {
+	if cached, ok := r.cached(namespaceCacheKeyBentoDeployment); ok {
+		return append([]string(nil), cached...), nil
+	}
+
+	conf, err := getBentoDeploymentNamespacesConfig(ctx, r.getter.GetSecret)
+	if err != nil {
+		return
+	}
+
+	namespaces, err = r.expandNamespaces(ctx, conf.Namespaces, conf.Selector)
+	if err != nil {
+		return
+	}
+
+	r.store(namespaceCacheKeyBentoDeployment, append([]string(nil), namespaces...))
+	return
+}
+
+func (r *NamespaceResolver) expandNamespaces(ctx context.Context, patterns []string, selector string) (namespaces []string, err error) {
+	seen := make(map[string]struct{})
+	globs := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?[") {
+			if _, err = path.Match(pattern, ""); err != nil {
+				err = errors.Wrapf(err, "invalid namespace pattern %q in %s", pattern, consts.EnvBentoDeploymentNamespaces)
+				return
+			}
+			globs = append(globs, pattern)
+			continue
+		}
+		if _, ok := seen[pattern]; !ok {
+			seen[pattern] = struct{}{}
+			namespaces = append(namespaces, pattern)
+		}
+	}
+
+	if len(globs) == 0 && selector == "" {
+		return
+	}
+
+	matched := make([]string, 0)
+	add := func(name string) {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			matched = append(matched, name)
+		}
+	}
+
+	if len(globs) != 0 {
+		var all []*corev1.Namespace
+		all, err = r.getter.ListNamespaces(ctx, labels.Everything())
+		if err != nil {
+			err = errors.Wrap(err, "failed to list namespaces")
+			return
+		}
+		for _, namespace := range all {
+			for _, glob := range globs {
+				if ok, _ := path.Match(glob, namespace.Name); ok {
+					add(namespace.Name)
+					break
+				}
+			}
+		}
+	}
+
+	if selector != "" {
+		var parsed labels.Selector
+		parsed, err = labels.Parse(selector)
+		if err != nil {
+			err = errors.Wrapf(err, "invalid %s", consts.EnvBentoDeploymentNamespaceSelector)
+			return
+		}
+		var selected []*corev1.Namespace
+		selected, err = r.getter.ListNamespaces(ctx, parsed)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to list namespaces matching %s", selector)
+			return
+		}
+		for _, namespace := range selected {
+			add(namespace.Name)
+		}
+	}
+
+	sort.Strings(matched)
+	namespaces = append(namespaces, matched...)
+	return
+}
+
+// Invalidate drops the cached namespaces.
+func (r *NamespaceResolver) Invalidate() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cache = make(map[string]namespaceCacheEntry)
+}
+
+// InvalidateOn drops the cached namespaces whenever one of the shared env
+// secrets or a namespace changes in the given Secret or Namespace informers.
+func (r *NamespaceResolver) InvalidateOn(informers ...cache.SharedInformer) {
+	yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
+	handler := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		switch o := obj.(type) {
+		case *corev1.Secret:
+			if o.Namespace != yataiSystemNamespace {
+				return
+			}
+			for _, component := range GetComponents() {
+				if o.Name == component.SharedEnvSecretName {
+					r.Invalidate()
+					return
+				}
+			}
+		case *corev1.Namespace:
+			// only the globs and the selector depend on namespaces
+			r.lock.Lock()
+			delete(r.cache, namespaceCacheKeyBentoDeployment)
+			r.lock.Unlock()
+		}
+	}
+	for _, informer := range informers {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: handler,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				handler(newObj)
+			},
+			DeleteFunc: handler,
+		})
+	}
+}
+
+func (r *NamespaceResolver) resolveOne(ctx context.Context, key string, resolve func(ctx context.Context) (string, error)) (namespace string, err error) {
+	if namespaces, ok := r.cached(key); ok {
+		return namespaces[0], nil
+	}
+	namespace, err = resolve(ctx)
+	if err != nil {
+		return
+	}
+	r.store(key, []string{namespace})
+	return
+}
+
+func (r *NamespaceResolver) cached(key string) ([]string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if !entry.expireAt.IsZero() && time.Now().After(entry.expireAt) {
+		delete(r.cache, key)
+		return nil, false
+	}
+	return entry.namespaces, true
+}
+
+func (r *NamespaceResolver) store(key string, namespaces []string) {
+	entry := namespaceCacheEntry{
+		namespaces: namespaces,
+	}
+	if r.ttl > 0 {
+		entry.expireAt = time.Now().Add(r.ttl)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cache[key] = entry
+}
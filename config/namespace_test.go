@@ -0,0 +1,102 @@
+package config
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+func TestNamespaceResolverCaches(t *testing.T) {
+	t.Setenv("YATAI_IMAGE_BUILDER_NAMESPACE", "")
+
+	cliset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeSecretNameYataiImageBuilderSharedEnv},
+		Data:       map[string][]byte{"YATAI_IMAGE_BUILDER_NAMESPACE": []byte("builder")},
+	})
+	gets := 0
+	cliset.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+
+	resolver := NewNamespaceResolver(NewClientsetGetter(cliset), time.Hour)
+	for i := 0; i < 3; i++ {
+		namespace, err := resolver.YataiImageBuilderNamespace(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if namespace != "builder" {
+			t.Fatalf("namespace is %s", namespace)
+		}
+	}
+	if gets != 1 {
+		t.Fatalf("expected the secret to be fetched once, got %d", gets)
+	}
+
+	resolver.Invalidate()
+	if _, err := resolver.YataiImageBuilderNamespace(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if gets != 2 {
+		t.Fatalf("expected the secret to be fetched again after invalidation, got %d", gets)
+	}
+}
+
+func TestNamespaceResolverBentoDeploymentNamespaces(t *testing.T) {
+	t.Setenv("BENTO_DEPLOYMENT_NAMESPACES", "yatai, team-*, missing")
+	t.Setenv("BENTO_DEPLOYMENT_NAMESPACE_SELECTOR", "yatai.ai/bento-deployment=true")
+
+	namespace := func(name string, labels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	cliset := fake.NewSimpleClientset(
+		namespace("yatai", nil),
+		namespace("team-b", nil),
+		namespace("team-a", nil),
+		namespace("labelled", map[string]string{"yatai.ai/bento-deployment": "true"}),
+		namespace("other", nil),
+	)
+
+	namespaces, err := NewNamespaceResolver(NewClientsetGetter(cliset), 0).BentoDeploymentNamespaces(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(namespaces, ","); got != "yatai,missing,labelled,team-a,team-b" {
+		t.Fatalf("namespaces are %s", got)
+	}
+}
+
+func TestBentoDeploymentNamespacesFromEnvWithoutSecret(t *testing.T) {
+	t.Setenv("BENTO_DEPLOYMENT_NAMESPACES", "yatai,team-a")
+	t.Setenv("BENTO_DEPLOYMENT_NAMESPACE_SELECTOR", "")
+
+	cliset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "yatai"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+	)
+
+	namespaces, err := GetBentoDeploymentNamespaces(context.Background(), NewClientsetGetter(cliset).GetSecret)
+	if err != nil {
+		t.Fatalf("the namespaces set in the environment should not need the secret: %v", err)
+	}
+	if strings.Join(namespaces, ",") != "yatai,team-a" {
+		t.Fatalf("unexpected namespaces %v", namespaces)
+	}
+
+	namespaces, err = NewNamespaceResolver(NewClientsetGetter(cliset), 0).BentoDeploymentNamespaces(context.Background())
+	if err != nil {
+		t.Fatalf("the namespaces set in the environment should not need the secret: %v", err)
+	}
+	if strings.Join(namespaces, ",") != "yatai,team-a" {
+		t.Fatalf("unexpected namespaces %v", namespaces)
+	}
+}
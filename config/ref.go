@@ -0,0 +1,98 @@
+package config
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+const (
+	TagRef = "ref"
+
+	// RefSchemeSecret references a key of a Secret: secret://[namespace/]name/key,
+	// the namespace defaults to the yatai system namespace.
+	RefSchemeSecret = "secret://"
+	// RefSchemeFile references a mounted file: file:///var/run/secrets/registry/password
+	RefSchemeFile = "file://"
+	// RefSchemeEnv references another environment variable: env://REGISTRY_PASSWORD
+	RefSchemeEnv = "env://"
+)
+
+func isRef(value string) bool {
+	return strings.HasPrefix(value, RefSchemeSecret) || strings.HasPrefix(value, RefSchemeFile) || strings.HasPrefix(value, RefSchemeEnv)
+}
+
+// resolveRef returns the value a reference points to, values which are not a
+// reference are returned as is.
+func resolveRef(ctx context.Context, secretGetter SecretGetter, ref string) (value string, err error) {
+	switch {
+	case strings.HasPrefix(ref, RefSchemeSecret):
+		return resolveSecretRef(ctx, secretGetter, strings.TrimPrefix(ref, RefSchemeSecret))
+	case strings.HasPrefix(ref, RefSchemeFile):
+		path := strings.TrimPrefix(ref, RefSchemeFile)
+		var content []byte
+		content, err = os.ReadFile(path)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to read the file %s", path)
+			return
+		}
+		value = strings.TrimSpace(string(content))
+	case strings.HasPrefix(ref, RefSchemeEnv):
+		key := strings.TrimPrefix(ref, RefSchemeEnv)
+		value = os.Getenv(key)
+		if value == "" {
+			err = errors.Wrapf(consts.ErrNotFound, "the environment variable %s is not set", key)
+			return
+		}
+	default:
+		value = ref
+		return
+	}
+
+	if value == "" {
+		err = errors.Errorf("%s resolves to an empty value", ref)
+	}
+	return
+}
+
+func resolveSecretRef(ctx context.Context, secretGetter SecretGetter, ref string) (value string, err error) {
+	pieces := strings.Split(ref, "/")
+	var namespace, name, key string
+	switch len(pieces) {
+	case 2:
+		namespace, name, key = GetYataiSystemNamespaceFromEnv(), pieces[0], pieces[1]
+	case 3:
+		namespace, name, key = pieces[0], pieces[1], pieces[2]
+	default:
+		err = errors.Errorf("invalid secret reference %s%s, expected %s[namespace/]name/key", RefSchemeSecret, ref, RefSchemeSecret)
+		return
+	}
+
+	if secretGetter == nil {
+		err = errors.Errorf("cannot resolve the secret reference %s%s without a secret getter", RefSchemeSecret, ref)
+		return
+	}
+
+	var secret *corev1.Secret
+	secret, err = secretGetter(ctx, namespace, name)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			err = errors.Wrapf(err, "secret %s not found in namespace %s", name, namespace)
+		}
+		return
+	}
+
+	data, ok := secret.Data[key]
+	if !ok {
+		err = errors.Errorf("key %s not found in secret %s in namespace %s", key, name, namespace)
+		return
+	}
+	value = string(data)
+	return
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGetDockerRegistryConfigResolvesRefs(t *testing.T) {
+	t.Setenv("YATAI_SYSTEM_NAMESPACE", "yatai-system")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "registry.example.com")
+	t.Setenv("DOCKER_REGISTRY_USERNAME", "robot")
+
+	secrets := fakeSecrets{
+		"registry/credentials": {Data: map[string][]byte{"password": []byte("from-secret")}},
+		"yatai-system/robot":   {Data: map[string][]byte{"password": []byte("from-default-namespace")}},
+	}
+
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REGISTRY_PASSWORD", "from-env")
+
+	for ref, expected := range map[string]string{
+		"secret://registry/credentials/password": "from-secret",
+		"secret://robot/password":                "from-default-namespace",
+		"file://" + passwordFile:                 "from-file",
+		"env://REGISTRY_PASSWORD":                "from-env",
+		"plain-password":                         "plain-password",
+	} {
+		t.Setenv("DOCKER_REGISTRY_PASSWORD", ref)
+
+		conf, err := GetDockerRegistryConfig(context.Background(), secrets.get)
+		if err != nil {
+			t.Fatalf("%s: get docker registry config failed: %v", ref, err)
+		}
+		if conf.Password != expected {
+			t.Fatalf("%s: password is %s, want %s", ref, conf.Password, expected)
+		}
+		if isRef(ref) && conf.Provenance()["Password"].Ref != ref {
+			t.Fatalf("%s: unexpected provenance %s", ref, conf.Provenance()["Password"])
+		}
+	}
+}
+
+func TestResolveRefErrors(t *testing.T) {
+	secretGetter := fakeSecrets{"yatai-system/robot": {Data: map[string][]byte{}}}.get
+
+	for _, ref := range []string{
+		"secret://robot",
+		"secret://robot/missing-key",
+		"secret://missing/password",
+		"file:///does/not/exist",
+		"env://YATAI_TEST_UNSET_VARIABLE",
+	} {
+		if _, err := resolveRef(context.Background(), secretGetter, ref); err == nil {
+			t.Fatalf("%s: expected an error", ref)
+		}
+	}
+
+	var nilGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)
+	if _, err := resolveRef(context.Background(), nilGetter, "secret://robot/password"); err == nil {
+		t.Fatal("expected an error without a secret getter")
+	}
+}
@@ -0,0 +1,280 @@
+package config
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+type ImageKind string
+
+const (
+	ImageKindBento ImageKind = "bento"
+	ImageKindModel ImageKind = "model"
+)
+
+// NamedDockerRegistryConfig is a registry of a DockerRegistrySet.
+type NamedDockerRegistryConfig struct {
+	Name                 string `yaml:"name"`
+	DockerRegistryConfig `yaml:",inline"`
+}
+
+// DockerRegistryRoute picks the registry, and optionally the repository, the
+// images of a kind are pushed to.
+type DockerRegistryRoute struct {
+	Kind       ImageKind `yaml:"kind"`
+	Registry   string    `yaml:"registry"`
+	Repository string    `yaml:"repository"`
+}
+
+// DockerRegistrySet is a set of registries, images are pushed to the registry
+// routed for their kind, registries without a route (e.g. mirrors) only
+// contribute their credentials to the regcred secret:
+//
+//	docker_registry:
+//	  registries:
+//	  - name: bentos
+//	    server: bentos.example.com
+//	    username: robot
+//	    password: secret://registry-credentials/password
+//	  - name: models
+//	    server: 123456789012.dkr.ecr.us-west-2.amazonaws.com
+//	    aws_ecr_with_iam_role: true
+//	  - name: mirror
+//	    server: mirror.example.com
+//	    in_cluster_server: mirror.registry.svc.cluster.local
+//	    secure: true
+//	    ca_bundle: |
+//	      -----BEGIN CERTIFICATE-----
+//	      ...
+//	      -----END CERTIFICATE-----
+//	  routes:
+//	  - kind: bento
+//	    registry: bentos
+//	    repository: yatai-bentos
+//	  - kind: model
+//	    registry: models
+//	    repository: yatai-models
+type DockerRegistrySet struct {
+	Registries []*NamedDockerRegistryConfig `yaml:"registries"`
+	Routes     []DockerRegistryRoute        `yaml:"routes"`
+}
+
+type dockerRegistrySetConfig struct {
+	Registries string `yaml:"registries" env:"DOCKER_REGISTRIES" secret:"DOCKER_REGISTRIES"`
+	Routes     string `yaml:"routes" env:"DOCKER_REGISTRY_ROUTES" secret:"DOCKER_REGISTRY_ROUTES"`
+
+	// tell whether the single registry layout is configured locally
+	Server            string `yaml:"server" env:"DOCKER_REGISTRY_SERVER"`
+	AWSECRWithIAMRole bool   `yaml:"aws_ecr_with_iam_role" env:"AWS_ECR_WITH_IAM_ROLE"`
+}
+
+// GetDockerRegistrySet reads the registries from DOCKER_REGISTRIES and their
+// routes from DOCKER_REGISTRY_ROUTES, both are yaml (or json) lists which may
+// be set in the environment, in the config file or in the yatai-image-builder
+// shared env secret. Without DOCKER_REGISTRIES the set consists of the single
+// registry returned by GetDockerRegistryConfig, used for all images.
+func GetDockerRegistrySet(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (set *DockerRegistrySet, err error) {
+	sources := localSources(FileSectionDockerRegistry)
+
+	conf := &dockerRegistrySetConfig{}
+	_, err = NewLoader(sources...).Load(ctx, conf)
+	if err != nil {
+		return
+	}
+
+	if conf.Registries == "" && conf.Server == "" && !conf.AWSECRWithIAMRole && secretGetter != nil {
+		sources = append(sources, OnlyKeys(NewSecretSource(secretGetter, GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiImageBuilderSharedEnv), consts.EnvDockerRegistries, consts.EnvDockerRegistryRoutes))
+		conf = &dockerRegistrySetConfig{}
+		_, err = NewLoader(sources...).Load(ctx, conf)
+		if err != nil {
+			return
+		}
+	}
+
+	if conf.Registries == "" {
+		var dockerRegistry *DockerRegistryConfig
+		dockerRegistry, err = GetDockerRegistryConfig(ctx, secretGetter)
+		if err != nil {
+			return
+		}
+		set = &DockerRegistrySet{
+			Registries: []*NamedDockerRegistryConfig{{
+				Name:                 "default",
+				DockerRegistryConfig: *dockerRegistry,
+			}},
+		}
+		return
+	}
+
+	set = &DockerRegistrySet{}
+	err = yaml.Unmarshal([]byte(conf.Registries), &set.Registries)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to yaml unmarshal %s", consts.EnvDockerRegistries)
+		return
+	}
+	if conf.Routes != "" {
+		err = yaml.Unmarshal([]byte(conf.Routes), &set.Routes)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to yaml unmarshal %s", consts.EnvDockerRegistryRoutes)
+			return
+		}
+	}
+
+	err = set.Validate()
+	if err != nil {
+		return
+	}
+
+	for _, registry := range set.Registries {
+		if isRef(registry.Password) {
+			registry.Password, err = resolveRef(ctx, secretGetter, registry.Password)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to resolve the password of registry %s", registry.Name)
+				return
+			}
+		}
+		if registry.AWSECRWithIAMRole {
+			err = registry.resolveECRCredentials(ctx, DefaultECRAuthorizationTokenGetter)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to resolve ecr credentials of registry %s", registry.Name)
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Validate checks the registries and routes of the set and returns a
+// *ValidationError listing all the problems found.
+func (s *DockerRegistrySet) Validate() error {
+	err := &ValidationError{Config: "DockerRegistrySet"}
+	add := func(field, format string, args ...interface{}) {
+		key := consts.EnvDockerRegistries
+		if strings.HasPrefix(field, "Routes") {
+			key = consts.EnvDockerRegistryRoutes
+		}
+		err.Fields = append(err.Fields, FieldError{
+			Field:  field,
+			Key:    key,
+			Reason: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(s.Registries) == 0 {
+		add("Registries", "is required")
+	}
+
+	names := make(map[string]struct{}, len(s.Registries))
+	for i, registry := range s.Registries {
+		field := fmt.Sprintf("Registries[%d]", i)
+		if registry.Name == "" {
+			add(field+".Name", "is required")
+		} else if _, ok := names[registry.Name]; ok {
+			add(field+".Name", "duplicates the registry %s", registry.Name)
+		}
+		names[registry.Name] = struct{}{}
+		if registry.Server == "" && !registry.AWSECRWithIAMRole {
+			add(field+".Server", "is required")
+		}
+		if registry.CABundle != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(registry.CABundle)) {
+			add(field+".CABundle", "has no PEM encoded certificate")
+		}
+	}
+
+	kinds := make(map[ImageKind]struct{}, len(s.Routes))
+	for i, route := range s.Routes {
+		field := fmt.Sprintf("Routes[%d]", i)
+		if route.Kind != ImageKindBento && route.Kind != ImageKindModel {
+			add(field+".Kind", "must be %s or %s, got %q", ImageKindBento, ImageKindModel, route.Kind)
+		} else if _, ok := kinds[route.Kind]; ok {
+			add(field+".Kind", "duplicates the route of %s images", route.Kind)
+		}
+		kinds[route.Kind] = struct{}{}
+		if _, ok := names[route.Registry]; !ok {
+			add(field+".Registry", "refers to the unknown registry %q", route.Registry)
+		}
+		if route.Repository != "" && !repositoryNameRegexp.MatchString(route.Repository) {
+			add(field+".Repository", "is not a valid repository name: %q", route.Repository)
+		}
+	}
+
+	if len(err.Fields) == 0 {
+		return nil
+	}
+	return err
+}
+
+// ForImageKind returns the registry images of the kind are pushed to, with the
+// repository of the route applied. When the kind has no route the set must
+// hold a single registry.
+func (s *DockerRegistrySet) ForImageKind(kind ImageKind) (conf *DockerRegistryConfig, err error) {
+	var registry *NamedDockerRegistryConfig
+	var repository string
+
+	for _, route := range s.Routes {
+		if route.Kind != kind {
+			continue
+		}
+		registry = s.Get(route.Registry)
+		if registry == nil {
+			err = errors.Wrapf(consts.ErrNotFound, "the registry %s routed for %s images", route.Registry, kind)
+			return
+		}
+		repository = route.Repository
+		break
+	}
+
+	if registry == nil {
+		if len(s.Registries) != 1 {
+			err = errors.Wrapf(consts.ErrNotFound, "no registry is routed for %s images", kind)
+			return
+		}
+		registry = s.Registries[0]
+	}
+
+	copied := registry.DockerRegistryConfig
+	conf = &copied
+	if repository != "" {
+		switch kind {
+		case ImageKindBento:
+			conf.BentoRepositoryName = repository
+		case ImageKindModel:
+			conf.ModelRepositoryName = repository
+		}
+	}
+	return
+}
+
+func (s *DockerRegistrySet) Get(name string) *NamedDockerRegistryConfig {
+	for _, registry := range s.Registries {
+		if registry.Name == name {
+			return registry
+		}
+	}
+	return nil
+}
+
+// CredentialsExpireAt returns when the earliest expiring credentials of the
+// set stop working, it is zero if none of them expire.
+func (s *DockerRegistrySet) CredentialsExpireAt() (expireAt time.Time) {
+	for _, registry := range s.Registries {
+		registryExpireAt := registry.CredentialsExpireAt()
+		if registryExpireAt.IsZero() {
+			continue
+		}
+		if expireAt.IsZero() || registryExpireAt.Before(expireAt) {
+			expireAt = registryExpireAt
+		}
+	}
+	return
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRegistrySetConfigFile = `
+docker_registry:
+  registries:
+  - name: bentos
+    server: bentos.example.com
+    username: robot
+    password: secret://registry-credentials/password
+  - name: models
+    server: models.example.com
+    in_cluster_server: models.registry.svc.cluster.local
+    username: robot
+    password: ${TEST_MODELS_PASSWORD}
+    secure: true
+  - name: mirror
+    server: mirror.example.com
+  routes:
+  - kind: bento
+    registry: bentos
+    repository: yatai-bentos
+  - kind: model
+    registry: models
+`
+
+func TestGetDockerRegistrySetFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testRegistrySetConfigFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("YATAI_CONFIG_FILE", path)
+	t.Setenv("DOCKER_REGISTRIES", "")
+	t.Setenv("DOCKER_REGISTRY_ROUTES", "")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+	t.Setenv("TEST_MODELS_PASSWORD", "models-password")
+
+	secrets := fakeSecrets{
+		"yatai-system/registry-credentials": {Data: map[string][]byte{"password": []byte("bentos-password")}},
+	}
+
+	set, err := GetDockerRegistrySet(context.Background(), secrets.get)
+	if err != nil {
+		t.Fatalf("get docker registry set failed: %v", err)
+	}
+	if len(set.Registries) != 3 {
+		t.Fatalf("unexpected registries %+v", set.Registries)
+	}
+	if bentos := set.Get("bentos"); bentos.Password != "bentos-password" {
+		t.Fatalf("unexpected bentos registry %+v", bentos)
+	}
+
+	bento, err := set.ForImageKind(ImageKindBento)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bento.Server != "bentos.example.com" || bento.BentoRepositoryName != "yatai-bentos" {
+		t.Fatalf("unexpected bento registry %+v", bento)
+	}
+
+	model, err := set.ForImageKind(ImageKindModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.Server != "models.example.com" || model.InClusterServer != "models.registry.svc.cluster.local" || model.Password != "models-password" || !model.Secure {
+		t.Fatalf("unexpected model registry %+v", model)
+	}
+}
+
+func TestGetDockerRegistrySetFallsBackToSingleRegistry(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("DOCKER_REGISTRIES", "")
+	t.Setenv("DOCKER_REGISTRY_ROUTES", "")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+	t.Setenv("AWS_ECR_WITH_IAM_ROLE", "")
+
+	secrets := fakeSecrets{
+		"yatai-system/yatai-image-builder-shared-env": {Data: map[string][]byte{
+			"DOCKER_REGISTRY_SERVER":                []byte("registry.example.com"),
+			"DOCKER_REGISTRY_BENTO_REPOSITORY_NAME": []byte("bentos"),
+		}},
+	}
+
+	set, err := GetDockerRegistrySet(context.Background(), secrets.get)
+	if err != nil {
+		t.Fatalf("get docker registry set failed: %v", err)
+	}
+	for _, kind := range []ImageKind{ImageKindBento, ImageKindModel} {
+		conf, err := set.ForImageKind(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.Server != "registry.example.com" || conf.BentoRepositoryName != "bentos" {
+			t.Fatalf("unexpected %s registry %+v", kind, conf)
+		}
+	}
+}
+
+func TestGetDockerRegistrySetFromSecret(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("DOCKER_REGISTRIES", "")
+	t.Setenv("DOCKER_REGISTRY_ROUTES", "")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+
+	secrets := fakeSecrets{
+		"yatai-system/yatai-image-builder-shared-env": {Data: map[string][]byte{
+			"DOCKER_REGISTRIES":      []byte(`[{"name": "a", "server": "a.example.com"}, {"name": "b", "server": "b.example.com"}]`),
+			"DOCKER_REGISTRY_ROUTES": []byte(`[{"kind": "model", "registry": "b"}]`),
+		}},
+	}
+
+	set, err := GetDockerRegistrySet(context.Background(), secrets.get)
+	if err != nil {
+		t.Fatalf("get docker registry set failed: %v", err)
+	}
+	model, err := set.ForImageKind(ImageKindModel)
+	if err != nil || model.Server != "b.example.com" {
+		t.Fatalf("unexpected model registry %+v: %v", model, err)
+	}
+	if _, err = set.ForImageKind(ImageKindBento); err == nil {
+		t.Fatal("expected an error for an image kind without a route")
+	}
+}
+
+func TestDockerRegistrySetValidate(t *testing.T) {
+	set := &DockerRegistrySet{
+		Registries: []*NamedDockerRegistryConfig{
+			{Name: "a", DockerRegistryConfig: DockerRegistryConfig{Server: "a.example.com"}},
+			{Name: "a", DockerRegistryConfig: DockerRegistryConfig{Server: "b.example.com", CABundle: "not a certificate"}},
+			{Name: "c"},
+		},
+		Routes: []DockerRegistryRoute{
+			{Kind: "chart", Registry: "a"},
+			{Kind: ImageKindBento, Registry: "missing", Repository: "Bentos"},
+		},
+	}
+
+	err := set.Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	got := make([]string, 0, len(verr.Fields))
+	for _, field := range verr.Fields {
+		got = append(got, field.Field)
+	}
+	expected := "Registries[1].Name,Registries[1].CABundle,Registries[2].Server,Routes[0].Kind,Routes[1].Registry,Routes[1].Repository"
+	if strings.Join(got, ",") != expected {
+		t.Fatalf("expected errors on %s, got %s", expected, strings.Join(got, ","))
+	}
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+type S3CredentialMode string
+
+const (
+	// S3CredentialModeStatic uses the access key and secret key of the config.
+	S3CredentialModeStatic S3CredentialMode = "static"
+	// S3CredentialModeAWSWebIdentity exchanges the service account token mounted by
+	// IRSA (AWS_WEB_IDENTITY_TOKEN_FILE) for the role in AWS_ROLE_ARN.
+	S3CredentialModeAWSWebIdentity S3CredentialMode = "aws-web-identity"
+	// S3CredentialModeAWSInstanceProfile reads the credentials of the EC2 instance
+	// profile from the instance metadata service.
+	S3CredentialModeAWSInstanceProfile S3CredentialMode = "aws-instance-profile"
+	// S3CredentialModeEnv tries the AWS and MinIO environment variables, the AWS
+	// shared credentials file and then IAM, in this order.
+	S3CredentialModeEnv S3CredentialMode = "env"
+	// S3CredentialModeGCSHMAC uses the HMAC keys of a GCP service account against
+	// the GCS XML API, the keys default to GCP_ACCESS_KEY_ID and GCP_SECRET_ACCESS_KEY
+	// and the endpoint to storage.googleapis.com.
+	S3CredentialModeGCSHMAC S3CredentialMode = "gcs-hmac"
+)
+
+var S3CredentialModes = []S3CredentialMode{
+	S3CredentialModeStatic,
+	S3CredentialModeAWSWebIdentity,
+	S3CredentialModeAWSInstanceProfile,
+	S3CredentialModeEnv,
+	S3CredentialModeGCSHMAC,
+}
+
+func (m S3CredentialMode) IsValid() bool {
+	for _, mode := range S3CredentialModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Credentials returns the credentials provider for the credential mode of the
+// config. CredentialEndpoint overrides the STS endpoint in the
+// aws-web-identity mode and the instance metadata endpoint in the
+// aws-instance-profile mode.
+func (c *S3Config) Credentials() (creds *credentials.Credentials, err error) {
+	switch c.CredentialMode {
+	case "", S3CredentialModeStatic:
+		creds = credentials.NewStaticV4(c.AccessKey, c.SecretKey, "")
+	case S3CredentialModeAWSWebIdentity:
+		tokenFile := os.Getenv(consts.EnvAWSWebIdentityTokenFile)
+		if tokenFile == "" {
+			err = errors.Wrapf(consts.ErrNotFound, "the environment variable %s is not set", consts.EnvAWSWebIdentityTokenFile)
+			return
+		}
+		roleARN := os.Getenv(consts.EnvAWSRoleARN)
+		if roleARN == "" {
+			err = errors.Wrapf(consts.ErrNotFound, "the environment variable %s is not set", consts.EnvAWSRoleARN)
+			return
+		}
+		creds, err = credentials.NewSTSWebIdentity(c.stsEndpoint(), func() (*credentials.WebIdentityToken, error) {
+			token, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read the web identity token file %s", tokenFile)
+			}
+			return &credentials.WebIdentityToken{Token: strings.TrimSpace(string(token))}, nil
+		}, func(i *credentials.STSWebIdentity) {
+			i.RoleARN = roleARN
+		})
+	case S3CredentialModeAWSInstanceProfile:
+		creds = credentials.NewIAM(c.CredentialEndpoint)
+	case S3CredentialModeEnv:
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{Endpoint: c.CredentialEndpoint},
+		})
+	case S3CredentialModeGCSHMAC:
+		accessKey := c.AccessKey
+		secretKey := c.SecretKey
+		if accessKey == "" {
+			accessKey = os.Getenv(consts.EnvGCPAccessKeyID)
+			secretKey = os.Getenv(consts.EnvGCPSecretAccessKey)
+		}
+		if accessKey == "" || secretKey == "" {
+			err = errors.Wrapf(consts.ErrNotFound, "the environment variables %s and %s are not set", consts.EnvGCPAccessKeyID, consts.EnvGCPSecretAccessKey)
+			return
+		}
+		creds = credentials.NewStaticV4(accessKey, secretKey, "")
+	default:
+		err = errors.Errorf("invalid s3 credential mode %s", c.CredentialMode)
+	}
+	return
+}
+
+func (c *S3Config) stsEndpoint() string {
+	if c.CredentialEndpoint != "" {
+		return c.CredentialEndpoint
+	}
+	region := c.Region
+	if region == "" {
+		region = os.Getenv(consts.EnvAWSRegion)
+	}
+	if region == "" {
+		return credentials.DefaultSTSRoleEndpoint
+	}
+	if strings.HasPrefix(region, "cn-") {
+		return "https://sts." + region + ".amazonaws.com.cn"
+	}
+	return "https://sts." + region + ".amazonaws.com"
+}
+
+// NewMinioClient creates a minio client authenticated with the credential mode
+// of the config.
+func (c *S3Config) NewMinioClient() (client *minio.Client, err error) {
+	creds, err := c.Credentials()
+	if err != nil {
+		err = errors.Wrap(err, "failed to get s3 credentials")
+		return
+	}
+
+	endpoint := c.Endpoint
+	secure := c.Secure
+	if endpoint == "" && c.CredentialMode == S3CredentialModeGCSHMAC {
+		// GCS is only served over https
+		endpoint = consts.GoogleCloudEndpoint
+		secure = true
+	}
+
+	client, err = minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: c.Region,
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create minio client for %s", endpoint)
+	}
+	return
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestS3ConfigStaticCredentials(t *testing.T) {
+	conf := &S3Config{Endpoint: "minio.example.com", AccessKey: "access", SecretKey: "secret"}
+	creds, err := conf.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "access" || value.SecretAccessKey != "secret" {
+		t.Fatalf("unexpected credentials %+v", value)
+	}
+
+	client, err := conf.NewMinioClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.EndpointURL().Host != "minio.example.com" {
+		t.Fatalf("unexpected endpoint %s", client.EndpointURL())
+	}
+}
+
+func TestS3ConfigAWSWebIdentityCredentials(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("service-account-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/yatai")
+
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %v", err)
+		}
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "service-account-token" || r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/yatai" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>irsa-access</AccessKeyId>
+      <SecretAccessKey>irsa-secret</SecretAccessKey>
+      <SessionToken>irsa-session</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	conf := &S3Config{
+		Endpoint:           "s3.amazonaws.com",
+		CredentialMode:     S3CredentialModeAWSWebIdentity,
+		CredentialEndpoint: sts.URL,
+	}
+	creds, err := conf.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "irsa-access" || value.SecretAccessKey != "irsa-secret" || value.SessionToken != "irsa-session" {
+		t.Fatalf("unexpected credentials %+v", value)
+	}
+}
+
+func TestS3ConfigAWSInstanceProfileCredentials(t *testing.T) {
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			fmt.Fprint(w, "imds-token")
+		case r.Header.Get("X-aws-ec2-metadata-token") != "imds-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "yatai-node")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/yatai-node":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"Code":            "Success",
+				"AccessKeyId":     "instance-access",
+				"SecretAccessKey": "instance-secret",
+				"Token":           "instance-session",
+				"Expiration":      time.Now().Add(time.Hour).UTC(),
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer metadata.Close()
+
+	conf := &S3Config{
+		Endpoint:           "s3.amazonaws.com",
+		CredentialMode:     S3CredentialModeAWSInstanceProfile,
+		CredentialEndpoint: metadata.URL,
+	}
+	creds, err := conf.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "instance-access" || value.SessionToken != "instance-session" {
+		t.Fatalf("unexpected credentials %+v", value)
+	}
+}
+
+func TestS3ConfigEnvAndGCSHMACCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	t.Setenv("GCP_ACCESS_KEY_ID", "gcp-access")
+	t.Setenv("GCP_SECRET_ACCESS_KEY", "gcp-secret")
+
+	conf := &S3Config{Endpoint: "s3.amazonaws.com", CredentialMode: S3CredentialModeEnv}
+	creds, err := conf.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "env-access" {
+		t.Fatalf("unexpected credentials %+v", value)
+	}
+
+	t.Setenv("S3_ENDPOINT", "")
+	t.Setenv("S3_SECURE", "false")
+	t.Setenv("S3_CREDENTIAL_MODE", string(S3CredentialModeGCSHMAC))
+	conf, err = GetS3Config(context.Background())
+	if err != nil {
+		t.Fatalf("the endpoint should be optional in the gcs-hmac mode: %v", err)
+	}
+	if err = conf.Validate(); err != nil {
+		t.Fatalf("the endpoint should be optional in the gcs-hmac mode: %v", err)
+	}
+	client, err := conf.NewMinioClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.EndpointURL().Host != "storage.googleapis.com" || client.EndpointURL().Scheme != "https" {
+		t.Fatalf("unexpected endpoint %s, the defaulted gcs endpoint should be https", client.EndpointURL())
+	}
+	creds, _ = conf.Credentials()
+	value, _ = creds.Get()
+	if value.AccessKeyID != "gcp-access" || value.SecretAccessKey != "gcp-secret" {
+		t.Fatalf("unexpected credentials %+v", value)
+	}
+
+	conf = &S3Config{Endpoint: "s3.amazonaws.com", CredentialMode: "kerberos"}
+	if _, err = conf.Credentials(); err == nil {
+		t.Fatal("expected an error for an invalid credential mode")
+	}
+	if err = conf.Validate(); err == nil {
+		t.Fatal("expected a validation error for an invalid credential mode")
+	}
+}
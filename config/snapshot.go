@@ -0,0 +1,324 @@
+package config
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/bentoml/yatai-common/consts"
+	"github.com/bentoml/yatai-common/system"
+)
+
+const (
+	// TagRedact marks the fields whose values are replaced by an HMAC in snapshots.
+	TagRedact = "redact"
+
+	SnapshotSectionS3             = "s3"
+	SnapshotSectionDockerRegistry = "docker_registry"
+	SnapshotSectionYatai          = "yatai"
+	SnapshotSectionInternalImages = "internal_images"
+	SnapshotSectionNamespaces     = "namespaces"
+	SnapshotSectionIngress        = "ingress"
+
+	SnapshotFormatJSON = "json"
+	SnapshotFormatYAML = "yaml"
+
+	// RedactionKeySourceEnv is the source of the key read from
+	// YATAI_SNAPSHOT_REDACTION_KEY
+	RedactionKeySourceEnv = "env"
+	// RedactionKeySourceRandom is the source of the random key of the process
+	RedactionKeySourceRandom = "random"
+)
+
+// SnapshotSection holds the resolved values of one config, keyed by field
+// name, or the error resolving it failed with.
+type SnapshotSection struct {
+	Values     map[string]string `json:"values,omitempty" yaml:"values,omitempty"`
+	Provenance Provenance        `json:"provenance,omitempty" yaml:"provenance,omitempty"`
+	Error      string            `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// RedactionKey identifies the key the secrets of a snapshot are redacted
+// with, ID is also the prefix of the redacted values.
+type RedactionKey struct {
+	ID     string `json:"id" yaml:"id"`
+	Source string `json:"source" yaml:"source"`
+}
+
+// Snapshot is the config a yatai component resolves at a point in time.
+// Secret values are redacted to an HMAC so snapshots can be shared and still
+// tell whether a secret changed, see DiffSnapshots.
+type Snapshot struct {
+	Component    string                     `json:"component" yaml:"component"`
+	TakenAt      time.Time                  `json:"taken_at" yaml:"taken_at"`
+	RedactionKey RedactionKey               `json:"redaction_key" yaml:"redaction_key"`
+	Sections     map[string]SnapshotSection `json:"sections" yaml:"sections"`
+}
+
+// TakeSnapshot resolves every config the way the yatai component does, a
+// config which fails to resolve is recorded with its error.
+func TakeSnapshot(ctx context.Context, getter ClusterGetter, yataiComponentName string) *Snapshot {
+	_, redactionKey := currentRedactionKey()
+	snapshot := &Snapshot{
+		Component:    yataiComponentName,
+		TakenAt:      time.Now().UTC(),
+		RedactionKey: redactionKey,
+		Sections:     make(map[string]SnapshotSection, 6),
+	}
+
+	s3, err := GetS3ConfigWithSecret(ctx, getter.GetSecret)
+	snapshot.Sections[SnapshotSectionS3] = newSnapshotSection(s3, s3.Provenance, err)
+
+	dockerRegistry, err := GetDockerRegistryConfig(ctx, getter.GetSecret)
+	snapshot.Sections[SnapshotSectionDockerRegistry] = newSnapshotSection(dockerRegistry, dockerRegistry.Provenance, err)
+
+	yatai, err := GetYataiConfigWithConfigMap(ctx, getter.GetSecret, getter.GetConfigMap, yataiComponentName, false)
+	snapshot.Sections[SnapshotSectionYatai] = newSnapshotSection(yatai, yatai.Provenance, err)
+
+	internalImages, err := LoadInternalImages()
+	snapshot.Sections[SnapshotSectionInternalImages] = newSnapshotSection(internalImages, nil, err)
+
+	snapshot.Sections[SnapshotSectionNamespaces] = takeNamespacesSnapshot(ctx, getter)
+
+	ingress, err := system.GetIngressConfig(ctx, getter.GetConfigMap)
+	snapshot.Sections[SnapshotSectionIngress] = newSnapshotSection(ingress, nil, err)
+
+	return snapshot
+}
+
+func takeNamespacesSnapshot(ctx context.Context, getter ClusterGetter) (section SnapshotSection) {
+	resolver := NewNamespaceResolver(getter, 0)
+	section.Values = make(map[string]string, 4)
+	errs := make([]string, 0)
+
+	for name, resolve := range map[string]func(context.Context) (string, error){
+		"YataiImageBuilder": resolver.YataiImageBuilderNamespace,
+		"YataiDeployment":   resolver.YataiDeploymentNamespace,
+		"ImageBuilders":     resolver.ImageBuildersNamespace,
+	} {
+		namespace, err := resolve(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		section.Values[name] = namespace
+	}
+
+	namespaces, err := resolver.BentoDeploymentNamespaces(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("BentoDeployment: %v", err))
+	} else {
+		section.Values["BentoDeployment"] = strings.Join(namespaces, ",")
+	}
+
+	sort.Strings(errs)
+	section.Error = strings.Join(errs, "; ")
+	return
+}
+
+// newSnapshotSection flattens the exported fields of conf, provenance is a
+// method value so it can be taken from a nil conf.
+func newSnapshotSection(conf interface{}, provenance func() Provenance, err error) (section SnapshotSection) {
+	if err != nil {
+		section.Error = err.Error()
+		return
+	}
+
+	v := reflect.ValueOf(conf)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	t := v.Type()
+
+	section.Values = make(map[string]string, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		value := snapshotValue(v.Field(i))
+		if value != "" && field.Tag.Get(TagRedact) == "true" {
+			value = redact(value)
+		}
+		section.Values[field.Name] = value
+	}
+
+	if provenance != nil {
+		section.Provenance = provenance()
+	}
+	return
+}
+
+func snapshotValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return ""
+		}
+		return snapshotValue(v.Elem())
+	case reflect.Slice:
+		items := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, snapshotValue(v.Index(i)))
+		}
+		return strings.Join(items, ",")
+	default:
+		content, err := json.Marshal(v.Interface())
+		if err != nil {
+			return fmt.Sprint(v.Interface())
+		}
+		return string(content)
+	}
+}
+
+// randomRedactionKey keys the HMAC of the redacted values when no key is
+// configured, it is random so the values cannot be brute-forced offline,
+// which only lets the snapshots taken by the same process tell whether a
+// secret changed.
+var randomRedactionKey = newRandomRedactionKey()
+
+const redactedPrefix = "redacted:hmac-sha256:"
+
+func newRandomRedactionKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(errors.Wrap(err, "failed to generate the redaction key"))
+	}
+	return key
+}
+
+// currentRedactionKey returns the key of YATAI_SNAPSHOT_REDACTION_KEY, which
+// lets the snapshots of different processes be compared and should be long
+// and random, or else the random key of the process.
+func currentRedactionKey() (key []byte, redactionKey RedactionKey) {
+	key, redactionKey.Source = randomRedactionKey, RedactionKeySourceRandom
+	if configured := os.Getenv(consts.EnvYataiSnapshotRedactionKey); configured != "" {
+		key, redactionKey.Source = []byte(configured), RedactionKeySourceEnv
+	}
+	hash := sha256.Sum256(key)
+	redactionKey.ID = hex.EncodeToString(hash[:])[:8]
+	return
+}
+
+func redact(value string) string {
+	key, redactionKey := currentRedactionKey()
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return redactedPrefix + redactionKey.ID + ":" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// comparableValues tells whether the values can be compared, the values
+// redacted with different keys cannot and are only compared for being set.
+func comparableValues(a, b string) bool {
+	keyID := func(value string) string {
+		if !strings.HasPrefix(value, "redacted:") {
+			return ""
+		}
+		id, _, _ := strings.Cut(strings.TrimPrefix(value, redactedPrefix), ":")
+		return id
+	}
+	return keyID(a) == "" || keyID(a) == keyID(b)
+}
+
+func (s *Snapshot) Marshal(format string) (content []byte, err error) {
+	switch format {
+	case SnapshotFormatJSON:
+		content, err = json.MarshalIndent(s, "", "  ")
+	case SnapshotFormatYAML:
+		content, err = yaml.Marshal(s)
+	default:
+		err = errors.Errorf("unknown snapshot format %s, must be %s or %s", format, SnapshotFormatJSON, SnapshotFormatYAML)
+	}
+	return
+}
+
+// UnmarshalSnapshot reads a snapshot written by Marshal in either format.
+func UnmarshalSnapshot(content []byte) (snapshot *Snapshot, err error) {
+	snapshot = &Snapshot{}
+	// json is yaml
+	err = yaml.Unmarshal(content, snapshot)
+	if err != nil {
+		err = errors.Wrap(err, "failed to unmarshal snapshot")
+	}
+	return
+}
+
+// SnapshotChange is a value which differs between two snapshots, Field is
+// "error" when the resolution error differs.
+type SnapshotChange struct {
+	Section string `json:"section" yaml:"section"`
+	Field   string `json:"field" yaml:"field"`
+	Old     string `json:"old" yaml:"old"`
+	New     string `json:"new" yaml:"new"`
+}
+
+func (c SnapshotChange) String() string {
+	return fmt.Sprintf("%s.%s: %q -> %q", c.Section, c.Field, c.Old, c.New)
+}
+
+// DiffSnapshots returns the values which differ from one snapshot to the
+// other, sorted by section and field. Only values are compared, not provenance,
+// and the secrets redacted by another process only when they are set or unset.
+func DiffSnapshots(from, to *Snapshot) []SnapshotChange {
+	changes := make([]SnapshotChange, 0)
+
+	sections := make(map[string]struct{}, len(from.Sections))
+	for name := range from.Sections {
+		sections[name] = struct{}{}
+	}
+	for name := range to.Sections {
+		sections[name] = struct{}{}
+	}
+
+	for name := range sections {
+		oldSection, newSection := from.Sections[name], to.Sections[name]
+		if oldSection.Error != newSection.Error {
+			changes = append(changes, SnapshotChange{Section: name, Field: "error", Old: oldSection.Error, New: newSection.Error})
+		}
+
+		fields := make(map[string]struct{}, len(oldSection.Values))
+		for field := range oldSection.Values {
+			fields[field] = struct{}{}
+		}
+		for field := range newSection.Values {
+			fields[field] = struct{}{}
+		}
+		for field := range fields {
+			oldValue, newValue := oldSection.Values[field], newSection.Values[field]
+			if !comparableValues(oldValue, newValue) && newValue != "" {
+				continue
+			}
+			if oldValue != newValue {
+				changes = append(changes, SnapshotChange{Section: name, Field: field, Old: oldValue, New: newValue})
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Section != changes[j].Section {
+			return changes[i].Section < changes[j].Section
+		}
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+func TestSnapshotRedactsAndDiffs(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("YATAI_SNAPSHOT_REDACTION_KEY", "")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "registry.example.com")
+	t.Setenv("DOCKER_REGISTRY_USERNAME", "robot")
+	t.Setenv("DOCKER_REGISTRY_PASSWORD", "registry-password")
+	t.Setenv("AWS_ECR_WITH_IAM_ROLE", "")
+
+	cliset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeSecretNameYataiDeploymentSharedEnv},
+		Data:       map[string][]byte{"BENTO_DEPLOYMENT_NAMESPACES": []byte("yatai,team-a")},
+	})
+
+	snapshot := TakeSnapshot(context.Background(), NewClientsetGetter(cliset), consts.YataiDeploymentComponentName)
+
+	dockerRegistry := snapshot.Sections[SnapshotSectionDockerRegistry]
+	if dockerRegistry.Error != "" || dockerRegistry.Values["Server"] != "registry.example.com" {
+		t.Fatalf("unexpected docker registry section %+v", dockerRegistry)
+	}
+	if password := dockerRegistry.Values["Password"]; !strings.HasPrefix(password, "redacted:") {
+		t.Fatalf("password is not redacted: %s", password)
+	}
+	if snapshot.Sections[SnapshotSectionS3].Error == "" {
+		t.Fatal("expected the s3 section to record why it failed to resolve")
+	}
+	if namespaces := snapshot.Sections[SnapshotSectionNamespaces].Values["BentoDeployment"]; namespaces != "yatai,team-a" {
+		t.Fatalf("bento deployment namespaces are %s", namespaces)
+	}
+
+	for _, format := range []string{SnapshotFormatJSON, SnapshotFormatYAML} {
+		content, err := snapshot.Marshal(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(content), "registry-password") {
+			t.Fatalf("%s snapshot leaks the password:\n%s", format, content)
+		}
+		restored, err := UnmarshalSnapshot(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changes := DiffSnapshots(snapshot, restored); len(changes) != 0 {
+			t.Fatalf("%s round trip changed the snapshot: %v", format, changes)
+		}
+	}
+
+	t.Setenv("DOCKER_REGISTRY_PASSWORD", "rotated-password")
+	changes := DiffSnapshots(snapshot, TakeSnapshot(context.Background(), NewClientsetGetter(cliset), consts.YataiDeploymentComponentName))
+	if len(changes) != 1 || changes[0].Section != SnapshotSectionDockerRegistry || changes[0].Field != "Password" {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+
+	// a snapshot of another process redacts with another key
+	other := TakeSnapshot(context.Background(), NewClientsetGetter(cliset), consts.YataiDeploymentComponentName)
+	other.Sections[SnapshotSectionDockerRegistry].Values["Password"] = redactedPrefix + "0badc0de:0123456789ab"
+	if changes = DiffSnapshots(snapshot, other); len(changes) != 0 {
+		t.Fatalf("the values redacted with different keys should not be compared, got %v", changes)
+	}
+	t.Setenv("DOCKER_REGISTRY_PASSWORD", "")
+	changes = DiffSnapshots(other, TakeSnapshot(context.Background(), NewClientsetGetter(cliset), consts.YataiDeploymentComponentName))
+	if len(changes) != 1 || changes[0].Field != "Password" || changes[0].New != "" {
+		t.Fatalf("the unset password should be reported, got %v", changes)
+	}
+}
+
+func TestSnapshotConfiguredRedactionKey(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "registry.example.com")
+	t.Setenv("DOCKER_REGISTRY_PASSWORD", "registry-password")
+	t.Setenv("AWS_ECR_WITH_IAM_ROLE", "")
+	t.Setenv("YATAI_SNAPSHOT_REDACTION_KEY", "")
+
+	cliset := fake.NewSimpleClientset()
+	getter := NewClientsetGetter(cliset)
+	snapshot := TakeSnapshot(context.Background(), getter, consts.YataiDeploymentComponentName)
+	if snapshot.RedactionKey.Source != RedactionKeySourceRandom {
+		t.Fatalf("the random key should be used without a configured one, got %+v", snapshot.RedactionKey)
+	}
+
+	t.Setenv("YATAI_SNAPSHOT_REDACTION_KEY", "a-long-random-key")
+	saved := TakeSnapshot(context.Background(), getter, consts.YataiDeploymentComponentName)
+	if saved.RedactionKey.Source != RedactionKeySourceEnv || saved.RedactionKey.ID == snapshot.RedactionKey.ID {
+		t.Fatalf("the configured key should be used, got %+v", saved.RedactionKey)
+	}
+
+	// another process has another random key but the same configured one
+	randomKey := randomRedactionKey
+	randomRedactionKey = newRandomRedactionKey()
+	defer func() { randomRedactionKey = randomKey }()
+
+	t.Setenv("DOCKER_REGISTRY_PASSWORD", "rotated-password")
+	changes := DiffSnapshots(saved, TakeSnapshot(context.Background(), getter, consts.YataiDeploymentComponentName))
+	if len(changes) != 1 || changes[0].Field != "Password" {
+		t.Fatalf("the rotated password should be reported across processes, got %v", changes)
+	}
+}
@@ -0,0 +1,271 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+const TagAnnotation = "annotation"
+
+// TenantOverlay holds the config a bento deployment namespace overrides. The
+// values are read from the Secrets of the namespace labelled
+// yatai.ai/tenant-config=true, then from the annotations of the namespace,
+// the API token is only ever read from a Secret. The values are not resolved
+// as references, the tenant would otherwise read whatever the controller can.
+// The overlay is empty unless YATAI_MULTI_TENANCY is true and the namespace
+// is one of the bento deployment namespaces.
+type TenantOverlay struct {
+	S3BucketName        string `secret:"S3_BUCKET_NAME" annotation:"yatai.ai/s3-bucket-name"`
+	S3Prefix            string `secret:"S3_PREFIX" annotation:"yatai.ai/s3-prefix"`
+	BentoRepositoryName string `secret:"DOCKER_REGISTRY_BENTO_REPOSITORY_NAME" annotation:"yatai.ai/docker-registry-bento-repository-name"`
+	ModelRepositoryName string `secret:"DOCKER_REGISTRY_MODEL_REPOSITORY_NAME" annotation:"yatai.ai/docker-registry-model-repository-name"`
+	YataiApiToken       string `secret:"YATAI_API_TOKEN"`
+
+	provenance Provenance
+}
+
+// Provenance returns where each field of the overlay was loaded from.
+func (o *TenantOverlay) Provenance() Provenance {
+	return o.provenance
+}
+
+// tenantOverlayKeys are the only Secret keys and annotations read into an
+// overlay, whatever else the tenant sets is ignored.
+var tenantOverlayKeys = map[string]struct{}{
+	consts.EnvS3BucketName:                                       {},
+	consts.EnvS3Prefix:                                           {},
+	consts.EnvDockerRegistryBentoRepositoryName:                  {},
+	consts.EnvDockerRegistryModelRepositoryName:                  {},
+	consts.EnvYataiApiToken:                                      {},
+	consts.KubeAnnotationTenantS3BucketName:                      {},
+	consts.KubeAnnotationTenantS3Prefix:                          {},
+	consts.KubeAnnotationTenantDockerRegistryBentoRepositoryName: {},
+	consts.KubeAnnotationTenantDockerRegistryModelRepositoryName: {},
+}
+
+// tenantOverlayFields are the config fields each overlay field may replace.
+var tenantOverlayFields = map[string]string{
+	"S3BucketName":        "BucketName",
+	"S3Prefix":            "Prefix",
+	"BentoRepositoryName": "BentoRepositoryName",
+	"ModelRepositoryName": "ModelRepositoryName",
+	"YataiApiToken":       "ApiToken",
+}
+
+type tenancyConfig struct {
+	Enabled bool `env:"YATAI_MULTI_TENANCY" secret:"YATAI_MULTI_TENANCY"`
+}
+
+// getTenancyConfig reads YATAI_MULTI_TENANCY from the environment, then from
+// the yatai-deployment shared env secret if it exists, multi-tenancy is
+// disabled by default.
+func getTenancyConfig(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error)) (conf *tenancyConfig, err error) {
+	conf = &tenancyConfig{}
+	_, err = NewLoader(
+		NewEnvSource(),
+		Optional(NewSecretSource(secretGetter, GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiDeploymentSharedEnv)),
+	).Load(ctx, conf)
+	return
+}
+
+type mapSource struct {
+	name string
+	tag  string
+	data map[string]string
+}
+
+func (s *mapSource) Name() string {
+	return s.name
+}
+
+func (s *mapSource) Tag() string {
+	return s.tag
+}
+
+func (s *mapSource) Lookup(ctx context.Context, key string) (value string, found bool, err error) {
+	value = strings.TrimSpace(s.data[key])
+	found = value != ""
+	return
+}
+
+// TenantResolver merges the overlay of a bento deployment namespace onto the
+// cluster-wide config. It reads the cluster on every call, give it a
+// ClusterGetter backed by listers to avoid hitting the API server.
+type TenantResolver struct {
+	getter             ClusterGetter
+	yataiComponentName string
+}
+
+func NewTenantResolver(getter ClusterGetter, yataiComponentName string) *TenantResolver {
+	return &TenantResolver{
+		getter:             getter,
+		yataiComponentName: yataiComponentName,
+	}
+}
+
+func (r *TenantResolver) Overlay(ctx context.Context, namespace string) (overlay *TenantOverlay, err error) {
+	overlay = &TenantOverlay{}
+	tenant, err := r.isTenant(ctx, namespace)
+	if err != nil || !tenant {
+		return
+	}
+
+	secrets, err := r.getter.ListSecrets(ctx, namespace, labels.SelectorFromSet(labels.Set{
+		consts.KubeLabelYataiTenantConfig: consts.KubeLabelValueTrue,
+	}))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to list tenant config secrets in namespace %s", namespace)
+		return
+	}
+	// the secrets take precedence over each other by name
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+
+	sources := make([]Source, 0, len(secrets)+1)
+	for _, secret := range secrets {
+		data := make(map[string]string, len(secret.Data))
+		for key, value := range secret.Data {
+			if _, ok := tenantOverlayKeys[key]; ok {
+				data[key] = string(value)
+			}
+		}
+		sources = append(sources, &mapSource{
+			name: fmt.Sprintf("secret:%s/%s", secret.Namespace, secret.Name),
+			tag:  TagSecret,
+			data: data,
+		})
+	}
+
+	ns, err := r.getter.GetNamespace(ctx, namespace)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to get namespace %s", namespace)
+		return
+	}
+	annotations := make(map[string]string)
+	for key, value := range ns.Annotations {
+		if _, ok := tenantOverlayKeys[key]; ok {
+			annotations[key] = value
+		}
+	}
+	sources = append(sources, &mapSource{
+		name: fmt.Sprintf("namespace:%s", namespace),
+		tag:  TagAnnotation,
+		data: annotations,
+	})
+
+	overlay.provenance, err = NewLoader(sources...).Load(ctx, overlay)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to load tenant config of namespace %s", namespace)
+	}
+	return
+}
+
+// isTenant reports whether multi-tenancy is enabled and namespace is one of
+// the bento deployment namespaces.
+func (r *TenantResolver) isTenant(ctx context.Context, namespace string) (tenant bool, err error) {
+	tenancy, err := getTenancyConfig(ctx, r.getter.GetSecret)
+	if err != nil {
+		err = errors.Wrap(err, "failed to get the tenancy config")
+		return
+	}
+	if !tenancy.Enabled {
+		return
+	}
+
+	namespaces, err := NewNamespaceResolver(r.getter, 0).BentoDeploymentNamespaces(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "failed to get the bento deployment namespaces")
+		return
+	}
+	for _, ns := range namespaces {
+		if ns == namespace {
+			tenant = true
+			return
+		}
+	}
+	return
+}
+
+func (r *TenantResolver) S3Config(ctx context.Context, namespace string) (conf *S3Config, err error) {
+	global, err := GetS3ConfigWithSecret(ctx, r.getter.GetSecret)
+	if err != nil {
+		return
+	}
+	overlay, err := r.Overlay(ctx, namespace)
+	if err != nil {
+		return
+	}
+
+	conf = &S3Config{}
+	*conf = *global
+	conf.provenance = overlay.apply(conf, global.provenance, "S3BucketName", "S3Prefix")
+	return
+}
+
+func (r *TenantResolver) DockerRegistryConfig(ctx context.Context, namespace string) (conf *DockerRegistryConfig, err error) {
+	global, err := GetDockerRegistryConfig(ctx, r.getter.GetSecret)
+	if err != nil {
+		return
+	}
+	overlay, err := r.Overlay(ctx, namespace)
+	if err != nil {
+		return
+	}
+
+	conf = &DockerRegistryConfig{}
+	*conf = *global
+	conf.provenance = overlay.apply(conf, global.provenance, "BentoRepositoryName", "ModelRepositoryName")
+	return
+}
+
+func (r *TenantResolver) YataiConfig(ctx context.Context, namespace string) (conf *YataiConfig, err error) {
+	global, err := GetYataiConfigWithConfigMap(ctx, r.getter.GetSecret, r.getter.GetConfigMap, r.yataiComponentName, false)
+	if err != nil {
+		return
+	}
+	overlay, err := r.Overlay(ctx, namespace)
+	if err != nil {
+		return
+	}
+
+	conf = &YataiConfig{}
+	*conf = *global
+	conf.provenance = overlay.apply(conf, global.provenance, "YataiApiToken")
+	return
+}
+
+// apply sets the fields of conf, a pointer to a copy of the global config, to
+// the non-empty overlay fields that tenantOverlayFields maps them to and
+// returns the merged provenance.
+func (o *TenantOverlay) apply(conf interface{}, global Provenance, overlayFields ...string) Provenance {
+	provenance := make(Provenance, len(global))
+	for field, origin := range global {
+		provenance[field] = origin
+	}
+
+	cv := reflect.ValueOf(conf).Elem()
+	ov := reflect.ValueOf(o).Elem()
+	for _, overlayField := range overlayFields {
+		field, ok := tenantOverlayFields[overlayField]
+		if !ok {
+			continue
+		}
+		value := ov.FieldByName(overlayField).String()
+		if value == "" {
+			continue
+		}
+		cv.FieldByName(field).SetString(value)
+		provenance[field] = o.provenance[overlayField]
+	}
+	return provenance
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+func TestTenantResolverMergesOverlay(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("S3_ENDPOINT", "minio.example.com")
+	t.Setenv("S3_BUCKET_NAME", "yatai")
+	t.Setenv("S3_PREFIX", "")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "registry.example.com")
+	t.Setenv("DOCKER_REGISTRY_BENTO_REPOSITORY_NAME", "bentos")
+	t.Setenv("DOCKER_REGISTRY_MODEL_REPOSITORY_NAME", "models")
+	t.Setenv("AWS_ECR_WITH_IAM_ROLE", "")
+	t.Setenv("YATAI_MULTI_TENANCY", "true")
+	t.Setenv("BENTO_DEPLOYMENT_NAMESPACES", "team-a,team-b")
+	t.Setenv("BENTO_DEPLOYMENT_NAMESPACE_SELECTOR", "")
+
+	cliset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name: "team-a",
+			Annotations: map[string]string{
+				consts.KubeAnnotationTenantS3BucketName:                      "team-a-from-annotation",
+				consts.KubeAnnotationTenantS3Prefix:                          "team-a/",
+				consts.KubeAnnotationTenantDockerRegistryBentoRepositoryName: "team-a-bentos",
+			},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "team-b",
+				Name:      "tenant-config",
+				Labels:    map[string]string{consts.KubeLabelYataiTenantConfig: "true"},
+			},
+			Data: map[string][]byte{"YATAI_API_TOKEN": []byte("secret://yatai-system/yatai-common-env/YATAI_API_TOKEN")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: "yatai-common-env"},
+			Data:       map[string][]byte{"YATAI_API_TOKEN": []byte("cluster-token")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "team-a",
+				Name:      "tenant-config",
+				Labels:    map[string]string{consts.KubeLabelYataiTenantConfig: "true"},
+			},
+			Data: map[string][]byte{
+				"S3_BUCKET_NAME": []byte("team-a"),
+				"S3_ENDPOINT":    []byte("minio.team-a.example.com"),
+			},
+		},
+	)
+	resolver := NewTenantResolver(NewClientsetGetter(cliset), consts.YataiDeploymentComponentName)
+
+	s3, err := resolver.S3Config(context.Background(), "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3.Endpoint != "minio.example.com" || s3.BucketName != "team-a" || s3.Prefix != "team-a/" {
+		t.Fatalf("unexpected s3 config %+v", s3)
+	}
+	if origin := s3.Provenance()["BucketName"]; origin.Source != "secret:team-a/tenant-config" {
+		t.Fatalf("bucket name provenance is %s", origin)
+	}
+	if origin := s3.Provenance()["Prefix"]; origin.Source != "namespace:team-a" {
+		t.Fatalf("prefix provenance is %s", origin)
+	}
+
+	dockerRegistry, err := resolver.DockerRegistryConfig(context.Background(), "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dockerRegistry.BentoRepositoryName != "team-a-bentos" || dockerRegistry.ModelRepositoryName != "models" {
+		t.Fatalf("unexpected docker registry config %+v", dockerRegistry)
+	}
+
+	s3, err = resolver.S3Config(context.Background(), "team-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3.BucketName != "yatai" || s3.Prefix != "" {
+		t.Fatalf("a namespace without overlay should get the global config, got %+v", s3)
+	}
+
+	overlay, err := resolver.Overlay(context.Background(), "team-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overlay.YataiApiToken == "cluster-token" {
+		t.Fatal("the overlay must not resolve references to the secrets of other namespaces")
+	}
+}
+
+func TestTenantResolverGatesOverlay(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("S3_ENDPOINT", "minio.example.com")
+	t.Setenv("S3_BUCKET_NAME", "yatai")
+	t.Setenv("S3_PREFIX", "")
+	t.Setenv("BENTO_DEPLOYMENT_NAMESPACES", "team-a")
+	t.Setenv("BENTO_DEPLOYMENT_NAMESPACE_SELECTOR", "")
+
+	newNamespace := func(name string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{consts.KubeAnnotationTenantS3BucketName: name},
+		}}
+	}
+	resolver := NewTenantResolver(NewClientsetGetter(fake.NewSimpleClientset(newNamespace("team-a"), newNamespace("kube-system"))), consts.YataiDeploymentComponentName)
+
+	for _, tc := range []struct {
+		multiTenancy string
+		namespace    string
+		bucketName   string
+	}{
+		{multiTenancy: "", namespace: "team-a", bucketName: "yatai"},
+		{multiTenancy: "false", namespace: "team-a", bucketName: "yatai"},
+		{multiTenancy: "true", namespace: "kube-system", bucketName: "yatai"},
+		{multiTenancy: "true", namespace: "team-a", bucketName: "team-a"},
+	} {
+		t.Setenv("YATAI_MULTI_TENANCY", tc.multiTenancy)
+		s3, err := resolver.S3Config(context.Background(), tc.namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s3.BucketName != tc.bucketName {
+			t.Errorf("multi-tenancy %q, namespace %s: expected bucket %s, got %s", tc.multiTenancy, tc.namespace, tc.bucketName, s3.BucketName)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package config
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	s3BucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	// https://github.com/distribution/distribution/blob/main/reference/regexp.go
+	repositoryNameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*)*$`)
+)
+
+// FieldError describes a single invalid field of a config.
+type FieldError struct {
+	Field  string `json:"field"`
+	Key    string `json:"key"`
+	Source string `json:"source,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (e FieldError) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("%s (%s): %s", e.Field, e.Key, e.Reason)
+	}
+	return fmt.Sprintf("%s (%s from %s): %s", e.Field, e.Key, e.Source, e.Reason)
+}
+
+// ValidationError aggregates every invalid field found while validating a config.
+type ValidationError struct {
+	Config string       `json:"config"`
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		msgs = append(msgs, field.Error())
+	}
+	return fmt.Sprintf("invalid %s: %s", e.Config, strings.Join(msgs, "; "))
+}
+
+type validator struct {
+	rt         reflect.Type
+	provenance Provenance
+	err        *ValidationError
+}
+
+func newValidator(conf interface{}, provenance Provenance) *validator {
+	rt := reflect.TypeOf(conf).Elem()
+	return &validator{
+		rt:         rt,
+		provenance: provenance,
+		err:        &ValidationError{Config: rt.Name()},
+	}
+}
+
+func (v *validator) addf(field string, format string, args ...interface{}) {
+	fieldErr := FieldError{
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	}
+	if origin, ok := v.provenance[field]; ok && origin.Key != "" {
+		fieldErr.Key = origin.Key
+		fieldErr.Source = origin.Source
+	} else if structField, ok := v.rt.FieldByName(field); ok {
+		fieldErr.Key = structField.Tag.Get(TagEnv)
+	}
+	v.err.Fields = append(v.err.Fields, fieldErr)
+}
+
+func (v *validator) required(field, value string) bool {
+	if value == "" {
+		v.addf(field, "is required")
+		return false
+	}
+	return true
+}
+
+// bool checks the raw value a bool field was loaded from, which is otherwise
+// silently treated as false when it is not "true".
+func (v *validator) bool(field string) {
+	raw := v.provenance[field].raw
+	if raw != "" && raw != "true" && raw != "false" {
+		v.addf(field, "must be true or false, got %q", raw)
+	}
+}
+
+func (v *validator) hostPort(field, value string) {
+	if strings.Contains(value, "://") {
+		v.addf(field, "must be a host[:port] without a scheme, got %q", value)
+		return
+	}
+	if strings.ContainsAny(value, " \t\n/?#") {
+		v.addf(field, "must be a host[:port], got %q", value)
+		return
+	}
+	host := value
+	if h, port, err := net.SplitHostPort(value); err == nil {
+		host = h
+		if n, err := strconv.Atoi(port); err != nil || len(validation.IsValidPortNum(n)) > 0 {
+			v.addf(field, "has an invalid port %q", port)
+			return
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return
+	}
+	if msgs := validation.IsDNS1123Subdomain(strings.ToLower(host)); len(msgs) > 0 {
+		v.addf(field, "has an invalid host %q: %s", host, strings.Join(msgs, ", "))
+	}
+}
+
+func (v *validator) result() error {
+	if len(v.err.Fields) == 0 {
+		return nil
+	}
+	return v.err
+}
+
+// Validate checks every field of the config and returns a *ValidationError
+// listing all the problems found.
+func (c *S3Config) Validate() error {
+	v := newValidator(c, c.provenance)
+
+	// the gcs-hmac mode defaults to the GCS XML API endpoint
+	if c.Endpoint != "" || c.CredentialMode != S3CredentialModeGCSHMAC {
+		if v.required("Endpoint", c.Endpoint) {
+			v.hostPort("Endpoint", c.Endpoint)
+		}
+	}
+	if !c.CredentialMode.IsValid() && c.CredentialMode != "" {
+		v.addf("CredentialMode", "must be one of %v, got %q", S3CredentialModes, c.CredentialMode)
+	}
+	if c.AccessKey != "" && c.SecretKey == "" {
+		v.addf("SecretKey", "is required when the access key is set")
+	}
+	if c.AccessKey == "" && c.SecretKey != "" {
+		v.addf("AccessKey", "is required when the secret key is set")
+	}
+	if c.BucketName != "" {
+		validateS3BucketName(v, c.BucketName)
+	}
+	v.bool("Secure")
+
+	return v.result()
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/bucketnamingrules.html
+func validateS3BucketName(v *validator, name string) {
+	switch {
+	case !s3BucketNameRegexp.MatchString(name):
+		v.addf("BucketName", "must be 3 to 63 lowercase letters, numbers, dots and hyphens, beginning and ending with a letter or number, got %q", name)
+	case strings.Contains(name, ".."):
+		v.addf("BucketName", "must not contain two adjacent periods, got %q", name)
+	case net.ParseIP(name) != nil:
+		v.addf("BucketName", "must not be formatted as an IP address, got %q", name)
+	case strings.HasPrefix(name, "xn--"):
+		v.addf("BucketName", "must not start with the prefix xn--, got %q", name)
+	case strings.HasSuffix(name, "-s3alias"):
+		v.addf("BucketName", "must not end with the suffix -s3alias, got %q", name)
+	}
+}
+
+// Validate checks every field of the config and returns a *ValidationError
+// listing all the problems found.
+func (c *DockerRegistryConfig) Validate() error {
+	v := newValidator(c, c.provenance)
+
+	if v.required("Server", c.Server) {
+		v.hostPort("Server", c.Server)
+	}
+	if c.InClusterServer != "" {
+		v.hostPort("InClusterServer", c.InClusterServer)
+	}
+	if c.BentoRepositoryName != "" && !repositoryNameRegexp.MatchString(c.BentoRepositoryName) {
+		v.addf("BentoRepositoryName", "is not a valid repository name: %q", c.BentoRepositoryName)
+	}
+	if c.ModelRepositoryName != "" && !repositoryNameRegexp.MatchString(c.ModelRepositoryName) {
+		v.addf("ModelRepositoryName", "is not a valid repository name: %q", c.ModelRepositoryName)
+	}
+	if c.Username == "" && c.Password != "" {
+		v.addf("Username", "is required when the password is set")
+	}
+	if c.CABundle != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(c.CABundle)) {
+		v.addf("CABundle", "has no PEM encoded certificate")
+	}
+	v.bool("Secure")
+	v.bool("InsecureSkipVerify")
+
+	return v.result()
+}
+
+// Validate checks every field of the config and returns a *ValidationError
+// listing all the problems found.
+func (c *YataiConfig) Validate() error {
+	v := newValidator(c, c.provenance)
+
+	if v.required("Endpoint", c.Endpoint) {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil {
+			v.addf("Endpoint", "is not a valid url: %v", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			v.addf("Endpoint", "must be an http or https url, got %q", c.Endpoint)
+		} else if u.Host == "" {
+			v.addf("Endpoint", "has no host: %q", c.Endpoint)
+		}
+	}
+	if c.ClusterName != "" {
+		if msgs := validation.IsDNS1123Label(c.ClusterName); len(msgs) > 0 {
+			v.addf("ClusterName", "is not a valid cluster name: %s", strings.Join(msgs, ", "))
+		}
+	}
+	v.required("ApiToken", c.ApiToken)
+
+	return v.result()
+}
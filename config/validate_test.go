@@ -0,0 +1,91 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestS3ConfigValidate(t *testing.T) {
+	t.Setenv("S3_ENDPOINT", "https://minio.example.com")
+	t.Setenv("S3_SECURE", "yes")
+	t.Setenv("S3_BUCKET_NAME", "My_Bucket")
+	t.Setenv("S3_ACCESS_KEY", "access")
+	t.Setenv("S3_SECRET_KEY", "")
+
+	conf, err := GetS3Config(context.Background())
+	if err != nil {
+		t.Fatalf("get s3 config failed: %v", err)
+	}
+
+	err = conf.Validate()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	fields := make(map[string]FieldError)
+	for _, field := range validationErr.Fields {
+		fields[field.Field] = field
+	}
+	for _, field := range []string{"Endpoint", "Secure", "BucketName", "SecretKey"} {
+		if _, ok := fields[field]; !ok {
+			t.Fatalf("%s is not reported in %v", field, err)
+		}
+	}
+	if fields["Secure"].Key != "S3_SECURE" || fields["Secure"].Source != "env" {
+		t.Fatalf("unexpected field error %+v", fields["Secure"])
+	}
+	if fields["SecretKey"].Key != "S3_SECRET_KEY" {
+		t.Fatalf("unexpected field error %+v", fields["SecretKey"])
+	}
+}
+
+func TestS3ConfigValidateBucketName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"yatai":              true,
+		"yatai.bentos-1":     true,
+		"ya":                 false,
+		"yatai..bentos":      false,
+		"192.168.1.1":        false,
+		"xn--yatai":          false,
+		"yatai-s3alias":      false,
+		"-yatai":             false,
+		"yatai_bentos":       false,
+		"yatai-bentos-store": true,
+	} {
+		conf := &S3Config{Endpoint: "s3.amazonaws.com", BucketName: name}
+		if err := conf.Validate(); (err == nil) != valid {
+			t.Fatalf("bucket name %q: valid=%v, err=%v", name, valid, err)
+		}
+	}
+}
+
+func TestDockerRegistryConfigValidate(t *testing.T) {
+	conf := &DockerRegistryConfig{
+		Server:              "registry.example.com:5000",
+		InClusterServer:     "docker-registry.yatai-image-builder.svc.cluster.local:5000",
+		BentoRepositoryName: "yatai-bentos",
+		ModelRepositoryName: "yatai/models",
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	conf.Server = "registry.example.com:99999"
+	conf.BentoRepositoryName = "Yatai Bentos"
+	err := conf.Validate()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Fields) != 2 {
+		t.Fatalf("expected two field errors, got %v", err)
+	}
+}
+
+func TestYataiConfigValidate(t *testing.T) {
+	conf := &YataiConfig{Endpoint: "yatai.example.com", ClusterName: "Default"}
+	err := conf.Validate()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Fields) != 3 {
+		t.Fatalf("expected three field errors, got %v", err)
+	}
+}
@@ -0,0 +1,460 @@
+package config
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bentoml/yatai-common/consts"
+	"github.com/bentoml/yatai-common/system"
+)
+
+type ConfigKind string
+
+const (
+	ConfigKindS3             ConfigKind = "s3"
+	ConfigKindDockerRegistry ConfigKind = "docker-registry"
+	ConfigKindYatai          ConfigKind = "yatai"
+	ConfigKindIngress        ConfigKind = "ingress"
+)
+
+// ChangeEvent is sent to subscribers when a config is resolved to a different
+// value. Only the field matching Kind is set.
+type ChangeEvent struct {
+	Kind           ConfigKind
+	S3             *S3Config
+	DockerRegistry *DockerRegistryConfig
+	Yatai          *YataiConfig
+	Ingress        *system.IngressConfig
+}
+
+type subscriber struct {
+	kinds  map[ConfigKind]struct{}
+	events chan ChangeEvent
+}
+
+// Watcher keeps S3Config, DockerRegistryConfig, YataiConfig and IngressConfig
+// up to date by watching the Secrets and ConfigMaps they are resolved from.
+type Watcher struct {
+	cliset             kubernetes.Interface
+	yataiComponentName string
+	resyncPeriod       time.Duration
+
+	// the listers of the watched objects by namespace/name, only the Run
+	// goroutine accesses them
+	secretListers    map[string]corev1listers.SecretLister
+	configMapListers map[string]corev1listers.ConfigMapLister
+
+	// pending are the kinds whose source objects changed since the last
+	// refresh
+	pendingLock sync.Mutex
+	pending     map[ConfigKind]struct{}
+
+	lock           sync.RWMutex
+	s3             *S3Config
+	dockerRegistry *DockerRegistryConfig
+	yatai          *YataiConfig
+	ingress        *system.IngressConfig
+	subscribers    map[int]*subscriber
+	nextSubscriber int
+	refreshCh      chan struct{}
+}
+
+func NewWatcher(cliset kubernetes.Interface, yataiComponentName string, resyncPeriod time.Duration) *Watcher {
+	return &Watcher{
+		cliset:             cliset,
+		yataiComponentName: yataiComponentName,
+		resyncPeriod:       resyncPeriod,
+		secretListers:      make(map[string]corev1listers.SecretLister),
+		configMapListers:   make(map[string]corev1listers.ConfigMapLister),
+		pending:            make(map[ConfigKind]struct{}),
+		subscribers:        make(map[int]*subscriber),
+		refreshCh:          make(chan struct{}, 1),
+	}
+}
+
+// Subscribe returns a channel receiving change events of the given kinds, or of
+// every kind if none is given. The returned function cancels the subscription.
+func (w *Watcher) Subscribe(kinds ...ConfigKind) (<-chan ChangeEvent, func()) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	sub := &subscriber{
+		kinds:  make(map[ConfigKind]struct{}, len(kinds)),
+		events: make(chan ChangeEvent, 16),
+	}
+	for _, kind := range kinds {
+		sub.kinds[kind] = struct{}{}
+	}
+
+	id := w.nextSubscriber
+	w.nextSubscriber++
+	w.subscribers[id] = sub
+
+	return sub.events, func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		if _, ok := w.subscribers[id]; ok {
+			delete(w.subscribers, id)
+			close(sub.events)
+		}
+	}
+}
+
+func (w *Watcher) S3Config() *S3Config {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.s3
+}
+
+func (w *Watcher) DockerRegistryConfig() *DockerRegistryConfig {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.dockerRegistry
+}
+
+func (w *Watcher) YataiConfig() *YataiConfig {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.yatai
+}
+
+func (w *Watcher) IngressConfig() *system.IngressConfig {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.ingress
+}
+
+// Run starts an informer per watched object, resolves the configs once they
+// are synced and then re-resolves the configs resolved from an object on
+// every change of it until ctx is done.
+func (w *Watcher) Run(ctx context.Context) (err error) {
+	yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
+
+	componentNamespace, componentEnvSecretName, err := w.componentEnvSecret(ctx)
+	if err != nil {
+		return
+	}
+
+	// the shared env secrets hold the s3 and registry configs, and the
+	// namespaces of the components
+	sharedKinds := []ConfigKind{ConfigKindS3, ConfigKindDockerRegistry, ConfigKindYatai}
+	for _, component := range GetComponents() {
+		err = w.watchSecret(ctx, yataiSystemNamespace, component.SharedEnvSecretName, sharedKinds...)
+		if err != nil {
+			return
+		}
+	}
+	for _, watch := range []func() error{
+		func() error {
+			return w.watchSecret(ctx, yataiSystemNamespace, consts.KubeSecretNameYataiCommonEnv, ConfigKindYatai)
+		},
+		func() error {
+			return w.watchSecret(ctx, componentNamespace, componentEnvSecretName, ConfigKindYatai)
+		},
+		func() error {
+			return w.watchConfigMap(ctx, system.GetNamespace(), consts.KubeConfigMapNameNetworkConfig, ConfigKindIngress)
+		},
+		func() error {
+			return w.watchConfigMap(ctx, yataiSystemNamespace, consts.KubeConfigMapNameYataiConfig, ConfigKindYatai)
+		},
+	} {
+		if err = watch(); err != nil {
+			return
+		}
+	}
+
+	w.refresh(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.closeSubscribers()
+			return
+		case <-w.refreshCh:
+			w.refresh(ctx, w.takePending()...)
+		}
+	}
+}
+
+func (w *Watcher) componentEnvSecret(ctx context.Context) (namespace, name string, err error) {
+	component, err := GetComponent(w.yataiComponentName)
+	if err != nil {
+		return
+	}
+	name = component.EnvSecretName
+	namespace, err = GetComponentNamespace(ctx, NewClientsetGetter(w.cliset).GetSecret, w.yataiComponentName)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to get namespace for %s", w.yataiComponentName)
+	}
+	return
+}
+
+// newObjectInformerFactory returns an informer factory listing and watching
+// only the object named name in namespace.
+func (w *Watcher) newObjectInformerFactory(namespace, name string) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(w.cliset, w.resyncPeriod,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+}
+
+func startInformerFactory(ctx context.Context, factory informers.SharedInformerFactory) error {
+	factory.Start(ctx.Done())
+	for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return errors.Errorf("failed to sync the informer of %s", informerType)
+		}
+	}
+	return nil
+}
+
+// watchSecret starts watching a secret, its changes refresh the configs of
+// kinds. A secret watched already is left as is.
+func (w *Watcher) watchSecret(ctx context.Context, namespace, name string, kinds ...ConfigKind) error {
+	key := namespace + "/" + name
+	if _, ok := w.secretListers[key]; ok {
+		return nil
+	}
+	factory := w.newObjectInformerFactory(namespace, name)
+	informer := factory.Core().V1().Secrets()
+	informer.Informer().AddEventHandler(w.eventHandler(name, kinds))
+	w.secretListers[key] = informer.Lister()
+	return startInformerFactory(ctx, factory)
+}
+
+// watchConfigMap is watchSecret for a ConfigMap.
+func (w *Watcher) watchConfigMap(ctx context.Context, namespace, name string, kinds ...ConfigKind) error {
+	key := namespace + "/" + name
+	if _, ok := w.configMapListers[key]; ok {
+		return nil
+	}
+	factory := w.newObjectInformerFactory(namespace, name)
+	informer := factory.Core().V1().ConfigMaps()
+	informer.Informer().AddEventHandler(w.eventHandler(name, kinds))
+	w.configMapListers[key] = informer.Lister()
+	return startInformerFactory(ctx, factory)
+}
+
+// watchYataiTokenSecret watches the secret the yatai ConfigMap reads the api
+// token from, which is only known once the ConfigMap is read.
+func (w *Watcher) watchYataiTokenSecret(ctx context.Context) {
+	yataiSystemNamespace := GetYataiSystemNamespaceFromEnv()
+	configMap, err := w.getConfigMap(ctx, yataiSystemNamespace, consts.KubeConfigMapNameYataiConfig)
+	if err != nil {
+		return
+	}
+	name := configMap.Data[consts.KubeConfigMapKeyYataiConfigApiTokenSecretName]
+	if name == "" {
+		return
+	}
+	err = w.watchSecret(ctx, yataiSystemNamespace, name, ConfigKindYatai)
+	if err != nil {
+		logrus.Warnf("failed to watch the yatai api token secret %s: %v", name, err)
+	}
+}
+
+// eventHandler marks kinds pending on the changes of the object named name.
+// The resyncs, which notify an update of an unchanged object, are ignored.
+func (w *Watcher) eventHandler(name string, kinds []ConfigKind) cache.ResourceEventHandler {
+	onEvent := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if o, ok := obj.(metav1.Object); !ok || o.GetName() != name {
+			return
+		}
+		w.markPending(kinds...)
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: onEvent,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldMeta, oldOk := oldObj.(metav1.Object)
+			newMeta, newOk := newObj.(metav1.Object)
+			if oldOk && newOk && oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+				return
+			}
+			onEvent(newObj)
+		},
+		DeleteFunc: onEvent,
+	}
+}
+
+func (w *Watcher) markPending(kinds ...ConfigKind) {
+	w.pendingLock.Lock()
+	for _, kind := range kinds {
+		w.pending[kind] = struct{}{}
+	}
+	w.pendingLock.Unlock()
+
+	select {
+	case w.refreshCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watcher) takePending() []ConfigKind {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	kinds := make([]ConfigKind, 0, len(w.pending))
+	for kind := range w.pending {
+		kinds = append(kinds, kind)
+		delete(w.pending, kind)
+	}
+	return kinds
+}
+
+func (w *Watcher) getSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	lister, ok := w.secretListers[namespace+"/"+name]
+	if !ok {
+		return w.cliset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	return lister.Secrets(namespace).Get(name)
+}
+
+func (w *Watcher) getConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+	lister, ok := w.configMapListers[namespace+"/"+name]
+	if !ok {
+		return w.cliset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	return lister.ConfigMaps(namespace).Get(name)
+}
+
+// refresh re-resolves the configs of kinds, every config when kinds is empty.
+func (w *Watcher) refresh(ctx context.Context, kinds ...ConfigKind) {
+	selected := make(map[ConfigKind]bool, len(kinds))
+	for _, kind := range kinds {
+		selected[kind] = true
+	}
+	all := len(kinds) == 0
+
+	// the getters return a partly resolved config along with their error, a
+	// config which is not refreshed keeps a nil error and is left as is
+	var s3 *S3Config
+	var s3Err error
+	if all || selected[ConfigKindS3] {
+		s3, s3Err = GetS3ConfigWithSecret(ctx, w.getSecret)
+		if s3Err != nil {
+			logrus.Warnf("failed to resolve s3 config: %v", s3Err)
+		}
+	}
+
+	var dockerRegistry *DockerRegistryConfig
+	var dockerRegistryErr error
+	if all || selected[ConfigKindDockerRegistry] {
+		dockerRegistry, dockerRegistryErr = GetDockerRegistryConfig(ctx, w.getSecret)
+		if dockerRegistryErr != nil {
+			logrus.Warnf("failed to resolve docker registry config: %v", dockerRegistryErr)
+		}
+	}
+
+	var yatai *YataiConfig
+	var yataiErr error
+	if all || selected[ConfigKindYatai] {
+		w.watchYataiTokenSecret(ctx)
+		yatai, yataiErr = GetYataiConfigWithConfigMap(ctx, w.getSecret, w.getConfigMap, w.yataiComponentName, false)
+		if yataiErr != nil {
+			logrus.Warnf("failed to resolve yatai config: %v", yataiErr)
+		}
+	}
+
+	var ingress *system.IngressConfig
+	var ingressErr error
+	if all || selected[ConfigKindIngress] {
+		ingress, ingressErr = system.GetIngressConfig(ctx, w.getConfigMap)
+		if ingressErr != nil {
+			logrus.Warnf("failed to resolve ingress config: %v", ingressErr)
+		}
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	events := make([]ChangeEvent, 0, 4)
+	// a config which failed to resolve keeps its last known value
+	if s3 != nil && s3Err == nil && !sameConfig(w.s3, s3) {
+		w.s3 = s3
+		events = append(events, ChangeEvent{Kind: ConfigKindS3, S3: s3})
+	}
+	if dockerRegistry != nil && dockerRegistryErr == nil {
+		// a new ecr token alone is not a change, the config is replaced
+		// to serve it without notifying
+		if !sameDockerRegistryConfig(w.dockerRegistry, dockerRegistry) {
+			events = append(events, ChangeEvent{Kind: ConfigKindDockerRegistry, DockerRegistry: dockerRegistry})
+		}
+		w.dockerRegistry = dockerRegistry
+	}
+	if yatai != nil && yataiErr == nil && !sameConfig(w.yatai, yatai) {
+		w.yatai = yatai
+		events = append(events, ChangeEvent{Kind: ConfigKindYatai, Yatai: yatai})
+	}
+	if ingress != nil && ingressErr == nil && !sameConfig(w.ingress, ingress) {
+		w.ingress = ingress
+		events = append(events, ChangeEvent{Kind: ConfigKindIngress, Ingress: ingress})
+	}
+
+	for _, event := range events {
+		for _, sub := range w.subscribers {
+			if _, ok := sub.kinds[event.Kind]; len(sub.kinds) > 0 && !ok {
+				continue
+			}
+			select {
+			case sub.events <- event:
+			default:
+				logrus.Warnf("dropping %s config change event for a slow subscriber", event.Kind)
+			}
+		}
+	}
+}
+
+func (w *Watcher) closeSubscribers() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for id, sub := range w.subscribers {
+		delete(w.subscribers, id)
+		close(sub.events)
+	}
+}
+
+// sameDockerRegistryConfig is sameConfig leaving out the credentials of the
+// ecr authorization tokens, which are renewed on every resolution.
+func sameDockerRegistryConfig(a, b *DockerRegistryConfig) bool {
+	if a == nil || b == nil || !a.AWSECRWithIAMRole || !b.AWSECRWithIAMRole {
+		return sameConfig(a, b)
+	}
+	return sameConfig(a.withoutECRCredentials(), b.withoutECRCredentials())
+}
+
+// sameConfig compares the exported fields of two config structs, ignoring
+// where their values were loaded from.
+func sameConfig(a, b interface{}) bool {
+	va := reflect.ValueOf(a)
+	vb := reflect.ValueOf(b)
+	if va.IsNil() || vb.IsNil() {
+		return va.IsNil() == vb.IsNil()
+	}
+	va = va.Elem()
+	vb = vb.Elem()
+	for i := 0; i < va.NumField(); i++ {
+		if !va.Type().Field(i).IsExported() {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+func waitChangeEvent(t *testing.T, events <-chan ChangeEvent) ChangeEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a change event")
+	}
+	return ChangeEvent{}
+}
+
+func TestWatcherReloadsDockerRegistryConfig(t *testing.T) {
+	t.Setenv("YATAI_SYSTEM_NAMESPACE", "yatai-system")
+	t.Setenv("YATAI_DEPLOYMENT_NAMESPACE", "yatai-deployment")
+	t.Setenv("SYSTEM_NAMESPACE", "yatai-deployment")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+
+	sharedEnv := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "yatai-system",
+			Name:      consts.KubeSecretNameYataiImageBuilderSharedEnv,
+		},
+		Data: map[string][]byte{
+			consts.EnvDockerRegistryServer: []byte("registry-a.example.com"),
+		},
+	}
+	cliset := fake.NewSimpleClientset(sharedEnv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watcher := NewWatcher(cliset, consts.YataiDeploymentComponentName, 0)
+	events, unsubscribe := watcher.Subscribe(ConfigKindDockerRegistry)
+	defer unsubscribe()
+
+	go func() {
+		if err := watcher.Run(ctx); err != nil {
+			t.Errorf("watcher failed: %v", err)
+		}
+	}()
+
+	event := waitChangeEvent(t, events)
+	if event.Kind != ConfigKindDockerRegistry || event.DockerRegistry.Server != "registry-a.example.com" {
+		t.Fatalf("unexpected initial event %+v", event)
+	}
+
+	sharedEnv = sharedEnv.DeepCopy()
+	sharedEnv.Data[consts.EnvDockerRegistryServer] = []byte("registry-b.example.com")
+	// the fake clientset does not bump the resource version like the api
+	// server does
+	sharedEnv.ResourceVersion = "2"
+	if _, err := cliset.CoreV1().Secrets("yatai-system").Update(ctx, sharedEnv, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	event = waitChangeEvent(t, events)
+	if event.DockerRegistry.Server != "registry-b.example.com" {
+		t.Fatalf("unexpected change event %+v", event)
+	}
+	if watcher.DockerRegistryConfig().Server != "registry-b.example.com" {
+		t.Fatalf("watcher still returns %s", watcher.DockerRegistryConfig().Server)
+	}
+}
+
+func TestWatcherKeepsConfigWhenSecretGetterFails(t *testing.T) {
+	t.Setenv("YATAI_SYSTEM_NAMESPACE", "yatai-system")
+	t.Setenv("YATAI_DEPLOYMENT_NAMESPACE", "yatai-deployment")
+	t.Setenv("SYSTEM_NAMESPACE", "yatai-deployment")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+
+	cliset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "yatai-system",
+			Name:      consts.KubeSecretNameYataiImageBuilderSharedEnv,
+		},
+		Data: map[string][]byte{
+			consts.EnvDockerRegistryServer: []byte("registry-a.example.com"),
+		},
+	})
+
+	ctx := context.Background()
+	watcher := NewWatcher(cliset, consts.YataiDeploymentComponentName, 0)
+	events, unsubscribe := watcher.Subscribe(ConfigKindDockerRegistry)
+	defer unsubscribe()
+
+	watcher.refresh(ctx)
+	event := waitChangeEvent(t, events)
+	if event.DockerRegistry.Server != "registry-a.example.com" {
+		t.Fatalf("unexpected initial event %+v", event)
+	}
+
+	cliset.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	watcher.refresh(ctx)
+
+	select {
+	case event := <-events:
+		t.Fatalf("a failed refresh should not notify, got %+v", event)
+	default:
+	}
+	if watcher.DockerRegistryConfig().Server != "registry-a.example.com" {
+		t.Fatalf("the failed refresh replaced the config with %+v", watcher.DockerRegistryConfig())
+	}
+}
+
+func TestWatcherWatchesOnlyItsObjects(t *testing.T) {
+	t.Setenv("YATAI_SYSTEM_NAMESPACE", "yatai-system")
+	t.Setenv("YATAI_DEPLOYMENT_NAMESPACE", "yatai-deployment")
+	t.Setenv("SYSTEM_NAMESPACE", "yatai-deployment")
+
+	cliset := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watcher := NewWatcher(cliset, consts.YataiDeploymentComponentName, 0)
+	events, unsubscribe := watcher.Subscribe(ConfigKindIngress)
+	defer unsubscribe()
+	go func() {
+		_ = watcher.Run(ctx)
+	}()
+	// the initial refresh fails to resolve the missing network ConfigMap,
+	// wait for the informers to be started by creating it
+	if _, err := cliset.CoreV1().ConfigMaps("yatai-deployment").Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-deployment", Name: consts.KubeConfigMapNameNetworkConfig},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitChangeEvent(t, events)
+
+	lists := 0
+	for _, action := range cliset.Actions() {
+		list, ok := action.(k8stesting.ListAction)
+		if !ok {
+			continue
+		}
+		lists++
+		selector := list.GetListRestrictions().Fields
+		if _, ok := selector.RequiresExactMatch("metadata.name"); !ok {
+			t.Errorf("the %s in %s are listed without a name field selector", list.GetResource().Resource, list.GetNamespace())
+		}
+	}
+	if lists == 0 {
+		t.Fatal("no list action was made")
+	}
+}
+
+func TestWatcherRefreshesOnlyTheChangedKinds(t *testing.T) {
+	t.Setenv("YATAI_SYSTEM_NAMESPACE", "yatai-system")
+	t.Setenv("YATAI_DEPLOYMENT_NAMESPACE", "yatai-deployment")
+	t.Setenv("SYSTEM_NAMESPACE", "yatai-deployment")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+
+	sharedEnv := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "yatai-system",
+			Name:      consts.KubeSecretNameYataiImageBuilderSharedEnv,
+		},
+		Data: map[string][]byte{
+			consts.EnvDockerRegistryServer: []byte("registry-a.example.com"),
+		},
+	}
+	cliset := fake.NewSimpleClientset(sharedEnv)
+
+	ctx := context.Background()
+	watcher := NewWatcher(cliset, consts.YataiDeploymentComponentName, 0)
+	events, unsubscribe := watcher.Subscribe(ConfigKindDockerRegistry)
+	defer unsubscribe()
+
+	watcher.refresh(ctx)
+	waitChangeEvent(t, events)
+
+	sharedEnv = sharedEnv.DeepCopy()
+	sharedEnv.Data[consts.EnvDockerRegistryServer] = []byte("registry-b.example.com")
+	if _, err := cliset.CoreV1().Secrets("yatai-system").Update(ctx, sharedEnv, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	cliset.ClearActions()
+	watcher.refresh(ctx, ConfigKindIngress)
+
+	select {
+	case event := <-events:
+		t.Fatalf("only the ingress config should be refreshed, got %+v", event)
+	default:
+	}
+	for _, action := range cliset.Actions() {
+		if action.GetResource().Resource == "secrets" {
+			t.Fatalf("the secrets should not be read to refresh the ingress config, got %+v", action)
+		}
+	}
+
+	watcher.refresh(ctx, ConfigKindDockerRegistry)
+	if event := waitChangeEvent(t, events); event.DockerRegistry.Server != "registry-b.example.com" {
+		t.Fatalf("unexpected change event %+v", event)
+	}
+}
+
+func TestSameDockerRegistryConfigIgnoresECRCredentials(t *testing.T) {
+	a := &DockerRegistryConfig{Server: "123.dkr.ecr.us-east-1.amazonaws.com", Username: "AWS", Password: "token-a", AWSECRWithIAMRole: true}
+	b := &DockerRegistryConfig{Server: "123.dkr.ecr.us-east-1.amazonaws.com", Username: "AWS", Password: "token-b", AWSECRWithIAMRole: true}
+	if !sameDockerRegistryConfig(a, b) {
+		t.Error("a renewed ecr token should not be a change")
+	}
+	if a.Password != "token-a" {
+		t.Error("the compared config should be left as is")
+	}
+
+	a.AWSECRWithIAMRole, b.AWSECRWithIAMRole = false, false
+	if sameDockerRegistryConfig(a, b) {
+		t.Error("a changed static password should be a change")
+	}
+}
@@ -0,0 +1,347 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+// SecretKeyChange is a key of a Secret changed by a write, Old is empty when
+// the key is added and New is empty when it is removed. The values of the
+// fields tagged `redact:"true"` are redacted.
+type SecretKeyChange struct {
+	Key string `json:"key" yaml:"key"`
+	Old string `json:"old" yaml:"old"`
+	New string `json:"new" yaml:"new"`
+}
+
+func (c SecretKeyChange) String() string {
+	return fmt.Sprintf("%s: %q -> %q", c.Key, c.Old, c.New)
+}
+
+// SecretWriteResult describes the write of a config into a Secret.
+type SecretWriteResult struct {
+	Namespace string            `json:"namespace" yaml:"namespace"`
+	Name      string            `json:"name" yaml:"name"`
+	Created   bool              `json:"created" yaml:"created"`
+	Changes   []SecretKeyChange `json:"changes" yaml:"changes"`
+}
+
+// SecretWriter writes configs into the Secrets the config getters read them
+// from, under the same keys. The keys of a Secret which are not part of the
+// written config are kept, keys of empty string fields are removed.
+type SecretWriter struct {
+	cliset kubernetes.Interface
+	dryRun bool
+}
+
+func NewSecretWriter(cliset kubernetes.Interface) *SecretWriter {
+	return &SecretWriter{cliset: cliset}
+}
+
+// WithDryRun makes the writer only compute the changes, the Secrets are not
+// created nor updated.
+func (w *SecretWriter) WithDryRun(dryRun bool) *SecretWriter {
+	w.dryRun = dryRun
+	return w
+}
+
+// WriteS3Config writes conf into the yatai-image-builder shared env secret.
+func (w *SecretWriter) WriteS3Config(ctx context.Context, conf *S3Config) (*SecretWriteResult, error) {
+	return w.WriteConfig(ctx, GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiImageBuilderSharedEnv, conf, conf.Provenance())
+}
+
+// WriteDockerRegistryConfig writes conf into the yatai-image-builder shared env secret.
+func (w *SecretWriter) WriteDockerRegistryConfig(ctx context.Context, conf *DockerRegistryConfig) (*SecretWriteResult, error) {
+	return w.WriteConfig(ctx, GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiImageBuilderSharedEnv, conf, conf.Provenance())
+}
+
+// WriteYataiConfig writes the endpoint and the cluster name of conf into the
+// yatai common env secret and, if yataiComponentName is not empty, the api
+// token into the env secret of that component. An empty api token removes
+// the key, one which was not read from a Secret, the env or a file is not
+// written.
+func (w *SecretWriter) WriteYataiConfig(ctx context.Context, conf *YataiConfig, yataiComponentName string) (results []*SecretWriteResult, err error) {
+	provenance := conf.Provenance()
+	data, err := secretData(conf, provenance)
+	if err != nil {
+		return
+	}
+	// the api token is per component
+	token, writeToken := data[consts.EnvYataiApiToken]
+	delete(data, consts.EnvYataiApiToken)
+	namespace, name := GetYataiSystemNamespaceFromEnv(), consts.KubeSecretNameYataiCommonEnv
+	result, err := w.write(ctx, namespace, name, data, redactedSecretKeys(conf), expectedResourceVersion(provenance, namespace, name))
+	if err != nil {
+		return
+	}
+	results = append(results, result)
+
+	if yataiComponentName == "" || !writeToken {
+		return
+	}
+	component, err := GetComponent(yataiComponentName)
+	if err != nil {
+		return
+	}
+	namespace, err = GetComponentNamespace(ctx, NewClientsetGetter(w.cliset).GetSecret, yataiComponentName)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to get namespace for %s", yataiComponentName)
+		return
+	}
+	name = component.EnvSecretName
+	result, err = w.write(ctx, namespace, name, map[string]*string{consts.EnvYataiApiToken: token}, redactedSecretKeys(conf), expectedResourceVersion(provenance, namespace, name))
+	if err != nil {
+		return
+	}
+	results = append(results, result)
+	return
+}
+
+// WriteComponentNamespace writes the namespace of a registered component into
+// its shared env secret.
+func (w *SecretWriter) WriteComponentNamespace(ctx context.Context, yataiComponentName, namespace string) (result *SecretWriteResult, err error) {
+	component, err := GetComponent(yataiComponentName)
+	if err != nil {
+		return
+	}
+	return w.write(ctx, GetYataiSystemNamespaceFromEnv(), component.SharedEnvSecretName, map[string]*string{component.NamespaceEnvKey: &namespace}, nil, "")
+}
+
+// WriteConfig writes the fields of conf, a pointer to a config struct, into
+// the Secret under the keys of their `secret` tags. A field whose provenance
+// records a reference is written as the reference, not as its resolved value.
+// When fields of conf were read from the Secret, the write fails if it was
+// changed since.
+func (w *SecretWriter) WriteConfig(ctx context.Context, namespace, name string, conf interface{}, provenance Provenance) (result *SecretWriteResult, err error) {
+	data, err := secretData(conf, provenance)
+	if err != nil {
+		return
+	}
+	return w.write(ctx, namespace, name, data, redactedSecretKeys(conf), expectedResourceVersion(provenance, namespace, name))
+}
+
+// expectedResourceVersion is the resource version of the Secret the fields of
+// provenance were read from, empty when none was read from it.
+func expectedResourceVersion(provenance Provenance, namespace, name string) string {
+	source := fmt.Sprintf("secret:%s/%s", namespace, name)
+	for _, origin := range provenance {
+		if origin.Source == source && origin.ResourceVersion != "" {
+			return origin.ResourceVersion
+		}
+	}
+	return ""
+}
+
+// write sets the keys of the Secret to data, a nil value removes the key. It
+// is retried on conflicts, so concurrent writers of other keys are not lost,
+// but it fails if a concurrent writer changed one of the keys of data, or if
+// the Secret first read is not at expectedVersion when it is not empty.
+func (w *SecretWriter) write(ctx context.Context, namespace, name string, data map[string]*string, redacted map[string]struct{}, expectedVersion string) (result *SecretWriteResult, err error) {
+	secrets := w.cliset.CoreV1().Secrets(namespace)
+	var read map[string]string
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result = &SecretWriteResult{Namespace: namespace, Name: name}
+
+		secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			result.Created = true
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: namespace,
+					Name:      name,
+				},
+			}
+		} else if err != nil {
+			return err
+		}
+
+		values := make(map[string]string, len(data))
+		for key := range data {
+			if value, ok := secret.Data[key]; ok {
+				values[key] = string(value)
+			}
+		}
+		if read == nil {
+			if expectedVersion != "" && secret.ResourceVersion != expectedVersion {
+				// not a conflict, the config was read from an older version
+				return errors.Errorf("the secret was changed since the config was read at version %s", expectedVersion)
+			}
+			read = values
+		}
+		for key := range data {
+			old, wasSet := read[key]
+			value, isSet := values[key]
+			if wasSet != isSet || old != value {
+				// not a conflict, the write must not be retried over the change
+				return errors.Errorf("key %s was changed concurrently", key)
+			}
+		}
+
+		result.Changes = applySecretData(secret, data, redacted)
+		if w.dryRun || (!result.Created && len(result.Changes) == 0) {
+			return nil
+		}
+
+		if result.Created {
+			_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+			if k8serrors.IsAlreadyExists(err) {
+				// created concurrently, retry as an update
+				return k8serrors.NewConflict(schema.GroupResource{Resource: "secrets"}, name, err)
+			}
+			return err
+		}
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to write secret %s in namespace %s", name, namespace)
+	}
+	return
+}
+
+// applySecretData sets data on the Secret and returns the changes sorted by key.
+func applySecretData(secret *corev1.Secret, data map[string]*string, redacted map[string]struct{}) []SecretKeyChange {
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte, len(data))
+	}
+
+	changes := make([]SecretKeyChange, 0)
+	for key, value := range data {
+		old, ok := secret.Data[key]
+		if value == nil {
+			if !ok {
+				continue
+			}
+			delete(secret.Data, key)
+			changes = append(changes, newSecretKeyChange(key, string(old), "", redacted))
+			continue
+		}
+		if ok && string(old) == *value {
+			continue
+		}
+		secret.Data[key] = []byte(*value)
+		changes = append(changes, newSecretKeyChange(key, string(old), *value, redacted))
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+func newSecretKeyChange(key, oldValue, newValue string, redacted map[string]struct{}) SecretKeyChange {
+	if _, ok := redacted[key]; ok {
+		if oldValue != "" {
+			oldValue = redact(oldValue)
+		}
+		if newValue != "" {
+			newValue = redact(newValue)
+		}
+	}
+	return SecretKeyChange{Key: key, Old: oldValue, New: newValue}
+}
+
+// secretData maps the `secret` tag keys of conf to their values, nil for the
+// empty string fields. The fields of derived origin are left out.
+func secretData(conf interface{}, provenance Provenance) (data map[string]*string, err error) {
+	rv := reflect.ValueOf(conf)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		err = errors.Errorf("config writer expects a pointer to a struct, got %T", conf)
+		return
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	data = make(map[string]*string, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get(TagSecret), ",")
+		if !field.IsExported() || key == "" || key == "-" {
+			continue
+		}
+
+		// the values derived from the others, e.g. the short-lived ECR
+		// credentials, are not written
+		if isDerivedOrigin(provenance[field.Name]) {
+			continue
+		}
+
+		var value string
+		value, err = fieldValueString(rv.Field(i))
+		if err != nil {
+			err = errors.Wrapf(err, "failed to write %s", field.Name)
+			return
+		}
+		if ref := provenance[field.Name].Ref; ref != "" && field.Tag.Get(TagRef) == "true" {
+			value = ref
+		}
+		if value == "" {
+			data[key] = nil
+			continue
+		}
+		data[key] = &value
+	}
+	return
+}
+
+// isDerivedOrigin tells whether the value was not read from a source a writer
+// can store it back to, the values set by the caller have no origin.
+func isDerivedOrigin(origin Origin) bool {
+	if origin.Source == "" || origin.Ref != "" || origin.Source == "env" {
+		return false
+	}
+	for _, prefix := range []string{"secret:", "configmap:", "file:"} {
+		if strings.HasPrefix(origin.Source, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func redactedSecretKeys(conf interface{}) map[string]struct{} {
+	rt := reflect.TypeOf(conf).Elem()
+	keys := make(map[string]struct{})
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get(TagSecret), ",")
+		if key != "" && field.Tag.Get(TagRedact) == "true" {
+			keys[key] = struct{}{}
+		}
+	}
+	return keys
+}
+
+// fieldValueString is the inverse of setFieldValue.
+func fieldValueString(v reflect.Value) (string, error) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return "", errors.Errorf("unsupported slice type %s", v.Type())
+		}
+		items := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, v.Index(i).String())
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", errors.Errorf("unsupported field type %s", v.Type())
+	}
+}
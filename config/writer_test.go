@@ -0,0 +1,295 @@
+package config
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bentoml/yatai-common/consts"
+)
+
+func TestSecretWriterRoundTrip(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("S3_ENDPOINT", "")
+	t.Setenv("S3_ACCESS_KEY", "")
+	t.Setenv("S3_SECRET_KEY", "")
+	t.Setenv("S3_BUCKET_NAME", "")
+
+	cliset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeSecretNameYataiImageBuilderSharedEnv},
+		Data: map[string][]byte{
+			"YATAI_IMAGE_BUILDER_NAMESPACE": []byte("builder"),
+			"S3_REGION":                     []byte("us-east-1"),
+		},
+	})
+
+	conf := &S3Config{
+		Endpoint:   "minio.example.com",
+		AccessKey:  "access",
+		SecretKey:  "secret",
+		BucketName: "yatai",
+		Secure:     true,
+	}
+	result, err := NewSecretWriter(cliset).WriteS3Config(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("write s3 config failed: %v", err)
+	}
+	if result.Created {
+		t.Fatal("the existing secret should be updated")
+	}
+	for _, change := range result.Changes {
+		if change.Key == "S3_SECRET_KEY" && change.New != redact("secret") {
+			t.Fatalf("the secret key should be redacted in the changes, got %s", change)
+		}
+	}
+
+	secret, err := cliset.CoreV1().Secrets("yatai-system").Get(context.Background(), consts.KubeSecretNameYataiImageBuilderSharedEnv, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["YATAI_IMAGE_BUILDER_NAMESPACE"]) != "builder" {
+		t.Fatal("the keys which are not part of the config should be kept")
+	}
+	if _, ok := secret.Data["S3_REGION"]; ok {
+		t.Fatal("the keys of empty fields should be removed")
+	}
+
+	loaded, err := GetS3ConfigWithSecret(context.Background(), NewClientsetGetter(cliset).GetSecret)
+	if err != nil {
+		t.Fatalf("get s3 config failed: %v", err)
+	}
+	if loaded.Endpoint != conf.Endpoint || loaded.AccessKey != conf.AccessKey || loaded.SecretKey != conf.SecretKey || loaded.BucketName != conf.BucketName || !loaded.Secure {
+		t.Fatalf("unexpected s3 config read back %+v", loaded)
+	}
+}
+
+func TestSecretWriterKeepsRefs(t *testing.T) {
+	cliset := fake.NewSimpleClientset()
+
+	conf := &DockerRegistryConfig{
+		Server:   "registry.example.com",
+		Password: "resolved",
+		provenance: Provenance{
+			"Password": {Source: "env", Key: "DOCKER_REGISTRY_PASSWORD", Ref: "secret://yatai-system/registry/password"},
+		},
+	}
+	result, err := NewSecretWriter(cliset).WriteDockerRegistryConfig(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("write docker registry config failed: %v", err)
+	}
+	if !result.Created {
+		t.Fatal("the secret should be created")
+	}
+
+	secret, err := cliset.CoreV1().Secrets("yatai-system").Get(context.Background(), consts.KubeSecretNameYataiImageBuilderSharedEnv, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := string(secret.Data["DOCKER_REGISTRY_PASSWORD"]); password != "secret://yatai-system/registry/password" {
+		t.Fatalf("the reference should be written instead of the resolved password, got %s", password)
+	}
+}
+
+func TestSecretWriterDryRun(t *testing.T) {
+	cliset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeSecretNameYataiCommonEnv},
+		Data:       map[string][]byte{"YATAI_ENDPOINT": []byte("https://old.example.com")},
+	})
+	cliset.PrependReactor("*", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetVerb() == "create" || action.GetVerb() == "update" {
+			t.Fatalf("dry run should not %s secrets", action.GetVerb())
+		}
+		return false, nil, nil
+	})
+
+	results, err := NewSecretWriter(cliset).WithDryRun(true).WriteYataiConfig(context.Background(), &YataiConfig{
+		Endpoint:    "https://new.example.com",
+		ClusterName: "default",
+	}, "")
+	if err != nil {
+		t.Fatalf("write yatai config failed: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected only the common env secret to be written, got %d results", len(results))
+	}
+
+	expected := []SecretKeyChange{
+		{Key: "YATAI_CLUSTER_NAME", New: "default"},
+		{Key: "YATAI_ENDPOINT", Old: "https://old.example.com", New: "https://new.example.com"},
+	}
+	if len(results[0].Changes) != len(expected) {
+		t.Fatalf("unexpected changes %v", results[0].Changes)
+	}
+	for i, change := range results[0].Changes {
+		if change != expected[i] {
+			t.Fatalf("change %d is %s, expected %s", i, change, expected[i])
+		}
+	}
+}
+
+func TestSecretWriterRetriesOnConflict(t *testing.T) {
+	cliset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeSecretNameYataiDeploymentSharedEnv},
+	})
+	updates := 0
+	cliset.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 1 {
+			return true, nil, k8serrors.NewConflict(schema.GroupResource{Resource: "secrets"}, consts.KubeSecretNameYataiDeploymentSharedEnv, nil)
+		}
+		return false, nil, nil
+	})
+
+	_, err := NewSecretWriter(cliset).WriteComponentNamespace(context.Background(), consts.YataiDeploymentComponentName, "deployments")
+	if err != nil {
+		t.Fatalf("write component namespace failed: %v", err)
+	}
+	if updates != 2 {
+		t.Fatalf("expected the update to be retried once, got %d updates", updates)
+	}
+}
+
+func TestSecretWriterSkipsDerivedFields(t *testing.T) {
+	cliset := fake.NewSimpleClientset()
+
+	conf := &DockerRegistryConfig{
+		Server:            "123456789012.dkr.ecr.us-west-2.amazonaws.com",
+		Username:          "AWS",
+		Password:          "short-lived-token",
+		AWSECRWithIAMRole: true,
+		provenance: Provenance{
+			"Server":            {Source: "env", Key: "DOCKER_REGISTRY_SERVER"},
+			"Username":          {Source: "ecr"},
+			"Password":          {Source: "ecr"},
+			"AWSECRWithIAMRole": {Source: "env", Key: "AWS_ECR_WITH_IAM_ROLE"},
+		},
+	}
+	if _, err := NewSecretWriter(cliset).WriteDockerRegistryConfig(context.Background(), conf); err != nil {
+		t.Fatalf("write docker registry config failed: %v", err)
+	}
+
+	secret, err := cliset.CoreV1().Secrets("yatai-system").Get(context.Background(), consts.KubeSecretNameYataiImageBuilderSharedEnv, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data["DOCKER_REGISTRY_PASSWORD"]; ok {
+		t.Fatal("the ecr token should not be written")
+	}
+	if _, ok := secret.Data["DOCKER_REGISTRY_USERNAME"]; ok {
+		t.Fatal("the ecr username should not be written")
+	}
+	if string(secret.Data["AWS_ECR_WITH_IAM_ROLE"]) != "true" {
+		t.Fatalf("unexpected secret data %v", secret.Data)
+	}
+}
+
+func TestSecretWriterFailsOnConcurrentChange(t *testing.T) {
+	cliset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeSecretNameYataiDeploymentSharedEnv},
+		Data:       map[string][]byte{consts.EnvYataiDeploymentNamespace: []byte("yatai-deployment")},
+	})
+	updates := 0
+	cliset.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates > 1 {
+			return false, nil, nil
+		}
+		// another writer sets the same key first
+		concurrent := action.(k8stesting.UpdateAction).GetObject().(*corev1.Secret).DeepCopy()
+		concurrent.Data[consts.EnvYataiDeploymentNamespace] = []byte("other")
+		if err := cliset.Tracker().Update(action.GetResource(), concurrent, concurrent.Namespace); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil, k8serrors.NewConflict(schema.GroupResource{Resource: "secrets"}, concurrent.Name, nil)
+	})
+
+	_, err := NewSecretWriter(cliset).WriteComponentNamespace(context.Background(), consts.YataiDeploymentComponentName, "deployments")
+	if err == nil {
+		t.Fatal("the write should fail when the key was changed concurrently")
+	}
+	if updates != 1 {
+		t.Fatalf("the write should not be retried over the concurrent change, got %d updates", updates)
+	}
+}
+
+func TestSecretWriterYataiApiToken(t *testing.T) {
+	t.Setenv("YATAI_DEPLOYMENT_NAMESPACE", "yatai-deployment")
+	envSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-deployment", Name: consts.KubeSecretNameYataiDeploymentEnv},
+		Data:       map[string][]byte{consts.EnvYataiApiToken: []byte("token")},
+	}
+
+	cliset := fake.NewSimpleClientset(envSecret.DeepCopy())
+	conf := &YataiConfig{Endpoint: "https://yatai.example.com"}
+	if _, err := NewSecretWriter(cliset).WriteYataiConfig(context.Background(), conf, consts.YataiDeploymentComponentName); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := cliset.CoreV1().Secrets("yatai-deployment").Get(context.Background(), consts.KubeSecretNameYataiDeploymentEnv, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data[consts.EnvYataiApiToken]; ok {
+		t.Fatalf("an empty api token should remove the key, got %q", secret.Data[consts.EnvYataiApiToken])
+	}
+
+	cliset = fake.NewSimpleClientset(envSecret.DeepCopy())
+	conf = &YataiConfig{
+		Endpoint: "https://yatai.example.com",
+		ApiToken: "tenant-token",
+		provenance: Provenance{
+			"ApiToken": {Source: "tenant:yatai"},
+		},
+	}
+	results, err := NewSecretWriter(cliset).WriteYataiConfig(context.Background(), conf, consts.YataiDeploymentComponentName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("the api token of derived origin should not be written, got %+v", results)
+	}
+}
+
+func TestSecretWriterExpectsTheReadVersion(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("S3_ENDPOINT", "")
+	t.Setenv("S3_BUCKET_NAME", "")
+
+	cliset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeSecretNameYataiImageBuilderSharedEnv, ResourceVersion: "1"},
+		Data: map[string][]byte{
+			"S3_ENDPOINT":    []byte("minio.example.com"),
+			"S3_BUCKET_NAME": []byte("yatai"),
+		},
+	})
+	ctx := context.Background()
+	conf, err := GetS3ConfigWithSecret(ctx, NewClientsetGetter(cliset).GetSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin := conf.Provenance()["Endpoint"]; origin.ResourceVersion != "1" {
+		t.Fatalf("the provenance should record the resource version, got %+v", origin)
+	}
+
+	// another writer changes the secret after the config was read
+	secret, err := cliset.CoreV1().Secrets("yatai-system").Get(ctx, consts.KubeSecretNameYataiImageBuilderSharedEnv, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data["S3_REGION"] = []byte("us-east-1")
+	secret.ResourceVersion = "2"
+	if _, err = cliset.CoreV1().Secrets("yatai-system").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.BucketName = "other"
+	if _, err = NewSecretWriter(cliset).WriteS3Config(ctx, conf); err == nil {
+		t.Fatal("the write should fail when the secret changed since the config was read")
+	}
+}
@@ -0,0 +1,121 @@
+package conncheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bentoml/yatai-common/config"
+	"github.com/bentoml/yatai-common/consts"
+)
+
+const defaultS3ObjectPrefix = "yatai-conncheck"
+
+type ProbesOptions struct {
+	// S3 are the options of the S3 probe, the bucket and the prefix are
+	// taken from the S3 config
+	S3 S3TestOptions
+	// RegistryCAFile is a PEM bundle of the CAs the registry probes trust in
+	// addition to the system ones
+	RegistryCAFile string
+	// Redis is probed when not nil, there is no Redis config to read it from
+	Redis *RedisConfig
+	// YataiComponent is the component whose api token the Yatai API server is
+	// probed with, it is not probed when empty
+	YataiComponent string
+	// KubeClient checks the permissions of the service account in the
+	// Kubernetes API server when not nil, the ones of YataiComponent among
+	// them, and reads the yatai ConfigMap
+	KubeClient kubernetes.Interface
+	// KubeFeatures are the opt-in features whose permissions are checked
+	KubeFeatures KubeFeatures
+}
+
+// ProbesFromConfig builds the probes of the services configured for yatai,
+// a config which fails to resolve is reported by a probe failing its config
+// step so the other probes still run. The configs are resolved under ctx,
+// which should have a deadline as the api server may not answer.
+func ProbesFromConfig(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), opts ProbesOptions) []Probe {
+	probes := make([]Probe, 0, 6)
+
+	probes = append(probes, s3ProbeFromConfig(ctx, secretGetter, opts.S3))
+
+	dockerRegistry, err := config.GetDockerRegistryConfig(ctx, secretGetter)
+	if err != nil {
+		probes = append(probes, &configErrorProbe{name: "registry", err: err})
+	} else {
+		for _, probe := range NewRegistryProbesFromConfig(dockerRegistry, opts.RegistryCAFile) {
+			probes = append(probes, probe)
+		}
+	}
+
+	if opts.Redis != nil {
+		probes = append(probes, NewRedisProbe(*opts.Redis))
+	}
+
+	if opts.YataiComponent != "" {
+		probes = append(probes, yataiProbeFromConfig(ctx, secretGetter, opts.KubeClient, opts.YataiComponent))
+	}
+
+	if opts.KubeClient != nil {
+		probes = append(probes, NewKubeProbe(opts.KubeClient, opts.YataiComponent).WithFeatures(opts.KubeFeatures))
+	}
+
+	return probes
+}
+
+func s3ProbeFromConfig(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), opts S3TestOptions) Probe {
+	s3, err := config.GetS3ConfigWithSecret(ctx, secretGetter)
+	if err != nil {
+		return &configErrorProbe{name: "s3", err: err}
+	}
+	client, err := s3.NewMinioClient()
+	if err != nil {
+		return &configErrorProbe{name: "s3", err: err}
+	}
+	opts.BucketName = s3.BucketName
+	opts.Prefix = path.Join(s3.Prefix, defaultS3ObjectPrefix)
+	return NewS3Probe(client).WithOptions(opts)
+}
+
+func yataiProbeFromConfig(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), kubeClient kubernetes.Interface, component string) Probe {
+	var yatai *config.YataiConfig
+	var err error
+	if kubeClient != nil {
+		yatai, err = config.GetYataiConfigWithConfigMap(ctx, secretGetter, config.NewClientsetGetter(kubeClient).GetConfigMap, component, false)
+	} else {
+		yatai, err = config.GetYataiConfig(ctx, secretGetter, component, false)
+	}
+	if err == nil && yatai.Endpoint == "" {
+		err = fmt.Errorf("the yatai endpoint %s is not set: %w", consts.EnvYataiEndpoint, consts.ErrNotFound)
+	}
+	if err != nil {
+		return &configErrorProbe{name: "yatai", err: err}
+	}
+	return NewYataiProbe(*yatai)
+}
+
+// configErrorProbe reports the error the config of a probe failed to resolve with.
+type configErrorProbe struct {
+	name string
+	err  error
+}
+
+func (p *configErrorProbe) Name() string {
+	return p.name
+}
+
+func (p *configErrorProbe) Check(ctx context.Context) *Result {
+	result := newResult(p.name, "")
+	err := p.err
+	if errors.Is(err, consts.ErrNotFound) {
+		err = withCategory(ErrorCategoryNotFound, "the service is not configured, check the environment and the shared env secrets", err)
+	}
+	result.add("config", time.Duration(0), err)
+	return result
+}
@@ -0,0 +1,299 @@
+package conncheck
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bentoml/yatai-common/config"
+	"github.com/bentoml/yatai-common/consts"
+	"github.com/bentoml/yatai-common/system"
+)
+
+// KubePermission is a request to the Kubernetes API a function of config,
+// system or k8sutils makes.
+type KubePermission struct {
+	Verb      string `json:"verb"`
+	Group     string `json:"group,omitempty"`
+	Resource  string `json:"resource"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	// Usage names the functions making the request
+	Usage string `json:"usage"`
+}
+
+// String reads like "patch configmaps/network in yatai-deployment".
+func (p KubePermission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	if p.Name != "" {
+		resource += "/" + p.Name
+	}
+	if p.Namespace == "" {
+		return p.Verb + " " + resource
+	}
+	return fmt.Sprintf("%s %s in %s", p.Verb, resource, p.Namespace)
+}
+
+type KubePermissionResult struct {
+	KubePermission
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// KubeNamespaces are the namespaces the permissions are checked in.
+type KubeNamespaces struct {
+	YataiSystem string
+	// System is system.GetNamespace(), where the ingresses and the network
+	// config live
+	System string
+	// Component is the namespace of the component, empty without a component
+	Component string
+	// ImageBuilders is where the image builder pods run
+	ImageBuilders string
+	// BentoDeployments are the namespaces bentos are deployed to
+	BentoDeployments []string
+}
+
+// KubeFeatures are the opt-in features whose permissions are checked on top
+// of the ones every component needs.
+type KubeFeatures struct {
+	// Watcher is config.Watcher, which lists and watches secrets and
+	// configmaps
+	Watcher bool
+	// Tenancy is config.TenantResolver, which reads the tenant overlays
+	Tenancy bool
+	// NamespaceDiscovery is the globs and the label selector of
+	// BENTO_DEPLOYMENT_NAMESPACES, which list the namespaces
+	NamespaceDiscovery bool
+}
+
+// KubeProbe checks the Kubernetes API server, then that the service account
+// is allowed the requests the yatai components make, with a
+// SelfSubjectAccessReview per permission.
+type KubeProbe struct {
+	cliset    kubernetes.Interface
+	component string
+	features  KubeFeatures
+}
+
+// NewKubeProbe returns a probe of the permissions component needs, the
+// permissions shared by the components only when component is empty.
+func NewKubeProbe(cliset kubernetes.Interface, component string) *KubeProbe {
+	return &KubeProbe{
+		cliset:    cliset,
+		component: component,
+	}
+}
+
+// WithFeatures adds the permissions of the opt-in features in use.
+func (p *KubeProbe) WithFeatures(features KubeFeatures) *KubeProbe {
+	p.features = features
+	return p
+}
+
+func (p *KubeProbe) Name() string {
+	return "kubernetes"
+}
+
+// Check reports a step per permission, a denied permission fails its step
+// without stopping the probe.
+func (p *KubeProbe) Check(ctx context.Context) *Result {
+	result := newResult(p.Name(), "")
+
+	err := result.runWithMessage("api", func() (string, error) {
+		version, err := p.cliset.Discovery().ServerVersion()
+		if err != nil {
+			return "", fmt.Errorf("failed to get the server version: %w", err)
+		}
+		return "server version " + version.GitVersion, nil
+	})
+	if err != nil {
+		return result
+	}
+
+	var namespaces KubeNamespaces
+	_ = result.runWithMessage("namespaces", func() (message string, err error) {
+		// the namespaces resolved before an error are still checked, the
+		// error is often a missing permission reported below
+		namespaces, err = p.ResolveNamespaces(ctx)
+		message = fmt.Sprintf("yatai system: %s, system: %s", namespaces.YataiSystem, namespaces.System)
+		if namespaces.Component != "" {
+			message += fmt.Sprintf(", %s: %s", p.component, namespaces.Component)
+		}
+		if namespaces.ImageBuilders != "" {
+			message += ", image builders: " + namespaces.ImageBuilders
+		}
+		if len(namespaces.BentoDeployments) != 0 {
+			message += ", bento deployments: " + strings.Join(namespaces.BentoDeployments, ", ")
+		}
+		return
+	})
+
+	for _, permission := range KubePermissions(namespaces, p.features) {
+		permission := permission
+		_ = result.runWithMessage(permission.String(), func() (string, error) {
+			review, err := p.reviewPermission(ctx, permission)
+			if err != nil {
+				return permission.Usage, err
+			}
+			if !review.Allowed {
+				err = fmt.Errorf("%s is denied", permission)
+				if review.Reason != "" {
+					err = fmt.Errorf("%s is denied: %s", permission, review.Reason)
+				}
+				err = withCategory(ErrorCategoryPermission, fmt.Sprintf("grant %s to the service account, with a Role bound to it in the namespace or a ClusterRole for the cluster scoped resources", permission), err)
+			}
+			return permission.Usage, err
+		})
+	}
+	return result
+}
+
+// ResolveNamespaces resolves the namespaces like the components do, the ones
+// failing to resolve fall back to their defaults.
+func (p *KubeProbe) ResolveNamespaces(ctx context.Context) (namespaces KubeNamespaces, err error) {
+	namespaces.YataiSystem = config.GetYataiSystemNamespaceFromEnv()
+	namespaces.System = system.GetNamespace()
+
+	resolver := config.NewNamespaceResolver(config.NewClientsetGetter(p.cliset), 0)
+	errs := make([]string, 0)
+
+	if p.component != "" {
+		var component config.Component
+		component, err = config.GetComponent(p.component)
+		if err != nil {
+			return
+		}
+		namespaces.Component, err = resolver.ComponentNamespace(ctx, p.component)
+		if err != nil {
+			errs = append(errs, err.Error())
+			namespaces.Component = component.DefaultNamespace
+		}
+	}
+
+	namespaces.ImageBuilders, err = resolver.ImageBuildersNamespace(ctx)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	namespaces.BentoDeployments, err = resolver.BentoDeploymentNamespaces(ctx)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	err = nil
+	if len(errs) != 0 {
+		err = fmt.Errorf("failed to resolve the namespaces: %s", strings.Join(errs, "; "))
+	}
+	return
+}
+
+// KubePermissions lists the permissions the functions of config, system and
+// k8sutils need in namespaces, the ones of the opt-in features only when they
+// are in use. A permission needed by several of them is listed once.
+func KubePermissions(namespaces KubeNamespaces, features KubeFeatures) []KubePermission {
+	permissions := make([]KubePermission, 0)
+	indexes := make(map[string]int)
+	add := func(usage, group, resource, namespace, name string, verbs ...string) {
+		if resource != "namespaces" && namespace == "" {
+			return
+		}
+		for _, verb := range verbs {
+			permission := KubePermission{Verb: verb, Group: group, Resource: resource, Namespace: namespace, Name: name, Usage: usage}
+			key := permission.String()
+			if i, ok := indexes[key]; ok {
+				if !strings.Contains(permissions[i].Usage, usage) {
+					permissions[i].Usage += ", " + usage
+				}
+				continue
+			}
+			indexes[key] = len(permissions)
+			permissions = append(permissions, permission)
+		}
+	}
+
+	add("config secret getters", "", "secrets", namespaces.YataiSystem, "", "get")
+	add("config.GetYataiConfigWithConfigMap", "", "configmaps", namespaces.YataiSystem, consts.KubeConfigMapNameYataiConfig, "get")
+	add("config.GetYataiConfig", "", "secrets", namespaces.Component, "", "get")
+
+	add("system.GetNetworkConfigConfigMap", "", "configmaps", namespaces.System, consts.KubeConfigMapNameNetworkConfig, "get")
+	add("system.GetDomainSuffix", "", "configmaps", namespaces.System, consts.KubeConfigMapNameNetworkConfig, "patch")
+	add("system.GetIngressIP", "networking.k8s.io", "ingresses", namespaces.System, "", "create", "get", "delete")
+
+	add("k8sutils.MakesureNamespaceExists", "", "namespaces", "", "", "get", "create")
+
+	bentoDeployments := append([]string(nil), namespaces.BentoDeployments...)
+	sort.Strings(bentoDeployments)
+	for _, namespace := range append([]string{namespaces.ImageBuilders}, bentoDeployments...) {
+		add("k8sutils.MakeSureDockerRegcred", "", "secrets", namespace, consts.KubeSecretNameRegcred, "get", "update")
+		add("k8sutils.MakeSureDockerRegcred", "", "secrets", namespace, "", "create")
+	}
+
+	if features.Watcher {
+		for _, namespace := range []string{namespaces.YataiSystem, namespaces.Component, namespaces.System} {
+			add("config.Watcher", "", "secrets", namespace, "", "list", "watch")
+		}
+		for _, namespace := range []string{namespaces.YataiSystem, namespaces.System} {
+			add("config.Watcher", "", "configmaps", namespace, "", "list", "watch")
+		}
+	}
+	if features.Tenancy {
+		add("config.TenantResolver", "", "namespaces", "", "", "get")
+		for _, namespace := range bentoDeployments {
+			add("config.TenantResolver", "", "secrets", namespace, "", "list")
+		}
+	}
+	if features.NamespaceDiscovery {
+		add("config.NamespaceResolver", "", "namespaces", "", "", "list")
+	}
+
+	return permissions
+}
+
+// CheckPermissions asks the API server whether the service account is
+// allowed each of the permissions, the results of the permissions reviewed
+// before an error are returned with it.
+func (p *KubeProbe) CheckPermissions(ctx context.Context, permissions []KubePermission) ([]KubePermissionResult, error) {
+	results := make([]KubePermissionResult, 0, len(permissions))
+	for _, permission := range permissions {
+		result, err := p.reviewPermission(ctx, permission)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// reviewPermission creates a SelfSubjectAccessReview of the permission.
+func (p *KubeProbe) reviewPermission(ctx context.Context, permission KubePermission) (result KubePermissionResult, err error) {
+	review, err := p.cliset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: permission.Namespace,
+				Verb:      permission.Verb,
+				Group:     permission.Group,
+				Resource:  permission.Resource,
+				Name:      permission.Name,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		err = fmt.Errorf("failed to review %s: %w", permission, err)
+		return
+	}
+	result = KubePermissionResult{
+		KubePermission: permission,
+		Allowed:        review.Status.Allowed,
+		Reason:         review.Status.Reason,
+	}
+	return
+}
@@ -0,0 +1,152 @@
+package conncheck
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bentoml/yatai-common/consts"
+	"github.com/bentoml/yatai-common/system"
+)
+
+func TestKubeProbe(t *testing.T) {
+	t.Setenv(consts.EnvYataiSystemNamespace, "yatai-system")
+	t.Setenv(consts.EnvYataiDeploymentNamespace, "")
+	t.Setenv(consts.EnvBentoDeploymentNamespaces, "")
+	t.Setenv(consts.EnvBentoDeploymentNamespaceSelector, "")
+	t.Setenv("IMAGE_BUILDERS_NAMESPACE", "")
+	t.Setenv(system.NamespaceEnvKey, "yatai-deployment")
+
+	cliset := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeSecretNameYataiDeploymentSharedEnv},
+			Data: map[string][]byte{
+				consts.EnvYataiDeploymentNamespace:  []byte("yatai-deployment"),
+				consts.EnvBentoDeploymentNamespaces: []byte("team-a"),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeSecretNameYataiImageBuilderSharedEnv},
+			Data: map[string][]byte{
+				"IMAGE_BUILDERS_NAMESPACE": []byte("builders"),
+			},
+		},
+	)
+	reviews := 0
+	cliset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		if attributes.Verb == "patch" && attributes.Resource == "configmaps" {
+			review.Status.Reason = "RBAC: no rule allows it"
+		} else {
+			review.Status.Allowed = true
+		}
+		return true, review, nil
+	})
+
+	result := NewKubeProbe(cliset, consts.YataiDeploymentComponentName).WithFeatures(KubeFeatures{Watcher: true, Tenancy: true, NamespaceDiscovery: true}).Check(context.Background())
+	steps := stepsByName(result)
+
+	if message := steps["namespaces"].Message; steps["namespaces"].Status != StepPassed || !strings.Contains(message, "image builders: builders") || !strings.Contains(message, "bento deployments: team-a") {
+		t.Fatalf("unexpected namespaces step %+v", steps["namespaces"])
+	}
+	if reviews != len(result.Steps)-2 {
+		t.Errorf("expected a review per permission step, got %d reviews for %d steps", reviews, len(result.Steps))
+	}
+
+	patch := steps["patch configmaps/network in yatai-deployment"]
+	if patch.Status != StepFailed || patch.Category != ErrorCategoryPermission || !strings.Contains(patch.Error, "RBAC: no rule allows it") || patch.Message != "system.GetDomainSuffix" {
+		t.Errorf("the denied patch should fail its step, got %+v", patch)
+	}
+	for _, name := range []string{
+		"get secrets in yatai-system",
+		"create ingresses.networking.k8s.io in yatai-deployment",
+		"create namespaces",
+		"update secrets/yatai-regcred in builders",
+		"list secrets in team-a",
+	} {
+		if step, ok := steps[name]; !ok || step.Status != StepPassed {
+			t.Errorf("the %s step should pass, got %+v", name, step)
+		}
+	}
+	if usage := steps["list secrets in yatai-deployment"].Message; usage != "config.Watcher" {
+		t.Errorf("the permission needed twice should be listed once, got usage %q", usage)
+	}
+}
+
+func TestKubeProbeReviewError(t *testing.T) {
+	t.Setenv(consts.EnvYataiSystemNamespace, "yatai-system")
+	t.Setenv(system.NamespaceEnvKey, "yatai-deployment")
+
+	cliset := fake.NewSimpleClientset()
+	cliset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		if review.Spec.ResourceAttributes.Resource == "namespaces" {
+			return true, nil, errors.New("the review timed out")
+		}
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+	probe := NewKubeProbe(cliset, "")
+
+	result := probe.Check(context.Background())
+	steps := stepsByName(result)
+	if step := steps["create namespaces"]; step.Status != StepFailed || !strings.Contains(step.Error, "the review timed out") || step.Message != "k8sutils.MakesureNamespaceExists" {
+		t.Errorf("the failed review should fail its step, got %+v", step)
+	}
+	if step := steps["get secrets in yatai-system"]; step.Status != StepPassed {
+		t.Errorf("the other permissions should still be reviewed, got %+v", step)
+	}
+
+	permissions := []KubePermission{
+		{Verb: "get", Resource: "secrets", Namespace: "yatai-system"},
+		{Verb: "create", Resource: "namespaces"},
+	}
+	results, err := probe.CheckPermissions(context.Background(), permissions)
+	if err == nil || len(results) != 1 || !results[0].Allowed {
+		t.Errorf("the results reviewed before the error should be returned, got %+v, %v", results, err)
+	}
+}
+
+func TestKubePermissionsDeduplicate(t *testing.T) {
+	permissions := KubePermissions(KubeNamespaces{YataiSystem: "yatai-system", System: "yatai-system"}, KubeFeatures{Watcher: true, Tenancy: true, NamespaceDiscovery: true})
+	seen := make(map[string]bool, len(permissions))
+	for _, permission := range permissions {
+		if seen[permission.String()] {
+			t.Errorf("%s is listed twice", permission)
+		}
+		seen[permission.String()] = true
+		if permission.Namespace == "" && permission.Resource != "namespaces" {
+			t.Errorf("%s should not be checked without a namespace", permission)
+		}
+	}
+	if !seen["get configmaps/yatai in yatai-system"] || !seen["patch configmaps/network in yatai-system"] {
+		t.Errorf("missing permissions in %v", permissions)
+	}
+}
+
+func TestKubePermissionsOptInFeatures(t *testing.T) {
+	namespaces := KubeNamespaces{YataiSystem: "yatai-system", System: "yatai-deployment", BentoDeployments: []string{"yatai"}}
+	for _, permission := range KubePermissions(namespaces, KubeFeatures{}) {
+		if permission.Verb == "list" || permission.Verb == "watch" {
+			t.Errorf("%s is only needed by an opt-in feature", permission)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, permission := range KubePermissions(namespaces, KubeFeatures{Tenancy: true}) {
+		seen[permission.String()] = true
+	}
+	if !seen["list secrets in yatai"] || !seen["get namespaces"] || seen["list namespaces"] || seen["watch secrets in yatai-system"] {
+		t.Errorf("unexpected permissions of the tenancy %v", seen)
+	}
+}
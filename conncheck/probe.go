@@ -0,0 +1,244 @@
+package conncheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Probe checks the connectivity to a service yatai depends on.
+type Probe interface {
+	Name() string
+	// Check runs every step of the probe and reports each of them, it does
+	// not stop at the first failed step unless the next ones depend on it.
+	Check(ctx context.Context) *Result
+}
+
+var (
+	_ Probe = (*S3Probe)(nil)
+	_ Probe = (*RedisProbe)(nil)
+	_ Probe = (*RegistryProbe)(nil)
+	_ Probe = (*YataiProbe)(nil)
+	_ Probe = (*KubeProbe)(nil)
+)
+
+type StepStatus string
+
+const (
+	StepPassed  StepStatus = "passed"
+	StepFailed  StepStatus = "failed"
+	StepSkipped StepStatus = "skipped"
+)
+
+// ErrorCategory tells which layer a step failed at.
+type ErrorCategory string
+
+const (
+	ErrorCategoryDNS          ErrorCategory = "dns"
+	ErrorCategoryTCP          ErrorCategory = "tcp"
+	ErrorCategoryTLS          ErrorCategory = "tls"
+	ErrorCategoryAuth         ErrorCategory = "auth"
+	ErrorCategoryPermission   ErrorCategory = "permission"
+	ErrorCategoryDataMismatch ErrorCategory = "data_mismatch"
+	ErrorCategoryNotFound     ErrorCategory = "not_found"
+	ErrorCategoryUnknown      ErrorCategory = "unknown"
+)
+
+var remediationHints = map[ErrorCategory]string{
+	ErrorCategoryDNS:          "check that the host name is correct and resolves from the pod, with nslookup in the same namespace",
+	ErrorCategoryTCP:          "check the port, and that no network policy, firewall or proxy blocks the connection from the pod",
+	ErrorCategoryTLS:          "check that the certificate is valid for the host name and signed by a trusted CA, or configure the CA bundle",
+	ErrorCategoryAuth:         "check the credentials, they are rejected by the server",
+	ErrorCategoryPermission:   "the credentials are accepted but lack permissions, grant them to the user or role",
+	ErrorCategoryDataMismatch: "the data read back differs from the data written, check for proxies or gateways rewriting the payload",
+	ErrorCategoryNotFound:     "the resource does not exist, create it or fix its name in the config",
+}
+
+// Step is the outcome of a single check of a probe.
+type Step struct {
+	Name     string        `json:"name"`
+	Status   StepStatus    `json:"status"`
+	Duration time.Duration `json:"duration"`
+	// Message details the outcome, such as why the step was skipped
+	Message  string        `json:"message,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Category ErrorCategory `json:"category,omitempty"`
+	Hint     string        `json:"hint,omitempty"`
+
+	err error
+}
+
+// Err returns the error the step failed with.
+func (s *Step) Err() error {
+	return s.err
+}
+
+// Result is the outcome of a probe.
+type Result struct {
+	Probe  string `json:"probe"`
+	Target string `json:"target"`
+	Steps  []Step `json:"steps"`
+}
+
+func newResult(probe, target string) *Result {
+	return &Result{Probe: probe, Target: target, Steps: make([]Step, 0)}
+}
+
+// Passed tells whether no step failed.
+func (r *Result) Passed() bool {
+	return r.Err() == nil
+}
+
+// Err returns the error of the first failed step.
+func (r *Result) Err() error {
+	for i := range r.Steps {
+		if r.Steps[i].Status == StepFailed {
+			return r.Steps[i].err
+		}
+	}
+	return nil
+}
+
+// run records fn as a step and returns its error.
+func (r *Result) run(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	r.add(name, time.Since(start), err)
+	return err
+}
+
+// runWithMessage is run for the steps which detail their outcome.
+func (r *Result) runWithMessage(name string, fn func() (string, error)) error {
+	start := time.Now()
+	message, err := fn()
+	r.add(name, time.Since(start), err)
+	r.Steps[len(r.Steps)-1].Message = message
+	return err
+}
+
+func (r *Result) add(name string, duration time.Duration, err error) {
+	step := Step{Name: name, Status: StepPassed, Duration: duration}
+	if err != nil {
+		step.Status = StepFailed
+		step.Error = err.Error()
+		step.Category = Categorize(err)
+		step.Hint = hint(err, step.Category)
+		step.err = err
+	}
+	r.Steps = append(r.Steps, step)
+}
+
+func (r *Result) skip(name, message string) {
+	r.Steps = append(r.Steps, Step{Name: name, Status: StepSkipped, Message: message})
+}
+
+// log writes the steps to logrus, the way the probes reported them before
+// they returned results.
+func (r *Result) log() {
+	for _, step := range r.Steps {
+		switch step.Status {
+		case StepPassed:
+			logrus.Infof("%s %s check passed", r.Probe, step.Name)
+		case StepSkipped:
+			logrus.Infof("%s %s check skipped: %s", r.Probe, step.Name, step.Message)
+		case StepFailed:
+			logrus.Errorf("%s %s check failed: %s", r.Probe, step.Name, step.Error)
+		}
+	}
+}
+
+// categorizedError is an error the probe knows the category of.
+type categorizedError struct {
+	category ErrorCategory
+	hint     string
+	err      error
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Unwrap() error {
+	return e.err
+}
+
+// withCategory sets the category of err, hint overrides the default hint of
+// the category when not empty.
+func withCategory(category ErrorCategory, hint string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{category: category, hint: hint, err: err}
+}
+
+// Categorize returns the category of an error returned by a probe, network
+// errors are categorized by their type.
+func Categorize(err error) ErrorCategory {
+	var categorized *categorizedError
+	if errors.As(err, &categorized) {
+		return categorized.category
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrorCategoryDNS
+	}
+
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var verificationErr *tls.CertificateVerificationError
+	var recordHeaderErr tls.RecordHeaderError
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certificateInvalidErr) ||
+		errors.As(err, &verificationErr) || errors.As(err, &recordHeaderErr) {
+		return ErrorCategoryTLS
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorCategoryTCP
+	}
+
+	return ErrorCategoryUnknown
+}
+
+func hint(err error, category ErrorCategory) string {
+	var categorized *categorizedError
+	if errors.As(err, &categorized) && categorized.hint != "" {
+		return categorized.hint
+	}
+	return remediationHints[category]
+}
+
+// newTLSConfig trusts the CAs of the PEM bundle caFile in addition to the
+// system ones.
+func newTLSConfig(caFile, serverName string, insecureSkipVerify bool) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify, // nolint:gosec
+	}
+	if caFile == "" {
+		return conf, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file %s: %w", caFile, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in CA file %s", caFile)
+	}
+	conf.RootCAs = pool
+	return conf, nil
+}
@@ -0,0 +1,55 @@
+package conncheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCategorize(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	// the certificate of the test server is not trusted by the default client
+	_, tlsErr := http.Get(server.URL)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	_, tcpErr := net.Dial("tcp", addr)
+
+	for _, c := range []struct {
+		err      error
+		category ErrorCategory
+	}{
+		{fmt.Errorf("request failed: %w", &net.DNSError{Err: "no such host", Name: "minio.invalid", IsNotFound: true}), ErrorCategoryDNS},
+		{tcpErr, ErrorCategoryTCP},
+		{tlsErr, ErrorCategoryTLS},
+		{fmt.Errorf("check failed: %w", withCategory(ErrorCategoryAuth, "", fmt.Errorf("unauthorized"))), ErrorCategoryAuth},
+		{fmt.Errorf("something else"), ErrorCategoryUnknown},
+	} {
+		if category := Categorize(c.err); category != c.category {
+			t.Errorf("%v is categorized %s, expected %s", c.err, category, c.category)
+		}
+	}
+}
+
+func TestRegistryProbeResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	result := NewRegistryProbe(RegistryConfig{Endpoint: server.URL, Username: "yatai", Password: "wrong"}).Check(context.Background())
+	if result.Passed() || len(result.Steps) != 1 {
+		t.Fatalf("expected the v2 check to fail and stop the probe, got %+v", result.Steps)
+	}
+	if step := result.Steps[0]; step.Name != "v2" || step.Category != ErrorCategoryAuth || step.Hint == "" {
+		t.Fatalf("unexpected step %+v", step)
+	}
+}
@@ -2,74 +2,342 @@ package conncheck
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
-	"github.com/sirupsen/logrus"
 )
 
+const defaultRedisKeyPrefix = "yatai-conncheck"
+
 type RedisConfig struct {
-	Addr     string
+	// Addr is the address of the server, or a seed address of the cluster
+	Addr string
+	// Addrs are more seed addresses of the cluster, or the addresses of the
+	// sentinels when SentinelMasterName is set
+	Addrs []string
+	// Username is the ACL user, the default user when empty
+	Username string
 	Password string
 	Cluster  bool
+
+	// SentinelMasterName discovers the master of that name through the
+	// sentinels at Addrs
+	SentinelMasterName string
+	SentinelUsername   string
+	SentinelPassword   string
+
+	TLS bool
+	// TLSCAFile is a PEM bundle of the CAs trusted in addition to the system ones
+	TLSCAFile             string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+}
+
+func (c RedisConfig) addrs() []string {
+	addrs := make([]string, 0, len(c.Addrs)+1)
+	if c.Addr != "" {
+		addrs = append(addrs, c.Addr)
+	}
+	return append(addrs, c.Addrs...)
+}
+
+func (c RedisConfig) tlsConfig() (*tls.Config, error) {
+	if !c.TLS {
+		return nil, nil
+	}
+	return newTLSConfig(c.TLSCAFile, c.TLSServerName, c.TLSInsecureSkipVerify)
 }
 
 type RedisProbe struct {
+	config RedisConfig
 	client redis.UniversalClient
 	addr   string
+	prefix string
+	err    error
 }
 
 func NewRedisProbe(cfg RedisConfig) *RedisProbe {
-	var client redis.UniversalClient
+	p := &RedisProbe{config: cfg, addr: strings.Join(cfg.addrs(), ","), prefix: defaultRedisKeyPrefix}
 
-	if cfg.Cluster {
-		client = redis.NewClusterClient(&redis.ClusterOptions{
-			Addrs:    []string{cfg.Addr},
-			Password: cfg.Password,
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		// reported by Check, the client is still created so Close works
+		p.err = err
+	}
+
+	switch {
+	case cfg.SentinelMasterName != "":
+		p.client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.SentinelMasterName,
+			SentinelAddrs:    cfg.addrs(),
+			SentinelUsername: cfg.SentinelUsername,
+			SentinelPassword: cfg.SentinelPassword,
+			Username:         cfg.Username,
+			Password:         cfg.Password,
+			TLSConfig:        tlsConfig,
+		})
+	case cfg.Cluster:
+		p.client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     cfg.addrs(),
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+			TLSConfig: tlsConfig,
 		})
-	} else {
-		client = redis.NewClient(&redis.Options{
-			Addr:     cfg.Addr,
-			Password: cfg.Password,
+	default:
+		p.client = redis.NewClient(&redis.Options{
+			Addr:      cfg.Addr,
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+			TLSConfig: tlsConfig,
 		})
 	}
 
-	return &RedisProbe{client: client, addr: cfg.Addr}
+	return p
+}
+
+// WithPrefix sets the prefix of the test keys Check writes.
+func (p *RedisProbe) WithPrefix(prefix string) *RedisProbe {
+	p.prefix = prefix
+	return p
+}
+
+func (p *RedisProbe) Name() string {
+	return "redis"
 }
 
 func (p *RedisProbe) Test(ctx context.Context, prefix string) error {
-	testKey := fmt.Sprintf("%s:%d", prefix, time.Now().UnixNano())
-	testValue := "test-value"
+	probe := *p
+	probe.prefix = prefix
+	result := probe.Check(ctx)
+	result.log()
+	return result.Err()
+}
 
-	logrus.Infof("Testing Redis connection to %s", p.addr)
-	err := p.client.Set(ctx, testKey, testValue, 1*time.Minute).Err()
-	if err != nil {
-		logrus.Errorf("Redis write test failed: %v", err)
-		return fmt.Errorf("redis write test failed: %w", err)
+// Check discovers the master through the sentinels, or the topology of the
+// cluster, then writes test keys, reads them back and deletes them. In
+// cluster mode a key is written to every shard.
+func (p *RedisProbe) Check(ctx context.Context) *Result {
+	result := newResult(p.Name(), p.addr)
+
+	if p.err != nil {
+		result.add("config", 0, withCategory(ErrorCategoryTLS, "check the CA bundle of the redis TLS config", p.err))
+		return result
 	}
-	logrus.Infof("Redis write test passed")
 
-	val, err := p.client.Get(ctx, testKey).Result()
+	keys := []string{fmt.Sprintf("%s:%d", p.prefix, time.Now().UnixNano())}
+	switch {
+	case p.config.SentinelMasterName != "":
+		if err := result.runWithMessage("sentinel", func() (string, error) { return p.checkSentinels(ctx) }); err != nil {
+			return result
+		}
+	case p.config.Cluster:
+		if err := result.runWithMessage("topology", func() (message string, err error) {
+			keys, message, err = p.checkClusterTopology(ctx, keys[0])
+			return
+		}); err != nil {
+			return result
+		}
+	}
+
+	testValue := "test-value"
+	err := result.run("write", func() error {
+		for _, key := range keys {
+			err := p.client.Set(ctx, key, testValue, 1*time.Minute).Err()
+			if err != nil {
+				return categorizeRedisError(fmt.Errorf("redis write test failed: %w", err))
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		logrus.Errorf("Redis read test failed: %v", err)
-		return fmt.Errorf("redis read test failed: %w", err)
+		return result
+	}
+
+	_ = result.run("read", func() error {
+		for _, key := range keys {
+			val, err := p.client.Get(ctx, key).Result()
+			if errors.Is(err, redis.Nil) {
+				return withCategory(ErrorCategoryDataMismatch, "the key written is missing, check that the address is not a read replica or a proxy to another server", fmt.Errorf("redis read test failed: %w", err))
+			}
+			if err != nil {
+				return categorizeRedisError(fmt.Errorf("redis read test failed: %w", err))
+			}
+			if val != testValue {
+				return withCategory(ErrorCategoryDataMismatch, "", fmt.Errorf("redis value mismatch: got %s, want %s", val, testValue))
+			}
+		}
+		return nil
+	})
+
+	_ = result.run("cleanup", func() error {
+		for _, key := range keys {
+			err := p.client.Del(ctx, key).Err()
+			if err != nil {
+				return categorizeRedisError(fmt.Errorf("redis cleanup failed: %w", err))
+			}
+		}
+		return nil
+	})
+
+	return result
+}
+
+// checkSentinels asks every sentinel for the address of the master, it fails
+// when none answers or they disagree.
+func (p *RedisProbe) checkSentinels(ctx context.Context) (message string, err error) {
+	tlsConfig, _ := p.config.tlsConfig()
+	masters := make(map[string]struct{})
+	failures := make([]string, 0)
+	var lastErr error
+	for _, addr := range p.config.addrs() {
+		sentinel := redis.NewSentinelClient(&redis.Options{
+			Addr:      addr,
+			Username:  p.config.SentinelUsername,
+			Password:  p.config.SentinelPassword,
+			TLSConfig: tlsConfig,
+		})
+		master, sentinelErr := sentinel.GetMasterAddrByName(ctx, p.config.SentinelMasterName).Result()
+		_ = sentinel.Close()
+		if sentinelErr != nil {
+			lastErr = sentinelErr
+			failures = append(failures, fmt.Sprintf("%s: %v", addr, sentinelErr))
+			continue
+		}
+		if len(master) != 2 {
+			failures = append(failures, fmt.Sprintf("%s: unexpected reply %v", addr, master))
+			continue
+		}
+		masters[net.JoinHostPort(master[0], master[1])] = struct{}{}
+	}
+
+	if len(masters) == 0 {
+		if errors.Is(lastErr, redis.Nil) {
+			return "", withCategory(ErrorCategoryNotFound, "check the master name against the sentinel config", fmt.Errorf("no sentinel knows master %s", p.config.SentinelMasterName))
+		}
+		return "", categorizeRedisError(fmt.Errorf("no sentinel answered: %s: %w", strings.Join(failures, "; "), lastErr))
+	}
+	if len(masters) > 1 {
+		addrs := make([]string, 0, len(masters))
+		for addr := range masters {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		return "", withCategory(ErrorCategoryDataMismatch, "the sentinels disagree, a failover may be in progress or the sentinels may be split", fmt.Errorf("sentinels report different masters: %s", strings.Join(addrs, ", ")))
 	}
-	logrus.Infof("Redis read test passed")
 
-	if val != testValue {
-		logrus.Errorf("Redis value mismatch: got %s, want %s", val, testValue)
-		return fmt.Errorf("redis value mismatch: got %s, want %s", val, testValue)
+	for addr := range masters {
+		message = fmt.Sprintf("master %s at %s", p.config.SentinelMasterName, addr)
+	}
+	if len(failures) != 0 {
+		message += ", unreachable sentinels: " + strings.Join(failures, "; ")
+	}
+	return
+}
+
+// checkClusterTopology pings every master of the cluster and returns a test
+// key per shard.
+func (p *RedisProbe) checkClusterTopology(ctx context.Context, key string) (keys []string, message string, err error) {
+	cluster, ok := p.client.(*redis.ClusterClient)
+	if !ok {
+		return nil, "", fmt.Errorf("the client is not a cluster client")
 	}
 
-	err = p.client.Del(ctx, testKey).Err()
+	slots, err := cluster.ClusterSlots(ctx).Result()
 	if err != nil {
-		logrus.Errorf("Redis cleanup failed: %v", err)
-		return fmt.Errorf("redis cleanup failed: %w", err)
+		return nil, "", categorizeRedisError(fmt.Errorf("failed to get the cluster slots: %w", err))
+	}
+	if len(slots) == 0 {
+		return nil, "", withCategory(ErrorCategoryNotFound, "the cluster has no slot assigned, check that it is initialized", fmt.Errorf("no slot is assigned"))
 	}
-	logrus.Infof("Redis cleanup test passed")
 
-	return nil
+	unreachable := make([]string, 0)
+	for _, slot := range slots {
+		if len(slot.Nodes) == 0 {
+			continue
+		}
+		addr := slot.Nodes[0].Addr
+		node := redis.NewClient(&redis.Options{
+			Addr:      addr,
+			Username:  p.config.Username,
+			Password:  p.config.Password,
+			TLSConfig: cluster.Options().TLSConfig,
+		})
+		err := node.Ping(ctx).Err()
+		_ = node.Close()
+		if err != nil {
+			unreachable = append(unreachable, fmt.Sprintf("%s: %v", addr, err))
+		}
+	}
+	if len(unreachable) != 0 {
+		return nil, "", withCategory(ErrorCategoryTCP, "every master must be reachable from the pod at the address the cluster announces, check cluster-announce-ip", fmt.Errorf("unreachable masters: %s", strings.Join(unreachable, "; ")))
+	}
+
+	// pick a key hashing into the slots of each shard
+	keys = make([]string, 0, len(slots))
+	for i, slot := range slots {
+		for n := 0; n < 100000; n++ {
+			candidate := fmt.Sprintf("%s:{%d}", key, n)
+			if s := int(redisKeySlot(candidate)); s >= int(slot.Start) && s <= int(slot.End) {
+				keys = append(keys, candidate)
+				break
+			}
+		}
+		if len(keys) != i+1 {
+			return nil, "", fmt.Errorf("no test key hashes to slots %d-%d", slot.Start, slot.End)
+		}
+	}
+
+	masters := make(map[string]struct{}, len(slots))
+	for _, slot := range slots {
+		if len(slot.Nodes) != 0 {
+			masters[slot.Nodes[0].Addr] = struct{}{}
+		}
+	}
+	message = fmt.Sprintf("%d masters serving %d slot ranges", len(masters), len(slots))
+	return
+}
+
+// redisKeySlot is the cluster slot of a key, the CRC16 of its hash tag or of
+// the key modulo 16384.
+func redisKeySlot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc % 16384
+}
+
+// categorizeRedisError sets the category of the Redis error replies.
+func categorizeRedisError(err error) error {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return err
+	}
+	switch reply := redisErr.Error(); {
+	case strings.HasPrefix(reply, "NOAUTH"), strings.HasPrefix(reply, "WRONGPASS"):
+		return withCategory(ErrorCategoryAuth, "check the redis username and password", err)
+	case strings.HasPrefix(reply, "NOPERM"):
+		return withCategory(ErrorCategoryPermission, "the ACL user can not run the command or access the key, allow it on the test key prefix", err)
+	}
+	return err
 }
 
 func (p *RedisProbe) Close() error {
@@ -0,0 +1,329 @@
+package conncheck
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeRedisSlot struct {
+	start, end int
+	addr       string
+}
+
+// fakeRedis is a stand-in for a Redis server speaking RESP2, it implements
+// the commands used by the probe and the go-redis clients, with ACL users,
+// sentinel master discovery and cluster slots.
+type fakeRedis struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	// users maps the ACL users to their passwords, no authentication is
+	// required when empty
+	users           map[string]string
+	data            map[string]string
+	sentinelMasters map[string]string
+	clusterSlots    []fakeRedisSlot
+	// sets counts the SET commands
+	sets int
+}
+
+func startFakeRedis(t *testing.T, tlsConfig *tls.Config) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	f := &fakeRedis{
+		listener:        listener,
+		users:           make(map[string]string),
+		data:            make(map[string]string),
+		sentinelMasters: make(map[string]string),
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) setCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sets
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := false
+
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		reply := f.reply(args, &authed)
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) reply(args []string, authed *bool) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	command := strings.ToUpper(args[0])
+	switch command {
+	case "HELLO", "COMMAND":
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	case "AUTH":
+		username, password := "default", args[len(args)-1]
+		if len(args) == 3 {
+			username = args[1]
+		}
+		if expected, ok := f.users[username]; !ok || expected != password {
+			return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	}
+	if len(f.users) != 0 && !*authed {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	switch command {
+	case "CLIENT", "READONLY", "SELECT":
+		return "+OK\r\n"
+	case "PING":
+		return "+PONG\r\n"
+	case "SET":
+		f.sets++
+		f.data[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		value, ok := f.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return respBulk(value)
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := f.data[key]; ok {
+				delete(f.data, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "SENTINEL":
+		if strings.ToLower(args[1]) != "get-master-addr-by-name" {
+			return "*0\r\n"
+		}
+		master, ok := f.sentinelMasters[args[2]]
+		if !ok {
+			return "*-1\r\n"
+		}
+		host, port, _ := net.SplitHostPort(master)
+		return "*2\r\n" + respBulk(host) + respBulk(port)
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		return "*3\r\n" + respBulk(strings.ToLower(command)) + respBulk(args[1]) + ":1\r\n"
+	case "CLUSTER":
+		reply := fmt.Sprintf("*%d\r\n", len(f.clusterSlots))
+		for i, slot := range f.clusterSlots {
+			host, port, _ := net.SplitHostPort(slot.addr)
+			reply += fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n%s:%s\r\n%s", slot.start, slot.end, respBulk(host), port, respBulk(fmt.Sprintf("node-%d", i)))
+		}
+		return reply
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestRedisKeySlot(t *testing.T) {
+	if slot := redisKeySlot("foo"); slot != 12182 {
+		t.Errorf("slot of foo: got %d, want 12182", slot)
+	}
+	if redisKeySlot("{user1000}.following") != redisKeySlot("user1000") {
+		t.Error("keys with the same hash tag should hash to the same slot")
+	}
+}
+
+func TestRedisProbeACLUser(t *testing.T) {
+	server := startFakeRedis(t, nil)
+	server.users["yatai"] = "secret"
+
+	probe := NewRedisProbe(RedisConfig{Addr: server.addr(), Username: "yatai", Password: "secret"})
+	defer probe.Close()
+	if result := probe.Check(context.Background()); !result.Passed() {
+		t.Fatalf("redis probe failed: %v", result.Err())
+	}
+
+	probe = NewRedisProbe(RedisConfig{Addr: server.addr(), Username: "yatai", Password: "wrong"})
+	defer probe.Close()
+	result := probe.Check(context.Background())
+	if result.Passed() || result.Steps[0].Category != ErrorCategoryAuth {
+		t.Fatalf("the wrong password should fail with an auth error, got %+v", result.Steps)
+	}
+}
+
+func TestRedisProbeSentinel(t *testing.T) {
+	master := startFakeRedis(t, nil)
+	sentinel := startFakeRedis(t, nil)
+	sentinel.sentinelMasters["mymaster"] = master.addr()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := listener.Addr().String()
+	listener.Close()
+
+	probe := NewRedisProbe(RedisConfig{
+		Addrs:              []string{unreachable, sentinel.addr()},
+		SentinelMasterName: "mymaster",
+	})
+	defer probe.Close()
+	result := probe.Check(context.Background())
+	if !result.Passed() {
+		t.Fatalf("redis probe failed: %v", result.Err())
+	}
+	step := result.Steps[0]
+	if step.Name != "sentinel" || !strings.Contains(step.Message, master.addr()) || !strings.Contains(step.Message, unreachable) {
+		t.Fatalf("the sentinel step should report the master and the unreachable sentinel, got %+v", step)
+	}
+	if master.setCount() != 1 {
+		t.Fatal("the test key should be written to the master")
+	}
+
+	probe = NewRedisProbe(RedisConfig{Addrs: []string{sentinel.addr()}, SentinelMasterName: "unknown"})
+	defer probe.Close()
+	if result := probe.Check(context.Background()); result.Passed() || result.Steps[0].Category != ErrorCategoryNotFound {
+		t.Fatalf("an unknown master should not be found, got %+v", result.Steps)
+	}
+}
+
+func TestRedisProbeClusterTopology(t *testing.T) {
+	first := startFakeRedis(t, nil)
+	second := startFakeRedis(t, nil)
+	slots := []fakeRedisSlot{{0, 8191, first.addr()}, {8192, 16383, second.addr()}}
+	first.clusterSlots = slots
+	second.clusterSlots = slots
+
+	probe := NewRedisProbe(RedisConfig{Addrs: []string{first.addr(), second.addr()}, Cluster: true})
+	defer probe.Close()
+	result := probe.Check(context.Background())
+	if !result.Passed() {
+		t.Fatalf("redis probe failed: %v", result.Err())
+	}
+	if result.Steps[0].Name != "topology" || result.Steps[0].Message != "2 masters serving 2 slot ranges" {
+		t.Fatalf("unexpected topology step %+v", result.Steps[0])
+	}
+	if first.setCount() != 1 || second.setCount() != 1 {
+		t.Fatalf("a test key should be written to each shard, got %d and %d", first.setCount(), second.setCount())
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := listener.Addr().String()
+	listener.Close()
+	first.mu.Lock()
+	first.clusterSlots = []fakeRedisSlot{{0, 8191, first.addr()}, {8192, 16383, down}}
+	first.mu.Unlock()
+
+	probe = NewRedisProbe(RedisConfig{Addr: first.addr(), Cluster: true})
+	defer probe.Close()
+	result = probe.Check(context.Background())
+	if result.Passed() || result.Steps[0].Category != ErrorCategoryTCP || !strings.Contains(result.Steps[0].Error, down) {
+		t.Fatalf("the unreachable master should fail the topology step, got %+v", result.Steps)
+	}
+}
+
+func TestRedisProbeTLS(t *testing.T) {
+	// borrow the certificate of an httptest server, valid for 127.0.0.1
+	httpServer := httptest.NewTLSServer(http.NotFoundHandler())
+	tlsConfig := httpServer.TLS.Clone()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: httpServer.Certificate().Raw}), 0600)
+	httpServer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := startFakeRedis(t, tlsConfig)
+
+	probe := NewRedisProbe(RedisConfig{Addr: server.addr(), TLS: true, TLSCAFile: caFile})
+	defer probe.Close()
+	if result := probe.Check(context.Background()); !result.Passed() {
+		t.Fatalf("redis probe failed: %v", result.Err())
+	}
+
+	probe = NewRedisProbe(RedisConfig{Addr: server.addr(), TLS: true})
+	defer probe.Close()
+	if result := probe.Check(context.Background()); result.Passed() || result.Steps[0].Category != ErrorCategoryTLS {
+		t.Fatalf("the untrusted certificate should fail with a tls error, got %+v", result.Steps)
+	}
+}
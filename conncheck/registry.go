@@ -1,96 +1,604 @@
 package conncheck
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/bentoml/yatai-common/config"
+	"github.com/bentoml/yatai-common/consts"
+	"github.com/bentoml/yatai-common/imageref"
+)
+
+const (
+	registryManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	registryConfigMediaType   = "application/vnd.oci.image.config.v1+json"
 )
 
 type RegistryConfig struct {
 	Endpoint string
 	Username string
 	Password string
+	// Repository is the repository the push, pull and delete steps run
+	// against with a unique conncheck tag, they are skipped when empty
+	Repository string
+
+	// CAFile is a PEM bundle of the CAs trusted in addition to the system ones
+	CAFile string
+	// CABundle is like CAFile, with the PEM bundle inline
+	CABundle string
+	// InsecureSkipVerify accepts any certificate, for the self-signed
+	// registries
+	InsecureSkipVerify bool
+	// HTTPFallback retries over plain http when /v2/ fails over https, like
+	// docker does for the insecure registries
+	HTTPFallback bool
 }
 
 type RegistryProbe struct {
+	name   string
 	config RegistryConfig
 	client *http.Client
+	err    error
+
+	mu sync.Mutex
+	// bearer is set once the registry challenged for a bearer token, the
+	// tokens are cached by scope
+	bearer bool
+	tokens map[string]string
 }
 
 func NewRegistryProbe(cfg RegistryConfig) *RegistryProbe {
-	return &RegistryProbe{
+	p := &RegistryProbe{
+		name:   "registry",
 		config: cfg,
 		client: &http.Client{},
+		tokens: make(map[string]string),
 	}
+	if cfg.CAFile != "" || cfg.CABundle != "" || cfg.InsecureSkipVerify {
+		tlsConfig, err := newTLSConfig(cfg.CAFile, "", cfg.InsecureSkipVerify)
+		if err == nil && cfg.CABundle != "" {
+			if tlsConfig.RootCAs == nil {
+				tlsConfig.RootCAs, _ = x509.SystemCertPool()
+			}
+			if tlsConfig.RootCAs == nil {
+				tlsConfig.RootCAs = x509.NewCertPool()
+			}
+			if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(cfg.CABundle)) {
+				err = errors.New("no certificate found in the CA bundle")
+			}
+		}
+		if err != nil {
+			// reported by Check
+			p.err = err
+		} else {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			p.client.Transport = transport
+		}
+	}
+	return p
 }
 
-func (p *RegistryProbe) Test(ctx context.Context) error {
-	if err := p.checkV2(ctx); err != nil {
-		logrus.Error("registry v2 check failed: ", err)
-		return fmt.Errorf("registry v2 check failed: %w", err)
+// NewRegistryProbesFromConfig returns a probe of the server of the registry,
+// and one of its in-cluster server when it has a different one. The servers
+// are probed over https unless they are configured with a scheme, an insecure
+// registry with skip-verify and a fallback to plain http. caFile is a PEM
+// bundle of the CAs trusted in addition to the system ones and the CA bundle
+// of the registry, for the registries with a certificate signed by a private
+// CA. The image is pushed to the bento repository itself, registries such as
+// docker hub and ECR do not allow creating a nested scratch repository.
+func NewRegistryProbesFromConfig(conf *config.DockerRegistryConfig, caFile string) []*RegistryProbe {
+	repository := conf.BentoRepositoryName
+	if repository == "" {
+		repository = consts.DefaultDockerRegistryBentoRepositoryName
 	}
-	logrus.Info("registry v2 check passed")
 
-	if err := p.checkCatalog(ctx); err != nil {
-		logrus.Error("registry catalog check failed: ", err)
-		return fmt.Errorf("registry catalog check failed: %w", err)
+	servers := []struct {
+		name   string
+		server string
+	}{{"registry", conf.Server}}
+	if conf.InClusterServer != "" && conf.InClusterServer != conf.Server {
+		servers = append(servers, struct {
+			name   string
+			server string
+		}{"registry-in-cluster", conf.InClusterServer})
 	}
-	logrus.Info("registry catalog check passed")
 
-	return nil
+	probes := make([]*RegistryProbe, 0, len(servers))
+	for _, server := range servers {
+		probe := NewRegistryProbe(RegistryConfig{
+			Endpoint:           registryEndpoint(server.server),
+			Username:           conf.Username,
+			Password:           conf.Password,
+			Repository:         repository,
+			CAFile:             caFile,
+			CABundle:           conf.CABundle,
+			InsecureSkipVerify: !conf.Secure || conf.InsecureSkipVerify,
+			HTTPFallback:       !conf.Secure && !strings.Contains(server.server, "://"),
+		})
+		probe.name = server.name
+		probes = append(probes, probe)
+	}
+	return probes
+}
+
+// registryEndpoint is the base URL of the API of a registry server, https
+// unless the server is configured with a scheme.
+func registryEndpoint(server string) string {
+	server = strings.TrimSuffix(server, "/")
+	scheme := "https://"
+	if i := strings.Index(server, "://"); i >= 0 {
+		scheme, server = server[:i+3], server[i+3:]
+	}
+	// the API of docker hub is not served on the host of its image references
+	if server == imageref.DefaultRegistry || server == "index.docker.io" {
+		server = "registry-1.docker.io"
+	}
+	return scheme + server
+}
+
+func (p *RegistryProbe) Name() string {
+	return p.name
+}
+
+func (p *RegistryProbe) Test(ctx context.Context) error {
+	result := p.Check(ctx)
+	result.log()
+	return result.Err()
 }
 
-func (p *RegistryProbe) checkV2(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v2/", p.config.Endpoint), nil)
+// Check checks the /v2/ endpoint and the catalog, then pushes a tiny image
+// with a unique tag to the repository, pulls it and deletes it by digest,
+// reporting the pull, push and delete permissions as separate steps.
+func (p *RegistryProbe) Check(ctx context.Context) *Result {
+	result := newResult(p.Name(), p.config.Endpoint)
+
+	if p.err != nil {
+		result.add("config", 0, withCategory(ErrorCategoryTLS, "check the CA bundle of the registry", p.err))
+		return result
+	}
+
+	// the endpoint is per check, it may fall back to http
+	var endpoint string
+	err := result.runWithMessage("v2", func() (message string, err error) {
+		endpoint, message, err = p.checkV2(ctx)
+		if err != nil {
+			return "", fmt.Errorf("registry v2 check failed: %w", err)
+		}
+		return message, nil
+	})
 	if err != nil {
-		return fmt.Errorf("create request failed: %w", err)
+		return result
 	}
+	result.Target = endpoint
 
-	if p.config.Username != "" {
-		req.SetBasicAuth(p.config.Username, p.config.Password)
+	start := time.Now()
+	disabled, err := p.checkCatalog(ctx, endpoint)
+	if disabled {
+		result.skip("catalog", "the catalog is disabled or not allowed, yatai does not need it")
+	} else {
+		if err != nil {
+			err = fmt.Errorf("registry catalog check failed: %w", err)
+		}
+		result.add("catalog", time.Since(start), err)
 	}
 
-	resp, err := p.client.Do(req)
+	if p.config.Repository == "" {
+		for _, name := range []string{"push", "pull", "delete"} {
+			result.skip(name, "no repository is configured to check the permissions on")
+		}
+		return result
+	}
+
+	var image *registryImage
+	err = result.runWithMessage("push", func() (message string, err error) {
+		image, err = p.push(ctx, endpoint)
+		if err != nil {
+			return "", fmt.Errorf("registry push check failed: %w", err)
+		}
+		return fmt.Sprintf("pushed %s:%s", p.config.Repository, image.tag), nil
+	})
+	pushed := err == nil
+
+	_ = result.runWithMessage("pull", func() (string, error) {
+		if !pushed {
+			if err := p.listTags(ctx, endpoint); err != nil {
+				return "", fmt.Errorf("registry pull check failed: %w", err)
+			}
+			return "nothing was pushed, pull was checked by listing the tags", nil
+		}
+		if err := p.pull(ctx, endpoint, image); err != nil {
+			return "", fmt.Errorf("registry pull check failed: %w", err)
+		}
+		return "", nil
+	})
+
+	if !pushed {
+		result.skip("delete", "nothing was pushed to delete")
+		return result
+	}
+	_ = result.runWithMessage("delete", func() (string, error) {
+		if err := p.delete(ctx, endpoint, image); err != nil {
+			return "", fmt.Errorf("registry delete check failed: %w", err)
+		}
+		return "the test blob is left to the garbage collection of the registry", nil
+	})
+
+	return result
+}
+
+// checkV2 returns the endpoint which answered, the configured one or its
+// plain http fallback.
+func (p *RegistryProbe) checkV2(ctx context.Context) (endpoint, message string, err error) {
+	endpoint = p.config.Endpoint
+	resp, err := p.do(ctx, endpoint, "", http.MethodGet, "/v2/", nil, nil)
+	if err != nil && p.config.HTTPFallback && strings.HasPrefix(endpoint, "https://") {
+		httpsErr := err
+		endpoint = "http://" + strings.TrimPrefix(endpoint, "https://")
+		resp, err = p.do(ctx, endpoint, "", http.MethodGet, "/v2/", nil, nil)
+		if err != nil {
+			err = fmt.Errorf("%w, falling back to http: %v", httpsErr, err)
+			return
+		}
+		defer func() {
+			if err == nil {
+				message += " over plain http"
+			}
+		}()
+	}
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusUnauthorized {
-		return fmt.Errorf("unauthorized: invalid credentials")
+		err = withCategory(ErrorCategoryAuth, "check DOCKER_REGISTRY_USERNAME and DOCKER_REGISTRY_PASSWORD", fmt.Errorf("unauthorized: invalid credentials"))
+		return
 	}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	if resp.StatusCode != http.StatusOK {
+		err = registryStatusError(resp, false)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.bearer:
+		message = "bearer token auth"
+	case p.config.Username != "":
+		message = "basic auth"
+	default:
+		message = "anonymous"
+	}
+	return
+}
+
+// checkCatalog tells whether the catalog is disabled, which many registries do.
+func (p *RegistryProbe) checkCatalog(ctx context.Context, endpoint string) (disabled bool, err error) {
+	resp, err := p.do(ctx, endpoint, "registry:catalog:*", http.MethodGet, "/v2/_catalog", nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		disabled = true
+		return
+	}
+	err = registryStatusError(resp, false)
+	return
+}
+
+// registryImage is the image the push step uploads, an empty config and no
+// layer.
+type registryImage struct {
+	tag            string
+	config         []byte
+	configDigest   string
+	manifest       []byte
+	manifestDigest string
+}
+
+func newRegistryImage() (*registryImage, error) {
+	image := &registryImage{
+		tag:    fmt.Sprintf("conncheck-%d", time.Now().UnixNano()),
+		config: []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`),
 	}
+	image.configDigest = registryDigest(image.config)
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     registryManifestMediaType,
+		"config": map[string]interface{}{
+			"mediaType": registryConfigMediaType,
+			"digest":    image.configDigest,
+			"size":      len(image.config),
+		},
+		"layers": []interface{}{},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the test manifest: %w", err)
+	}
+	image.manifest = manifest
+	image.manifestDigest = registryDigest(manifest)
+	return image, nil
+}
+
+func registryDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// push uploads the config blob, then the manifest.
+func (p *RegistryProbe) push(ctx context.Context, endpoint string) (*registryImage, error) {
+	image, err := newRegistryImage()
+	if err != nil {
+		return nil, err
+	}
+	repository := p.config.Repository
+	scope := fmt.Sprintf("repository:%s:pull,push", repository)
 
+	resp, err := p.do(ctx, endpoint, scope, http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", repository), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, fmt.Errorf("failed to start the blob upload: %w", registryStatusError(resp, true))
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob upload location %q: %w", resp.Header.Get("Location"), err)
+	}
+	query := location.Query()
+	query.Set("digest", image.configDigest)
+	location.RawQuery = query.Encode()
+
+	resp, err = p.do(ctx, endpoint, scope, http.MethodPut, location.String(), http.Header{"Content-Type": {"application/octet-stream"}}, image.config)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("failed to upload the blob: %w", registryStatusError(resp, true))
+	}
+
+	resp, err = p.do(ctx, endpoint, scope, http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", repository, image.tag), http.Header{"Content-Type": {registryManifestMediaType}}, image.manifest)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("failed to push the manifest: %w", registryStatusError(resp, true))
+	}
+	return image, nil
+}
+
+// pull reads back the manifest and the blob pushed, the blob may be
+// redirected to the storage of the registry.
+func (p *RegistryProbe) pull(ctx context.Context, endpoint string, image *registryImage) error {
+	scope := fmt.Sprintf("repository:%s:pull", p.config.Repository)
+	for _, object := range []struct {
+		path   string
+		digest string
+	}{
+		{fmt.Sprintf("/v2/%s/manifests/%s", p.config.Repository, image.tag), image.manifestDigest},
+		{fmt.Sprintf("/v2/%s/blobs/%s", p.config.Repository, image.configDigest), image.configDigest},
+	} {
+		resp, err := p.do(ctx, endpoint, scope, http.MethodGet, object.path, http.Header{"Accept": {registryManifestMediaType}}, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = registryStatusError(resp, true)
+			resp.Body.Close()
+			return fmt.Errorf("failed to get %s: %w", object.path, err)
+		}
+		content, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", object.path, err)
+		}
+		if digest := registryDigest(content); digest != object.digest {
+			return withCategory(ErrorCategoryDataMismatch, "", fmt.Errorf("digest mismatch of %s: got %s, want %s", object.path, digest, object.digest))
+		}
+	}
 	return nil
 }
 
-func (p *RegistryProbe) checkCatalog(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v2/_catalog", p.config.Endpoint), nil)
+// listTags checks the pull permission when nothing could be pushed, a missing
+// repository reads as allowed.
+func (p *RegistryProbe) listTags(ctx context.Context, endpoint string) error {
+	resp, err := p.do(ctx, endpoint, fmt.Sprintf("repository:%s:pull", p.config.Repository), http.MethodGet, fmt.Sprintf("/v2/%s/tags/list", p.config.Repository), nil, nil)
 	if err != nil {
-		return fmt.Errorf("create request failed: %w", err)
+		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return registryStatusError(resp, true)
+	}
+	return nil
+}
 
-	if p.config.Username != "" {
+func (p *RegistryProbe) delete(ctx context.Context, endpoint string, image *registryImage) error {
+	resp, err := p.do(ctx, endpoint, fmt.Sprintf("repository:%s:delete", p.config.Repository), http.MethodDelete, fmt.Sprintf("/v2/%s/manifests/%s", p.config.Repository, image.manifestDigest), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return withCategory(ErrorCategoryPermission, "deletion is disabled on the registry, enable it to let yatai clean up images, with REGISTRY_STORAGE_DELETE_ENABLED for the distribution registry", fmt.Errorf("failed to delete the manifest: %w", registryStatusError(resp, true)))
+	}
+	return fmt.Errorf("failed to delete the manifest: %w", registryStatusError(resp, true))
+}
+
+// do sends a request to the registry at endpoint, answering its challenge for
+// a bearer token of scope or for basic auth.
+func (p *RegistryProbe) do(ctx context.Context, endpoint, scope, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	target := path
+	if strings.HasPrefix(path, "/") {
+		target = endpoint + path
+	}
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("create request failed: %w", err)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		p.authorize(req, scope)
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	if err = p.fetchToken(ctx, challenge, scope); err != nil {
+		return nil, err
+	}
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err = p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	return resp, nil
+}
+
+func (p *RegistryProbe) authorize(req *http.Request, scope string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if token, ok := p.tokens[scope]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
+	}
+	if !p.bearer && p.config.Username != "" {
 		req.SetBasicAuth(p.config.Username, p.config.Password)
 	}
+}
+
+var registryChallengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken gets a token of scope from the realm of a bearer challenge, with
+// the credentials when set, anonymously otherwise.
+func (p *RegistryProbe) fetchToken(ctx context.Context, challenge, scope string) error {
+	params := make(map[string]string)
+	for _, match := range registryChallengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid bearer challenge %q", challenge)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	// the token is cached under the requested scope, which authorize looks
+	// it up by, even when the challenge names the scope
+	tokenScope := scope
+	if tokenScope == "" {
+		tokenScope = params["scope"]
+	}
+	if tokenScope != "" {
+		query.Set("scope", tokenScope)
+	}
+	realm.RawQuery = query.Encode()
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return fmt.Errorf("create token request failed: %w", err)
+	}
+	if p.config.Username != "" {
+		req.SetBasicAuth(p.config.Username, p.config.Password)
+	}
 	resp, err := p.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return fmt.Errorf("token request to %s failed: %w", realm.Host, err)
 	}
 	defer resp.Body.Close()
-
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return withCategory(ErrorCategoryAuth, "check DOCKER_REGISTRY_USERNAME and DOCKER_REGISTRY_PASSWORD", fmt.Errorf("the token server %s rejected the credentials: status %d", realm.Host, resp.StatusCode))
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("token request to %s failed: status %d, body: %s", realm.Host, resp.StatusCode, string(body))
 	}
 
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to decode the token response of %s: %w", realm.Host, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("the token server %s returned no token", realm.Host)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bearer = true
+	p.tokens[scope] = token.Token
 	return nil
 }
+
+// registryStatusError categorizes an unexpected response, the authentication
+// having succeeded on /v2/ an unauthorized response to a repository request is
+// a missing permission.
+func registryStatusError(resp *http.Response, repository bool) error {
+	body, _ := io.ReadAll(resp.Body)
+	err := fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	if repository && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		return withCategory(ErrorCategoryPermission, "the registry user lacks the permission on the repository, grant it", err)
+	}
+	return categorizeHTTPStatus(resp.StatusCode, err)
+}
+
+func categorizeHTTPStatus(statusCode int, err error) error {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return withCategory(ErrorCategoryAuth, "", err)
+	case http.StatusForbidden:
+		return withCategory(ErrorCategoryPermission, "", err)
+	case http.StatusNotFound:
+		return withCategory(ErrorCategoryNotFound, "", err)
+	}
+	return err
+}
@@ -0,0 +1,339 @@
+package conncheck
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bentoml/yatai-common/config"
+)
+
+// fakeRegistry is a registry delegating its auth to a token server, like
+// Docker Hub and Harbor do. The token server grants the actions of the
+// scopes allowed to the user, the token is the scope granted.
+type fakeRegistry struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// allowed are the actions granted on the repositories
+	allowed       map[string]bool
+	deleteEnabled bool
+	blobs         map[string][]byte
+	manifests     map[string][]byte
+	uploads       int
+	// v2Scope is the scope of the challenge to the /v2/ requests
+	v2Scope string
+	// tokenRequests counts the requests to the token server
+	tokenRequests int
+}
+
+func startFakeRegistry(t *testing.T, secure bool) *fakeRegistry {
+	t.Helper()
+	f := &fakeRegistry{
+		allowed:       map[string]bool{"pull": true, "push": true, "delete": true},
+		deleteEnabled: true,
+		blobs:         make(map[string][]byte),
+		manifests:     make(map[string][]byte),
+	}
+	if secure {
+		f.server = httptest.NewTLSServer(http.HandlerFunc(f.handle))
+	} else {
+		f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	}
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeRegistry) challenge(w http.ResponseWriter, scope string) {
+	challenge := fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry"`, f.server.URL)
+	if scope != "" {
+		challenge += fmt.Sprintf(`,scope="%s"`, scope)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (f *fakeRegistry) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		f.tokenRequests++
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "yatai" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		granted := ""
+		if scope := r.URL.Query().Get("scope"); scope != "" {
+			parts := strings.Split(scope, ":")
+			actions := make([]string, 0)
+			for _, action := range strings.Split(parts[2], ",") {
+				if f.allowed[action] {
+					actions = append(actions, action)
+				}
+			}
+			granted = parts[0] + ":" + parts[1] + ":" + strings.Join(actions, ",")
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "token=" + granted})
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer token=")
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		scope := ""
+		if r.URL.Path == "/v2/" {
+			scope = f.v2Scope
+		}
+		f.challenge(w, scope)
+		return
+	}
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	if r.URL.Path == "/v2/_catalog" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// the repository is followed by the kind and the reference, e.g.
+	// yatai-bentos/manifests/<digest>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/"), "/")
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	repository := strings.Join(parts[:len(parts)-2], "/")
+	kind, reference := parts[len(parts)-2], parts[len(parts)-1]
+	if kind == "uploads" {
+		repository = strings.Join(parts[:len(parts)-3], "/")
+		kind = parts[len(parts)-3]
+	}
+	action := "pull"
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		action = "push"
+	case http.MethodDelete:
+		action = "delete"
+	}
+	scope := "repository:" + repository + ":" + action
+	if !strings.HasPrefix(token, "repository:"+repository+":") || !strings.Contains(token, action) {
+		f.challenge(w, scope)
+		return
+	}
+
+	switch {
+	case kind == "blobs" && r.Method == http.MethodPost:
+		f.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repository, f.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "blobs" && r.Method == http.MethodPut:
+		content, _ := io.ReadAll(r.Body)
+		f.blobs[r.URL.Query().Get("digest")] = content
+		w.WriteHeader(http.StatusCreated)
+	case kind == "blobs" && r.Method == http.MethodGet:
+		content, ok := f.blobs[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(content)
+	case kind == "manifests" && r.Method == http.MethodPut:
+		content, _ := io.ReadAll(r.Body)
+		f.manifests[reference] = content
+		f.manifests[registryDigest(content)] = content
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests" && r.Method == http.MethodGet:
+		content, ok := f.manifests[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(content)
+	case kind == "manifests" && r.Method == http.MethodDelete:
+		if !f.deleteEnabled {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		delete(f.manifests, reference)
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "tags":
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func stepsByName(result *Result) map[string]Step {
+	steps := make(map[string]Step, len(result.Steps))
+	for _, step := range result.Steps {
+		steps[step.Name] = step
+	}
+	return steps
+}
+
+func TestRegistryProbeBearerToken(t *testing.T) {
+	registry := startFakeRegistry(t, false)
+
+	result := NewRegistryProbe(RegistryConfig{
+		Endpoint:   registry.server.URL,
+		Username:   "yatai",
+		Password:   "secret",
+		Repository: "yatai-bentos",
+	}).Check(context.Background())
+	if !result.Passed() {
+		t.Fatalf("registry probe failed: %+v", result.Steps)
+	}
+	steps := stepsByName(result)
+	if steps["v2"].Message != "bearer token auth" {
+		t.Errorf("the v2 step should report the bearer token auth, got %q", steps["v2"].Message)
+	}
+	if steps["catalog"].Status != StepSkipped {
+		t.Errorf("the disabled catalog should be skipped, got %+v", steps["catalog"])
+	}
+	for _, name := range []string{"push", "pull", "delete"} {
+		if steps[name].Status != StepPassed {
+			t.Errorf("the %s step should pass, got %+v", name, steps[name])
+		}
+	}
+	if len(registry.manifests) != 1 {
+		t.Errorf("the manifest should be deleted by digest, leaving the tag only in the fake, got %d manifests", len(registry.manifests))
+	}
+
+	result = NewRegistryProbe(RegistryConfig{Endpoint: registry.server.URL, Username: "yatai", Password: "wrong"}).Check(context.Background())
+	if result.Passed() || result.Steps[0].Category != ErrorCategoryAuth {
+		t.Fatalf("the wrong password should fail the v2 step with an auth error, got %+v", result.Steps)
+	}
+}
+
+func TestRegistryProbeCachesTokens(t *testing.T) {
+	registry := startFakeRegistry(t, false)
+	registry.v2Scope = "registry:catalog:*"
+
+	probe := NewRegistryProbe(RegistryConfig{Endpoint: registry.server.URL, Username: "yatai", Password: "secret"})
+	for i := 0; i < 2; i++ {
+		if _, _, err := probe.checkV2(context.Background()); err != nil {
+			t.Fatalf("v2 check %d failed: %v", i, err)
+		}
+	}
+	if registry.tokenRequests != 1 {
+		t.Errorf("the token of the challenge scope should be fetched once, got %d token requests", registry.tokenRequests)
+	}
+}
+
+func TestRegistryProbePermissions(t *testing.T) {
+	registry := startFakeRegistry(t, false)
+	registry.allowed["push"] = false
+	probe := NewRegistryProbe(RegistryConfig{
+		Endpoint:   registry.server.URL,
+		Username:   "yatai",
+		Password:   "secret",
+		Repository: "yatai-bentos",
+	})
+
+	steps := stepsByName(probe.Check(context.Background()))
+	if steps["push"].Status != StepFailed || steps["push"].Category != ErrorCategoryPermission {
+		t.Errorf("the push step should fail with a permission error, got %+v", steps["push"])
+	}
+	if steps["pull"].Status != StepPassed {
+		t.Errorf("the pull step should pass by listing the tags, got %+v", steps["pull"])
+	}
+	if steps["delete"].Status != StepSkipped {
+		t.Errorf("the delete step should be skipped, got %+v", steps["delete"])
+	}
+
+	registry.allowed["push"] = true
+	registry.deleteEnabled = false
+	steps = stepsByName(probe.Check(context.Background()))
+	if steps["push"].Status != StepPassed || steps["pull"].Status != StepPassed {
+		t.Fatalf("the push and pull steps should pass, got %+v", steps)
+	}
+	if steps["delete"].Status != StepFailed || steps["delete"].Category != ErrorCategoryPermission || !strings.Contains(steps["delete"].Hint, "deletion is disabled") {
+		t.Errorf("the delete step should fail as disabled, got %+v", steps["delete"])
+	}
+}
+
+func TestNewRegistryProbesFromConfig(t *testing.T) {
+	probes := NewRegistryProbesFromConfig(&config.DockerRegistryConfig{
+		Server:          "docker.io",
+		InClusterServer: "http://docker-registry.yatai-system.svc.cluster.local:5000/",
+		Secure:          true,
+	}, "")
+	if len(probes) != 2 {
+		t.Fatalf("expected a probe of each server, got %d", len(probes))
+	}
+	if probes[0].Name() != "registry" || probes[0].config.Endpoint != "https://registry-1.docker.io" {
+		t.Errorf("unexpected probe of the server %s %s", probes[0].Name(), probes[0].config.Endpoint)
+	}
+	if probes[1].Name() != "registry-in-cluster" || probes[1].config.Endpoint != "http://docker-registry.yatai-system.svc.cluster.local:5000" {
+		t.Errorf("unexpected probe of the in-cluster server %s %s", probes[1].Name(), probes[1].config.Endpoint)
+	}
+	if probes[0].config.Repository != "yatai-bentos" {
+		t.Errorf("the image should be pushed to the default bento repository, got %s", probes[0].config.Repository)
+	}
+}
+
+func TestRegistryProbeTLS(t *testing.T) {
+	registry := startFakeRegistry(t, true)
+	server := strings.TrimPrefix(registry.server.URL, "https://")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.server.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.DockerRegistryConfig{Server: server, Username: "yatai", Password: "secret", Secure: true}
+
+	result := NewRegistryProbesFromConfig(conf, caFile)[0].Check(context.Background())
+	if !result.Passed() {
+		t.Fatalf("the certificate signed by the CA bundle should be trusted, got %+v", result.Steps)
+	}
+
+	result = NewRegistryProbesFromConfig(conf, "")[0].Check(context.Background())
+	if result.Passed() || result.Steps[0].Category != ErrorCategoryTLS {
+		t.Fatalf("the self-signed certificate should fail with a tls error, got %+v", result.Steps)
+	}
+
+	conf.CABundle = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.server.Certificate().Raw}))
+	result = NewRegistryProbesFromConfig(conf, "")[0].Check(context.Background())
+	if !result.Passed() {
+		t.Fatalf("the certificate signed by the CA bundle of the registry should be trusted, got %+v", result.Steps)
+	}
+	conf.CABundle = ""
+
+	conf.Secure = false
+	result = NewRegistryProbesFromConfig(conf, "")[0].Check(context.Background())
+	if !result.Passed() || result.Target != registry.server.URL {
+		t.Fatalf("the insecure registry should skip the verification, got %s %+v", result.Target, result.Steps)
+	}
+}
+
+func TestRegistryProbeHTTPFallback(t *testing.T) {
+	registry := startFakeRegistry(t, false)
+	server := strings.TrimPrefix(registry.server.URL, "http://")
+
+	probe := NewRegistryProbesFromConfig(&config.DockerRegistryConfig{Server: server, Username: "yatai", Password: "secret"}, "")[0]
+	result := probe.Check(context.Background())
+	if !result.Passed() {
+		t.Fatalf("the insecure registry should fall back to http, got %+v", result.Steps)
+	}
+	if probe.config.Endpoint != "https://"+server {
+		t.Errorf("the fallback should not change the configured endpoint, got %s", probe.config.Endpoint)
+	}
+	if result.Target != registry.server.URL || result.Steps[0].Message != "bearer token auth over plain http" {
+		t.Fatalf("the fallback should be reported, got %s %+v", result.Target, result.Steps[0])
+	}
+
+	result = NewRegistryProbesFromConfig(&config.DockerRegistryConfig{Server: server, Secure: true}, "")[0].Check(context.Background())
+	if result.Passed() {
+		t.Fatal("the secure registry should not fall back to http")
+	}
+}
@@ -0,0 +1,160 @@
+package conncheck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const DefaultProbeTimeout = 30 * time.Second
+
+// Runner runs probes concurrently, each under its own deadline.
+type Runner struct {
+	probes  []Probe
+	timeout time.Duration
+
+	// checks are the Check calls which have not returned yet
+	checks sync.WaitGroup
+}
+
+// NewRunner returns a runner giving each probe timeout to finish,
+// DefaultProbeTimeout when zero.
+func NewRunner(timeout time.Duration, probes ...Probe) *Runner {
+	if timeout == 0 {
+		timeout = DefaultProbeTimeout
+	}
+	return &Runner{probes: probes, timeout: timeout}
+}
+
+// Report aggregates the results of the probes, in the order they were given
+// to the runner.
+type Report struct {
+	Passed    bool          `json:"passed"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Results   []*Result     `json:"results"`
+}
+
+func (r *Runner) Run(ctx context.Context) *Report {
+	report := &Report{
+		StartedAt: time.Now().UTC(),
+		Results:   make([]*Result, len(r.probes)),
+	}
+
+	var wg sync.WaitGroup
+	for i, probe := range r.probes {
+		wg.Add(1)
+		go func(i int, probe Probe) {
+			defer wg.Done()
+			report.Results[i] = r.runProbe(ctx, probe)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	report.Duration = time.Since(report.StartedAt)
+	report.Passed = true
+	for _, result := range report.Results {
+		if !result.Passed() {
+			report.Passed = false
+		}
+	}
+	return report
+}
+
+// Wait blocks until the checks left running past their deadline return, the
+// probes may only be closed then. It returns the error of ctx when it is done
+// first.
+func (r *Runner) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.checks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runProbe returns a failed result when the probe does not return by its
+// deadline, a probe ignoring its context is left running until Wait.
+func (r *Runner) runProbe(ctx context.Context, probe Probe) *Result {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	done := make(chan *Result, 1)
+	start := time.Now()
+	r.checks.Add(1)
+	go func() {
+		defer r.checks.Done()
+		done <- probe.Check(ctx)
+	}()
+
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+		result := newResult(probe.Name(), "")
+		result.add("deadline", time.Since(start), fmt.Errorf("probe did not finish within %s: %w", r.timeout, ctx.Err()))
+		return result
+	}
+}
+
+// ExitCode is 0 when every probe passed, 1 otherwise.
+func (r *Report) ExitCode() int {
+	if r.Passed {
+		return 0
+	}
+	return 1
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteText writes a line per step, with the error and the hint of the
+// failed ones.
+func (r *Report) WriteText(w io.Writer) (err error) {
+	for _, result := range r.Results {
+		status := StepPassed
+		if !result.Passed() {
+			status = StepFailed
+		}
+		_, err = fmt.Fprintf(w, "%s %s: %s\n", result.Probe, result.Target, status)
+		if err != nil {
+			return
+		}
+		for _, step := range result.Steps {
+			_, err = fmt.Fprintf(w, "  %-12s %-8s %s\n", step.Name, step.Status, step.Duration.Round(time.Millisecond))
+			if err != nil {
+				return
+			}
+			if step.Message != "" {
+				_, err = fmt.Fprintf(w, "    %s\n", step.Message)
+			}
+			if err == nil && step.Status == StepFailed {
+				_, err = fmt.Fprintf(w, "    error (%s): %s\n", step.Category, step.Error)
+			}
+			if err == nil && step.Hint != "" {
+				_, err = fmt.Fprintf(w, "    hint: %s\n", step.Hint)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	status := "all probes passed"
+	if !r.Passed {
+		status = "some probes failed"
+	}
+	_, err = fmt.Fprintf(w, "%s in %s\n", status, r.Duration.Round(time.Millisecond))
+	return
+}
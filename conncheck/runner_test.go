@@ -0,0 +1,162 @@
+package conncheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/bentoml/yatai-common/config"
+	"github.com/bentoml/yatai-common/consts"
+)
+
+type funcProbe struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func (p *funcProbe) Name() string {
+	return p.name
+}
+
+func (p *funcProbe) Check(ctx context.Context) *Result {
+	result := newResult(p.name, "test")
+	_ = result.run("check", func() error {
+		return p.check(ctx)
+	})
+	return result
+}
+
+func TestRunner(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	report := NewRunner(100*time.Millisecond,
+		&funcProbe{name: "ok", check: func(ctx context.Context) error { return nil }},
+		&funcProbe{name: "denied", check: func(ctx context.Context) error {
+			return withCategory(ErrorCategoryPermission, "", errors.New("access denied"))
+		}},
+		// ignores its context
+		&funcProbe{name: "stuck", check: func(ctx context.Context) error {
+			<-block
+			return nil
+		}},
+	).Run(context.Background())
+
+	if report.Passed || report.ExitCode() != 1 {
+		t.Fatal("the report should fail")
+	}
+	if len(report.Results) != 3 || report.Results[0].Probe != "ok" || report.Results[1].Probe != "denied" || report.Results[2].Probe != "stuck" {
+		t.Fatalf("the results should be in the order of the probes, got %+v", report.Results)
+	}
+	if !report.Results[0].Passed() {
+		t.Fatal("the ok probe should pass")
+	}
+	if step := report.Results[2].Steps[0]; step.Name != "deadline" || step.Category != ErrorCategoryTCP {
+		t.Fatalf("the stuck probe should fail its deadline, got %+v", step)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Report{}
+	if err := json.Unmarshal(buf.Bytes(), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Passed || decoded.Results[1].Steps[0].Category != ErrorCategoryPermission {
+		t.Fatalf("unexpected json report %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := report.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "hint: "+remediationHints[ErrorCategoryPermission]) {
+		t.Fatalf("the text report should hint at the failures, got\n%s", buf.String())
+	}
+}
+
+func TestProbesFromConfigReportsMissingConfig(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("S3_ENDPOINT", "")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+	t.Setenv("AWS_ECR_WITH_IAM_ROLE", "")
+
+	secretGetter := func(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+		return &corev1.Secret{}, nil
+	}
+	probes := ProbesFromConfig(context.Background(), secretGetter, ProbesOptions{})
+	if len(probes) != 2 {
+		t.Fatalf("expected the s3 and registry probes, got %d", len(probes))
+	}
+	for _, probe := range probes {
+		result := probe.Check(context.Background())
+		if result.Passed() || result.Steps[0].Name != "config" || result.Steps[0].Category != ErrorCategoryNotFound {
+			t.Fatalf("the %s probe should fail its config step, got %+v", probe.Name(), result.Steps)
+		}
+	}
+
+	notFound := func(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	probes = ProbesFromConfig(context.Background(), notFound, ProbesOptions{})
+	if result := probes[0].Check(context.Background()); result.Passed() {
+		t.Fatal("the s3 probe should fail without its shared env secret")
+	}
+}
+
+func TestProbesFromConfigReadsYataiConfigMap(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("YATAI_SYSTEM_NAMESPACE", "yatai-system")
+	t.Setenv("YATAI_ENDPOINT", "")
+	t.Setenv("YATAI_CLUSTER_NAME", "")
+	t.Setenv("YATAI_API_TOKEN", "token")
+
+	cliset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "yatai-system", Name: consts.KubeConfigMapNameYataiConfig},
+		Data: map[string]string{
+			consts.KubeConfigMapKeyYataiConfigEndpoint:    "https://yatai.example.com",
+			consts.KubeConfigMapKeyYataiConfigClusterName: "default",
+		},
+	})
+	probe := yataiProbeFromConfig(context.Background(), config.NewClientsetGetter(cliset).GetSecret, cliset, consts.YataiDeploymentComponentName)
+	yatai, ok := probe.(*YataiProbe)
+	if !ok {
+		t.Fatalf("the yatai probe should be built from the ConfigMap, got %+v", probe.Check(context.Background()).Steps)
+	}
+	if yatai.config.Endpoint != "https://yatai.example.com" || yatai.config.ClusterName != "default" {
+		t.Fatalf("unexpected yatai config %+v", yatai.config)
+	}
+}
+
+func TestRunnerWaitsForTheStuckChecks(t *testing.T) {
+	block := make(chan struct{})
+	runner := NewRunner(10*time.Millisecond, &funcProbe{name: "stuck", check: func(ctx context.Context) error {
+		<-block
+		return nil
+	}})
+	if report := runner.Run(context.Background()); report.Passed {
+		t.Fatal("the stuck probe should miss its deadline")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := runner.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the stuck check should still be running, got %v", err)
+	}
+
+	close(block)
+	if err := runner.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,78 +3,521 @@ package conncheck
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
-	"github.com/sirupsen/logrus"
 )
 
+// S3Stage is a check S3Probe.TestWithOptions can run.
+type S3Stage string
+
+const (
+	// S3StagePutGet writes, reads back and removes a small object
+	S3StagePutGet S3Stage = "put_get"
+	// S3StageHead checks the metadata of an object with a HEAD request
+	S3StageHead S3Stage = "head"
+	// S3StageList lists the objects under the test prefix
+	S3StageList S3Stage = "list"
+	// S3StageMultipart uploads an object over the part size threshold, like
+	// bento and model uploads do
+	S3StageMultipart S3Stage = "multipart"
+	// S3StagePresigned round-trips an object through presigned PUT and GET
+	// URLs with a plain HTTP client, like clients outside the cluster do
+	S3StagePresigned S3Stage = "presigned"
+	// S3StagePermissions finds out which of the S3Permissions are missing
+	S3StagePermissions S3Stage = "permissions"
+)
+
+// S3Stages are all the stages, in the order they are run.
+var S3Stages = []S3Stage{S3StagePutGet, S3StageHead, S3StageList, S3StageMultipart, S3StagePresigned, S3StagePermissions}
+
+// s3ReadStages are the stages which run in read only mode.
+var s3ReadStages = map[S3Stage]bool{
+	S3StageList:        true,
+	S3StagePermissions: true,
+}
+
+// ErrS3BucketMissing is returned instead of creating the bucket in least
+// privilege mode.
+var ErrS3BucketMissing = errors.New("bucket does not exist")
+
+// the smallest part size S3 accepts
+const defaultS3MultipartPartSize = 5 * 1024 * 1024
+
+type S3TestOptions struct {
+	BucketName string
+	// Prefix names the test objects, which are all written under it
+	Prefix string
+	// Stages to run, only S3StagePutGet when empty
+	Stages []S3Stage
+	// MultipartPartSize is the part size of the multipart stage, which
+	// uploads an object one byte larger. Defaults to 5MiB.
+	MultipartPartSize int64
+	// HTTPClient sends the presigned requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// LeastPrivilege never creates the bucket, a missing bucket fails with
+	// ErrS3BucketMissing. The only objects written are the test objects
+	// named after the prefix.
+	LeastPrivilege bool
+	// ReadOnly implies LeastPrivilege and skips the stages which write,
+	// the list stage then lists the prefix without writing to it.
+	ReadOnly bool
+}
+
 type S3Probe struct {
 	client *minio.Client
+	opts   S3TestOptions
 }
 
 func NewS3Probe(c *minio.Client) *S3Probe {
 	return &S3Probe{client: c}
 }
 
+// WithOptions sets the bucket, the prefix and the stages Check runs.
+func (p *S3Probe) WithOptions(opts S3TestOptions) *S3Probe {
+	p.opts = opts
+	return p
+}
+
+func (p *S3Probe) Name() string {
+	return "s3"
+}
+
 func (p *S3Probe) Test(ctx context.Context, prefix string, bucketName string) error {
-	objectName := fmt.Sprintf("%s-%d.txt", prefix, time.Now().UnixNano())
-	content := []byte("test content")
+	opts := p.opts
+	opts.Prefix = prefix
+	opts.BucketName = bucketName
+	result := (&S3Probe{client: p.client, opts: opts}).Check(ctx)
+	result.log()
+	return result.Err()
+}
 
-	logrus.Infof("Testing S3 connection to %s", p.client.EndpointURL())
-	exists, err := p.client.BucketExists(ctx, bucketName)
-	if err != nil {
-		logrus.Errorf("Failed to check bucket existence: %v", err)
-		return fmt.Errorf("failed to check bucket existence: %w", err)
-	}
-	if !exists {
-		logrus.Infof("Bucket %s does not exist, creating it", bucketName)
-		err = p.client.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
+// Check makes sure the bucket exists, then runs every selected stage, even
+// after one failed, as a step of the result. When the bucket check is denied
+// only the permissions stage is run, to report what is missing.
+func (p *S3Probe) Check(ctx context.Context) *Result {
+	opts := p.opts
+	result := newResult(p.Name(), p.client.EndpointURL().String())
+
+	bucketErr := result.run("bucket", func() error {
+		exists, err := p.client.BucketExists(ctx, opts.BucketName)
 		if err != nil {
-			logrus.Errorf("Failed to create bucket: %v", err)
-			return fmt.Errorf("failed to create test bucket: %w", err)
+			return categorizeS3Error(fmt.Errorf("failed to check bucket existence: %w", err))
+		}
+		if exists {
+			return nil
 		}
-		logrus.Infof("Bucket %s created successfully", bucketName)
+		if opts.LeastPrivilege || opts.ReadOnly {
+			return withCategory(ErrorCategoryNotFound, "create the bucket, the probe does not create it in least privilege mode", fmt.Errorf("bucket %s: %w", opts.BucketName, ErrS3BucketMissing))
+		}
+		err = p.client.MakeBucket(ctx, opts.BucketName, minio.MakeBucketOptions{})
+		if err != nil {
+			return categorizeS3Error(fmt.Errorf("failed to create test bucket: %w", err))
+		}
+		return nil
+	})
+	if bucketErr != nil && Categorize(bucketErr) != ErrorCategoryPermission {
+		return result
 	}
 
-	reader := bytes.NewReader(content)
-	_, err = p.client.PutObject(ctx, bucketName, objectName, reader, int64(len(content)), minio.PutObjectOptions{
-		ContentType: "text/plain",
-	})
+	selected := make(map[S3Stage]bool, len(opts.Stages))
+	for _, stage := range opts.Stages {
+		selected[stage] = true
+	}
+	if len(selected) == 0 {
+		selected[S3StagePutGet] = true
+	}
+
+	stages := map[S3Stage]func(ctx context.Context, prefix, bucketName string, opts S3TestOptions) error{
+		S3StagePutGet:    p.testPutGet,
+		S3StageHead:      p.testHead,
+		S3StageList:      p.testList,
+		S3StageMultipart: p.testMultipart,
+		S3StagePresigned: p.testPresigned,
+		S3StagePermissions: func(ctx context.Context, prefix, bucketName string, opts S3TestOptions) error {
+			permissions, err := p.CheckPermissions(ctx, prefix, bucketName, opts.ReadOnly)
+			if err != nil {
+				return err
+			}
+			return missingS3Permissions(permissions)
+		},
+	}
+	for _, stage := range S3Stages {
+		if !selected[stage] {
+			continue
+		}
+		if bucketErr != nil && stage != S3StagePermissions {
+			result.skip(string(stage), "the bucket check was denied")
+			continue
+		}
+		if opts.ReadOnly && !s3ReadStages[stage] {
+			result.skip(string(stage), "the stage writes, it is not run in read only mode")
+			continue
+		}
+		_ = result.run(string(stage), func() error {
+			return categorizeS3Error(stages[stage](ctx, opts.Prefix, opts.BucketName, opts))
+		})
+	}
+	return result
+}
+
+// categorizeS3Error sets the category of the S3 error responses.
+func categorizeS3Error(err error) error {
+	var resp minio.ErrorResponse
+	if !errors.As(err, &resp) {
+		return err
+	}
+	switch resp.Code {
+	case "AccessDenied":
+		return withCategory(ErrorCategoryPermission, "", err)
+	case "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken":
+		return withCategory(ErrorCategoryAuth, "check S3_ACCESS_KEY and S3_SECRET_KEY, or the credentials of the pod role", err)
+	case "NoSuchBucket":
+		return withCategory(ErrorCategoryNotFound, "", err)
+	}
+	return err
+}
+
+func testObjectName(prefix, stage string) string {
+	return fmt.Sprintf("%s-%s-%d.txt", prefix, stage, time.Now().UnixNano())
+}
+
+// putTestObject writes a test object and returns a func removing it.
+func (p *S3Probe) putTestObject(ctx context.Context, bucketName, objectName string, content []byte, opts minio.PutObjectOptions) (cleanup func() error, err error) {
+	_, err = p.client.PutObject(ctx, bucketName, objectName, bytes.NewReader(content), int64(len(content)), opts)
 	if err != nil {
-		logrus.Errorf("Failed to write object: %v", err)
-		return fmt.Errorf("failed to write object: %w", err)
+		return nil, fmt.Errorf("failed to write object: %w", err)
+	}
+	cleanup = func() error {
+		err := p.client.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to cleanup test object: %w", err)
+		}
+		return nil
 	}
-	logrus.Infof("Object %s written successfully", objectName)
+	return
+}
 
+func (p *S3Probe) readTestObject(ctx context.Context, bucketName, objectName string, content []byte) error {
 	obj, err := p.client.GetObject(ctx, bucketName, objectName, minio.GetObjectOptions{})
 	if err != nil {
-		logrus.Errorf("Failed to get object: %v", err)
 		return fmt.Errorf("failed to get object: %w", err)
 	}
-	logrus.Infof("Object %s retrieved successfully", objectName)
 	defer obj.Close()
 
 	readContent, err := io.ReadAll(obj)
 	if err != nil {
-		logrus.Errorf("Failed to read object content: %v", err)
 		return fmt.Errorf("failed to read object content: %w", err)
 	}
-	logrus.Infof("Object content read successfully")
-
 	if !bytes.Equal(readContent, content) {
-		logrus.Errorf("Content mismatch: got %s, want %s", readContent, content)
-		return fmt.Errorf("content mismatch: got %s, want %s", readContent, content)
+		return withCategory(ErrorCategoryDataMismatch, "", fmt.Errorf("content mismatch: got %d bytes, want %d bytes", len(readContent), len(content)))
 	}
+	return nil
+}
+
+func (p *S3Probe) testPutGet(ctx context.Context, prefix, bucketName string, opts S3TestOptions) error {
+	objectName := testObjectName(prefix, string(S3StagePutGet))
+	content := []byte("test content")
 
-	err = p.client.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{})
+	cleanup, err := p.putTestObject(ctx, bucketName, objectName, content, minio.PutObjectOptions{ContentType: "text/plain"})
 	if err != nil {
-		logrus.Errorf("Failed to cleanup test object: %v", err)
-		return fmt.Errorf("failed to cleanup test object: %w", err)
+		return err
+	}
+	if err = p.readTestObject(ctx, bucketName, objectName, content); err != nil {
+		_ = cleanup()
+		return err
 	}
-	logrus.Infof("Test object %s cleaned up successfully", objectName)
+	return cleanup()
+}
+
+func (p *S3Probe) testHead(ctx context.Context, prefix, bucketName string, opts S3TestOptions) error {
+	objectName := testObjectName(prefix, string(S3StageHead))
+	content := []byte("test content")
 
+	cleanup, err := p.putTestObject(ctx, bucketName, objectName, content, minio.PutObjectOptions{ContentType: "text/plain"})
+	if err != nil {
+		return err
+	}
+	info, err := p.client.StatObject(ctx, bucketName, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		_ = cleanup()
+		return fmt.Errorf("failed to head object: %w", err)
+	}
+	if info.Size != int64(len(content)) {
+		_ = cleanup()
+		return withCategory(ErrorCategoryDataMismatch, "", fmt.Errorf("object size mismatch: got %d, want %d", info.Size, len(content)))
+	}
+	return cleanup()
+}
+
+func (p *S3Probe) testList(ctx context.Context, prefix, bucketName string, opts S3TestOptions) error {
+	if opts.ReadOnly {
+		if err := p.listFirstObject(ctx, bucketName, prefix); err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+		return nil
+	}
+
+	objectName := testObjectName(prefix, string(S3StageList))
+
+	cleanup, err := p.putTestObject(ctx, bucketName, objectName, []byte("test content"), minio.PutObjectOptions{ContentType: "text/plain"})
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for obj := range p.client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			_ = cleanup()
+			return fmt.Errorf("failed to list objects: %w", obj.Err)
+		}
+		if obj.Key == objectName {
+			found = true
+		}
+	}
+	if !found {
+		_ = cleanup()
+		return withCategory(ErrorCategoryDataMismatch, "", fmt.Errorf("object %s is missing from the listing of prefix %s", objectName, prefix))
+	}
+	return cleanup()
+}
+
+// listFirstObject lists the prefix and stops after the first object, MaxKeys
+// alone only sets the page size and the listing would go through every page.
+func (p *S3Probe) listFirstObject(ctx context.Context, bucketName, prefix string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	obj, ok := <-p.client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: prefix, MaxKeys: 1})
+	if ok && obj.Err != nil {
+		return obj.Err
+	}
 	return nil
 }
+
+func (p *S3Probe) testMultipart(ctx context.Context, prefix, bucketName string, opts S3TestOptions) error {
+	objectName := testObjectName(prefix, string(S3StageMultipart))
+	partSize := opts.MultipartPartSize
+	if partSize == 0 {
+		partSize = defaultS3MultipartPartSize
+	}
+	content := bytes.Repeat([]byte("x"), int(partSize)+1)
+
+	cleanup, err := p.putTestObject(ctx, bucketName, objectName, content, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    uint64(partSize),
+	})
+	if err != nil {
+		return err
+	}
+	if err = p.readTestObject(ctx, bucketName, objectName, content); err != nil {
+		_ = cleanup()
+		return err
+	}
+	return cleanup()
+}
+
+func (p *S3Probe) testPresigned(ctx context.Context, prefix, bucketName string, opts S3TestOptions) error {
+	objectName := testObjectName(prefix, string(S3StagePresigned))
+	content := []byte("test content")
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	putURL, err := p.client.PresignedPutObject(ctx, bucketName, objectName, 5*time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed to presign put object: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, putURL.String(), bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("create request failed: %w", err)
+	}
+	if err = doPresignedRequest(httpClient, req, nil); err != nil {
+		return fmt.Errorf("presigned put failed: %w", err)
+	}
+
+	cleanup := func() error {
+		err := p.client.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to cleanup test object: %w", err)
+		}
+		return nil
+	}
+
+	getURL, err := p.client.PresignedGetObject(ctx, bucketName, objectName, 5*time.Minute, nil)
+	if err != nil {
+		_ = cleanup()
+		return fmt.Errorf("failed to presign get object: %w", err)
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, getURL.String(), nil)
+	if err != nil {
+		_ = cleanup()
+		return fmt.Errorf("create request failed: %w", err)
+	}
+	var body bytes.Buffer
+	if err = doPresignedRequest(httpClient, req, &body); err != nil {
+		_ = cleanup()
+		return fmt.Errorf("presigned get failed: %w", err)
+	}
+	if !bytes.Equal(body.Bytes(), content) {
+		_ = cleanup()
+		return withCategory(ErrorCategoryDataMismatch, "", fmt.Errorf("content mismatch: got %d bytes, want %d bytes", body.Len(), len(content)))
+	}
+	return cleanup()
+}
+
+func doPresignedRequest(client *http.Client, req *http.Request, body io.Writer) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		content, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, strings.TrimSpace(string(content)))
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			return withCategory(ErrorCategoryAuth, "", err)
+		case http.StatusForbidden:
+			return withCategory(ErrorCategoryPermission, "a proxy in front of S3 may strip or alter the presigned query", err)
+		}
+		return err
+	}
+	if body != nil {
+		_, err = io.Copy(body, resp.Body)
+	}
+	return err
+}
+
+// S3Permission is an S3 action the yatai components need on the bucket.
+type S3Permission string
+
+const (
+	S3PermissionPutObject    S3Permission = "s3:PutObject"
+	S3PermissionGetObject    S3Permission = "s3:GetObject"
+	S3PermissionDeleteObject S3Permission = "s3:DeleteObject"
+	S3PermissionListBucket   S3Permission = "s3:ListBucket"
+)
+
+// S3Permissions are the permissions CheckPermissions reports, in order.
+var S3Permissions = []S3Permission{S3PermissionPutObject, S3PermissionGetObject, S3PermissionDeleteObject, S3PermissionListBucket}
+
+type S3PermissionStatus string
+
+const (
+	S3PermissionGranted S3PermissionStatus = "granted"
+	S3PermissionDenied  S3PermissionStatus = "denied"
+	// S3PermissionUnknown is reported when the permission could not be
+	// exercised, in read only mode or because another one is missing
+	S3PermissionUnknown S3PermissionStatus = "unknown"
+)
+
+type S3PermissionResult struct {
+	Permission S3Permission
+	Status     S3PermissionStatus
+}
+
+// S3MissingPermissionsError lists the permissions which are denied.
+type S3MissingPermissionsError struct {
+	Missing []S3Permission
+}
+
+func (e *S3MissingPermissionsError) Error() string {
+	missing := make([]string, 0, len(e.Missing))
+	for _, permission := range e.Missing {
+		missing = append(missing, string(permission))
+	}
+	return "missing s3 permissions: " + strings.Join(missing, ", ")
+}
+
+func missingS3Permissions(permissions []S3PermissionResult) error {
+	missing := make([]S3Permission, 0)
+	for _, permission := range permissions {
+		if permission.Status == S3PermissionDenied {
+			missing = append(missing, permission.Permission)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	err := &S3MissingPermissionsError{Missing: missing}
+	return withCategory(ErrorCategoryPermission, strings.TrimPrefix(err.Error(), "missing s3 permissions: ")+" must be granted on the bucket to the user or role", err)
+}
+
+func isS3AccessDenied(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "AccessDenied" || resp.StatusCode == http.StatusForbidden
+}
+
+// s3PermissionStatus maps the error of an action to the status of its
+// permission, err is returned when it is not an access denied error.
+func s3PermissionStatus(err error) (S3PermissionStatus, error) {
+	if err == nil {
+		return S3PermissionGranted, nil
+	}
+	if isS3AccessDenied(err) {
+		return S3PermissionDenied, nil
+	}
+	return S3PermissionUnknown, err
+}
+
+// CheckPermissions exercises each of the S3Permissions on a test object named
+// after the prefix and reports which are granted. In read only mode nothing
+// is written, the object permissions are checked by reading a missing object,
+// which S3 only tells apart from a denied read when listing is granted.
+func (p *S3Probe) CheckPermissions(ctx context.Context, prefix, bucketName string, readOnly bool) (permissions []S3PermissionResult, err error) {
+	statuses := make(map[S3Permission]S3PermissionStatus, len(S3Permissions))
+	for _, permission := range S3Permissions {
+		statuses[permission] = S3PermissionUnknown
+	}
+
+	statuses[S3PermissionListBucket], err = s3PermissionStatus(p.listFirstObject(ctx, bucketName, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	objectName := testObjectName(prefix, string(S3StagePermissions))
+	content := []byte("test content")
+	written := false
+	if !readOnly {
+		_, err = p.client.PutObject(ctx, bucketName, objectName, bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{ContentType: "text/plain"})
+		statuses[S3PermissionPutObject], err = s3PermissionStatus(err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write object: %w", err)
+		}
+		written = statuses[S3PermissionPutObject] == S3PermissionGranted
+	}
+
+	_, statErr := p.client.StatObject(ctx, bucketName, objectName, minio.StatObjectOptions{})
+	switch {
+	case statErr == nil:
+		statuses[S3PermissionGetObject] = S3PermissionGranted
+	case !written && minio.ToErrorResponse(statErr).Code == "NoSuchKey":
+		statuses[S3PermissionGetObject] = S3PermissionGranted
+	case isS3AccessDenied(statErr) && (written || statuses[S3PermissionListBucket] == S3PermissionGranted):
+		statuses[S3PermissionGetObject] = S3PermissionDenied
+	case isS3AccessDenied(statErr):
+		// a missing object reads as denied without s3:ListBucket
+	default:
+		return nil, fmt.Errorf("failed to head object: %w", statErr)
+	}
+
+	if written {
+		err = p.client.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{})
+		statuses[S3PermissionDeleteObject], err = s3PermissionStatus(err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to cleanup test object: %w", err)
+		}
+	}
+
+	for _, permission := range S3Permissions {
+		permissions = append(permissions, S3PermissionResult{Permission: permission, Status: statuses[permission]})
+	}
+	return
+}
@@ -0,0 +1,415 @@
+package conncheck
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// fakeS3 is an in-memory stand-in for the part of the S3 API used by the
+// probe. It does not check signatures.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	uploads map[string]map[int][]byte
+	// requests counts the requests by "METHOD kind", kind being bucket,
+	// object, uploads, part, complete, abort or list
+	requests map[string]int
+	// deny fails the requests of "METHOD kind" with AccessDenied
+	deny map[string]bool
+}
+
+func newFakeS3(buckets ...string) *fakeS3 {
+	f := &fakeS3{
+		buckets:  make(map[string]map[string][]byte),
+		uploads:  make(map[string]map[int][]byte),
+		requests: make(map[string]int),
+		deny:     make(map[string]bool),
+	}
+	for _, bucket := range buckets {
+		f.buckets[bucket] = make(map[string][]byte)
+	}
+	return f
+}
+
+func (f *fakeS3) count(request string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[request]
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func s3ETag(content []byte) string {
+	sum := md5.Sum(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	kind := "object"
+	switch {
+	case key == "" && query.Has("list-type"):
+		kind = "list"
+	case key == "":
+		kind = "bucket"
+	case query.Has("uploads"):
+		kind = "uploads"
+	case query.Has("partNumber"):
+		kind = "part"
+	case query.Has("uploadId") && r.Method == http.MethodPost:
+		kind = "complete"
+	case query.Has("uploadId"):
+		kind = "abort"
+	}
+	request := r.Method + " " + kind
+	f.requests[request]++
+	if f.deny[request] {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	if query.Has("location") {
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+		return
+	}
+
+	objects, ok := f.buckets[bucket]
+	if !ok && !(kind == "bucket" && r.Method == http.MethodPut) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	switch request {
+	case "HEAD bucket":
+	case "PUT bucket":
+		f.buckets[bucket] = make(map[string][]byte)
+	case "GET list":
+		f.list(w, bucket, objects, query)
+	case "PUT object":
+		objects[key] = body
+		w.Header().Set("ETag", s3ETag(body))
+	case "GET object", "HEAD object":
+		content, ok := objects[key]
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", s3ETag(content))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(content)
+		}
+	case "DELETE object":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "POST uploads":
+		uploadID := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, bucket, key, uploadID)
+	case "PUT part":
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[partNumber] = body
+		w.Header().Set("ETag", s3ETag(body))
+	case "POST complete":
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		content := make([]byte, 0)
+		for _, number := range numbers {
+			content = append(content, parts[number]...)
+		}
+		objects[key] = content
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, bucket, key, s3ETag(content))
+	case "DELETE abort":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, objects map[string][]byte, query url.Values) {
+	prefix := query.Get("prefix")
+	maxKeys, _ := strconv.Atoi(query.Get("max-keys"))
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+		// NextContinuationToken is the last key listed
+		NextContinuationToken string `xml:",omitempty"`
+	}{Name: bucket, Prefix: prefix}
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if maxKeys > 0 && len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			ETag:         s3ETag(objects[key]),
+			Size:         len(objects[key]),
+		})
+	}
+	result.KeyCount = len(keys)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func newFakeS3Client(t *testing.T, fake *fakeS3) (*minio.Client, *http.Client) {
+	t.Helper()
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4("access", "secret", ""),
+		Secure:       true,
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+		Transport:    server.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server.Client()
+}
+
+func TestS3ProbeStages(t *testing.T) {
+	fake := newFakeS3("yatai")
+	client, httpClient := newFakeS3Client(t, fake)
+
+	result := NewS3Probe(client).WithOptions(S3TestOptions{
+		BucketName: "yatai",
+		Prefix:     "conncheck",
+		Stages:     S3Stages,
+		HTTPClient: httpClient,
+	}).Check(context.Background())
+	if !result.Passed() {
+		t.Fatalf("s3 probe failed: %v", result.Err())
+	}
+	// the bucket check comes first
+	if len(result.Steps) != len(S3Stages)+1 {
+		t.Fatalf("expected a step per stage, got %d", len(result.Steps))
+	}
+	for i, step := range result.Steps[1:] {
+		if step.Name != string(S3Stages[i]) || step.Status != StepPassed {
+			t.Fatalf("unexpected step %+v", step)
+		}
+	}
+
+	if fake.count("POST uploads") != 1 || fake.count("PUT part") != 2 || fake.count("POST complete") != 1 {
+		t.Fatalf("the multipart stage should upload 2 parts, requests: %v", fake.requests)
+	}
+	if fake.count("GET list") == 0 || fake.count("HEAD object") == 0 {
+		t.Fatalf("the list and head stages should list and head, requests: %v", fake.requests)
+	}
+	if len(fake.buckets["yatai"]) != 0 {
+		t.Fatalf("the test objects should be removed, left %d", len(fake.buckets["yatai"]))
+	}
+}
+
+func TestS3ProbeReportsStagesSeparately(t *testing.T) {
+	fake := newFakeS3("yatai")
+	fake.deny["GET list"] = true
+	client, _ := newFakeS3Client(t, fake)
+
+	result := NewS3Probe(client).WithOptions(S3TestOptions{
+		BucketName: "yatai",
+		Prefix:     "conncheck",
+		Stages:     []S3Stage{S3StageHead, S3StageList},
+	}).Check(context.Background())
+	if len(result.Steps) != 3 || result.Steps[1].Status != StepPassed || result.Steps[2].Status != StepFailed {
+		t.Fatalf("unexpected steps %+v", result.Steps)
+	}
+	if step := result.Steps[2]; step.Category != ErrorCategoryPermission || step.Hint == "" {
+		t.Fatalf("the denied listing should be a permission error with a hint, got %+v", step)
+	}
+}
+
+func TestS3ProbeLeastPrivilegeBucketMissing(t *testing.T) {
+	fake := newFakeS3()
+	client, _ := newFakeS3Client(t, fake)
+
+	err := NewS3Probe(client).WithOptions(S3TestOptions{LeastPrivilege: true}).Test(context.Background(), "conncheck", "yatai")
+	if !errors.Is(err, ErrS3BucketMissing) {
+		t.Fatalf("expected the bucket to be reported missing, got %v", err)
+	}
+	if Categorize(err) != ErrorCategoryNotFound {
+		t.Fatalf("the missing bucket should be categorized not found, got %s", Categorize(err))
+	}
+	if fake.count("PUT bucket") != 0 {
+		t.Fatal("the bucket should not be created in least privilege mode")
+	}
+}
+
+func TestS3ProbeMissingPermissions(t *testing.T) {
+	fake := newFakeS3("yatai")
+	fake.deny["GET list"] = true
+	fake.deny["DELETE object"] = true
+	client, _ := newFakeS3Client(t, fake)
+
+	result := NewS3Probe(client).WithOptions(S3TestOptions{
+		BucketName:     "yatai",
+		Prefix:         "conncheck",
+		Stages:         []S3Stage{S3StagePermissions},
+		LeastPrivilege: true,
+	}).Check(context.Background())
+	var missing *S3MissingPermissionsError
+	if !errors.As(result.Err(), &missing) {
+		t.Fatalf("expected missing permissions, got %v", result.Err())
+	}
+	if len(missing.Missing) != 2 || missing.Missing[0] != S3PermissionDeleteObject || missing.Missing[1] != S3PermissionListBucket {
+		t.Fatalf("unexpected missing permissions %v", missing.Missing)
+	}
+}
+
+func TestS3ProbeListsOnlyTheFirstPage(t *testing.T) {
+	fake := newFakeS3("yatai")
+	for i := 0; i < 5; i++ {
+		fake.buckets["yatai"][fmt.Sprintf("conncheck-%d", i)] = []byte("test content")
+	}
+	client, _ := newFakeS3Client(t, fake)
+
+	probe := NewS3Probe(client)
+	if _, err := probe.CheckPermissions(context.Background(), "conncheck", "yatai", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := probe.testList(context.Background(), "conncheck", "yatai", S3TestOptions{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	// without stopping each listing would request the 5 pages, the canceled
+	// listing may still have requested the next one
+	if count := fake.count("GET list"); count > 4 {
+		t.Fatalf("each listing should stop after the first page, got %d list requests", count)
+	}
+}
+
+func TestS3ProbeBucketDeniedReportsPermissions(t *testing.T) {
+	fake := newFakeS3("yatai")
+	fake.deny["HEAD bucket"] = true
+	fake.deny["GET list"] = true
+	client, _ := newFakeS3Client(t, fake)
+
+	result := NewS3Probe(client).WithOptions(S3TestOptions{
+		BucketName:     "yatai",
+		Prefix:         "conncheck",
+		Stages:         []S3Stage{S3StageHead, S3StagePermissions},
+		LeastPrivilege: true,
+	}).Check(context.Background())
+	steps := stepsByName(result)
+	if steps["bucket"].Status != StepFailed || steps[string(S3StageHead)].Status != StepSkipped {
+		t.Fatalf("unexpected steps %+v", result.Steps)
+	}
+	var missing *S3MissingPermissionsError
+	if !errors.As(steps[string(S3StagePermissions)].err, &missing) || len(missing.Missing) != 1 || missing.Missing[0] != S3PermissionListBucket {
+		t.Fatalf("the permissions stage should report the missing s3:ListBucket, got %+v", steps[string(S3StagePermissions)])
+	}
+}
+
+func TestS3ProbeReadOnly(t *testing.T) {
+	fake := newFakeS3("yatai")
+	fake.deny["HEAD object"] = true
+	client, _ := newFakeS3Client(t, fake)
+
+	probe := NewS3Probe(client).WithOptions(S3TestOptions{
+		BucketName: "yatai",
+		Prefix:     "conncheck",
+		Stages:     S3Stages,
+		ReadOnly:   true,
+	})
+	result := probe.Check(context.Background())
+	if result.Passed() {
+		t.Fatal("expected the denied read to fail the permissions stage")
+	}
+	for _, step := range result.Steps[1:] {
+		if s3ReadStages[S3Stage(step.Name)] == (step.Status == StepSkipped) {
+			t.Fatalf("only the write stages should be skipped, got %+v", step)
+		}
+	}
+	if fake.count("PUT object") != 0 || fake.count("DELETE object") != 0 {
+		t.Fatalf("nothing should be written in read only mode, requests: %v", fake.requests)
+	}
+
+	permissions, err := probe.CheckPermissions(context.Background(), "conncheck", "yatai", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[S3Permission]S3PermissionStatus{
+		S3PermissionPutObject:    S3PermissionUnknown,
+		S3PermissionGetObject:    S3PermissionDenied,
+		S3PermissionDeleteObject: S3PermissionUnknown,
+		S3PermissionListBucket:   S3PermissionGranted,
+	}
+	for _, permission := range permissions {
+		if permission.Status != expected[permission.Permission] {
+			t.Fatalf("%s is %s, expected %s", permission.Permission, permission.Status, expected[permission.Permission])
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package conncheck
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bentoml/yatai-common/config"
+	"github.com/bentoml/yatai-common/consts"
+)
+
+// DefaultMaxClockSkew is the clock skew with the Yatai API server above which
+// the clock step fails.
+const DefaultMaxClockSkew = time.Minute
+
+// YataiProbe checks the Yatai API server the components report to.
+type YataiProbe struct {
+	config       config.YataiConfig
+	client       *http.Client
+	maxClockSkew time.Duration
+}
+
+func NewYataiProbe(conf config.YataiConfig) *YataiProbe {
+	return &YataiProbe{
+		config:       conf,
+		client:       &http.Client{},
+		maxClockSkew: DefaultMaxClockSkew,
+	}
+}
+
+// WithHTTPClient sets the client of the API requests, the tls step uses the
+// TLS config of its transport.
+func (p *YataiProbe) WithHTTPClient(client *http.Client) *YataiProbe {
+	p.client = client
+	return p
+}
+
+func (p *YataiProbe) WithMaxClockSkew(maxClockSkew time.Duration) *YataiProbe {
+	p.maxClockSkew = maxClockSkew
+	return p
+}
+
+func (p *YataiProbe) Name() string {
+	return "yatai"
+}
+
+// Check resolves the host of the endpoint, connects to it and completes the
+// TLS handshake, then authenticates with the api token, looks up the cluster
+// and compares the Date of the API responses with the local clock.
+func (p *YataiProbe) Check(ctx context.Context) *Result {
+	result := newResult(p.Name(), p.config.Endpoint)
+
+	endpoint, err := url.Parse(strings.TrimSuffix(p.config.Endpoint, "/"))
+	if err == nil && (endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "") {
+		err = fmt.Errorf("the endpoint %q is not an http or https URL", p.config.Endpoint)
+	}
+	if err != nil {
+		result.add("config", 0, withCategory(ErrorCategoryNotFound, fmt.Sprintf("set %s to the URL of the Yatai API server", consts.EnvYataiEndpoint), err))
+		return result
+	}
+	addr := endpoint.Host
+	if endpoint.Port() == "" {
+		port := "80"
+		if endpoint.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(endpoint.Hostname(), port)
+	}
+
+	err = result.runWithMessage("dns", func() (string, error) {
+		if net.ParseIP(endpoint.Hostname()) != nil {
+			return "the host is an IP address", nil
+		}
+		addrs, err := net.DefaultResolver.LookupHost(ctx, endpoint.Hostname())
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %w", endpoint.Hostname(), err)
+		}
+		return "resolved to " + strings.Join(addrs, ", "), nil
+	})
+	if err != nil {
+		return result
+	}
+
+	err = result.run("tcp", func() error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", addr, err)
+		}
+		return conn.Close()
+	})
+	if err != nil {
+		return result
+	}
+
+	if endpoint.Scheme != "https" {
+		result.skip("tls", "the endpoint is not https")
+	} else {
+		err = result.runWithMessage("tls", func() (string, error) {
+			return p.checkTLS(ctx, addr, endpoint.Hostname())
+		})
+		if err != nil {
+			return result
+		}
+	}
+
+	var date time.Time
+	var requestedAt time.Time
+	err = result.runWithMessage("token", func() (string, error) {
+		var user struct {
+			Name string `json:"name"`
+		}
+		requestedAt = time.Now()
+		resp, err := p.get(ctx, endpoint.String()+"/api/v1/auth/current", &user)
+		if resp != nil {
+			date, _ = http.ParseTime(resp.Header.Get("Date"))
+		}
+		if err != nil {
+			return "", fmt.Errorf("yatai token check failed: %w", err)
+		}
+		return "authenticated as " + user.Name, nil
+	})
+	if err != nil {
+		return result
+	}
+
+	if p.config.ClusterName == "" {
+		result.skip("cluster", fmt.Sprintf("no cluster name is configured, set %s", consts.EnvYataiClusterName))
+	} else {
+		_ = result.run("cluster", func() error {
+			_, err := p.get(ctx, endpoint.String()+"/api/v1/clusters/"+url.PathEscape(p.config.ClusterName), nil)
+			if Categorize(err) == ErrorCategoryNotFound {
+				return withCategory(ErrorCategoryNotFound, fmt.Sprintf("register the cluster %s in Yatai, or fix %s", p.config.ClusterName, consts.EnvYataiClusterName), fmt.Errorf("cluster %s is not registered: %w", p.config.ClusterName, err))
+			}
+			if err != nil {
+				return fmt.Errorf("yatai cluster check failed: %w", err)
+			}
+			return nil
+		})
+	}
+
+	if date.IsZero() {
+		result.skip("clock", "the response has no Date header")
+		return result
+	}
+	_ = result.runWithMessage("clock", func() (string, error) {
+		// the Date header has a one second resolution
+		skew := requestedAt.Sub(date).Round(time.Second)
+		message := fmt.Sprintf("the local clock is %s ahead of the Yatai API server", skew)
+		if skew < 0 {
+			message = fmt.Sprintf("the local clock is %s behind the Yatai API server", -skew)
+		}
+		if skew > p.maxClockSkew || -skew > p.maxClockSkew {
+			return message, withCategory(ErrorCategoryUnknown, "synchronize the clocks of the nodes with NTP, the tokens and signed URLs are rejected when they drift", fmt.Errorf("clock skew %s exceeds %s", skew, p.maxClockSkew))
+		}
+		return message, nil
+	})
+
+	return result
+}
+
+// checkTLS completes a handshake with the TLS config of the client and
+// reports when the certificate expires.
+func (p *YataiProbe) checkTLS(ctx context.Context, addr, serverName string) (message string, err error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if transport, ok := p.client.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverName
+	}
+	dialer := tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		err = fmt.Errorf("tls handshake with %s failed: %w", addr, err)
+		return
+	}
+	defer conn.Close()
+	certificates := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certificates) != 0 {
+		message = fmt.Sprintf("certificate valid until %s", certificates[0].NotAfter.UTC().Format(time.RFC3339))
+	}
+	return
+}
+
+// get sends an authenticated request to the API and decodes the response into
+// v when not nil.
+func (p *YataiProbe) get(ctx context.Context, target string, v interface{}) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request failed: %w", err)
+	}
+	req.Header.Set(consts.YataiApiTokenHeaderName, p.config.ApiToken)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return resp, withCategory(ErrorCategoryAuth, fmt.Sprintf("check %s, the token may have been revoked", consts.EnvYataiApiToken), fmt.Errorf("the api token is rejected: status %d", resp.StatusCode))
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return resp, categorizeHTTPStatus(resp.StatusCode, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body)))
+	}
+
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return resp, fmt.Errorf("failed to decode the response of %s: %w", req.URL.Path, err)
+		}
+	}
+	return resp, nil
+}
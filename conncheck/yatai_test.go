@@ -0,0 +1,109 @@
+package conncheck
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bentoml/yatai-common/config"
+	"github.com/bentoml/yatai-common/consts"
+)
+
+// startFakeYatai serves the current user and the registered clusters of a
+// Yatai API server, with a clock offset by skew.
+func startFakeYatai(t *testing.T, token string, clusters []string, skew time.Duration) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+		if r.Header.Get(consts.YataiApiTokenHeaderName) != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/api/v1/auth/current":
+			_, _ = w.Write([]byte(`{"name":"yatai-deployment"}`))
+			return
+		case strings.HasPrefix(r.URL.Path, "/api/v1/clusters/"):
+			for _, cluster := range clusters {
+				if r.URL.Path == "/api/v1/clusters/"+cluster {
+					_, _ = w.Write([]byte(`{"name":"` + cluster + `"}`))
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestYataiProbe(t *testing.T) {
+	server := startFakeYatai(t, "secret", []string{"default"}, 0)
+
+	result := NewYataiProbe(config.YataiConfig{Endpoint: server.URL, ClusterName: "default", ApiToken: "secret"}).WithHTTPClient(server.Client()).Check(context.Background())
+	if !result.Passed() {
+		t.Fatalf("yatai probe failed: %+v", result.Steps)
+	}
+	names := make([]string, 0, len(result.Steps))
+	for _, step := range result.Steps {
+		names = append(names, step.Name)
+	}
+	if strings.Join(names, ",") != "dns,tcp,tls,token,cluster,clock" {
+		t.Errorf("unexpected steps %v", names)
+	}
+	if steps := stepsByName(result); steps["token"].Message != "authenticated as yatai-deployment" {
+		t.Errorf("the token step should report the user, got %q", steps["token"].Message)
+	}
+
+	result = NewYataiProbe(config.YataiConfig{Endpoint: server.URL, ClusterName: "default", ApiToken: "secret"}).Check(context.Background())
+	if result.Passed() || stepsByName(result)["tls"].Category != ErrorCategoryTLS {
+		t.Errorf("the untrusted certificate should fail the tls step, got %+v", result.Steps)
+	}
+
+	result = NewYataiProbe(config.YataiConfig{Endpoint: server.URL, ClusterName: "default", ApiToken: "revoked"}).WithHTTPClient(server.Client()).Check(context.Background())
+	if step := stepsByName(result)["token"]; step.Status != StepFailed || step.Category != ErrorCategoryAuth {
+		t.Errorf("the revoked token should fail the token step, got %+v", step)
+	}
+
+	result = NewYataiProbe(config.YataiConfig{Endpoint: server.URL, ClusterName: "unknown", ApiToken: "secret"}).WithHTTPClient(server.Client()).Check(context.Background())
+	if step := stepsByName(result)["cluster"]; step.Status != StepFailed || step.Category != ErrorCategoryNotFound {
+		t.Errorf("the unregistered cluster should fail the cluster step, got %+v", step)
+	}
+}
+
+func TestYataiProbeClockSkew(t *testing.T) {
+	server := startFakeYatai(t, "secret", nil, -5*time.Minute)
+
+	result := NewYataiProbe(config.YataiConfig{Endpoint: server.URL, ApiToken: "secret"}).WithHTTPClient(server.Client()).Check(context.Background())
+	step := stepsByName(result)["clock"]
+	if step.Status != StepFailed || !strings.Contains(step.Message, "ahead of the Yatai API server") {
+		t.Errorf("the clock skew should fail the clock step, got %+v", step)
+	}
+	if stepsByName(result)["cluster"].Status != StepSkipped {
+		t.Error("the cluster step should be skipped without a cluster name")
+	}
+
+	result = NewYataiProbe(config.YataiConfig{Endpoint: server.URL, ApiToken: "secret"}).WithHTTPClient(server.Client()).WithMaxClockSkew(10 * time.Minute).Check(context.Background())
+	if !result.Passed() {
+		t.Errorf("the clock skew should be tolerated, got %+v", result.Steps)
+	}
+}
+
+func TestYataiProbeUnreachable(t *testing.T) {
+	server := startFakeYatai(t, "secret", nil, 0)
+	endpoint := server.URL
+	server.Close()
+
+	result := NewYataiProbe(config.YataiConfig{Endpoint: endpoint, ApiToken: "secret"}).Check(context.Background())
+	if result.Passed() || result.Steps[len(result.Steps)-1].Name != "tcp" || result.Steps[len(result.Steps)-1].Category != ErrorCategoryTCP {
+		t.Errorf("the closed server should fail the tcp step, got %+v", result.Steps)
+	}
+
+	result = NewYataiProbe(config.YataiConfig{Endpoint: "yatai.example.com"}).Check(context.Background())
+	if result.Passed() || result.Steps[0].Name != "config" {
+		t.Errorf("the endpoint without a scheme should fail the config step, got %+v", result.Steps)
+	}
+}
@@ -27,7 +27,8 @@ const (
 
 	NoneStr = "None"
 
-	AmazonS3Endpoint = "s3.amazonaws.com"
+	AmazonS3Endpoint    = "s3.amazonaws.com"
+	GoogleCloudEndpoint = "storage.googleapis.com"
 
 	YataiImageBuilderComponentName = "yatai-image-builder"
 	YataiDeploymentComponentName   = "yatai-deployment"
@@ -45,4 +46,7 @@ const (
 	InternalImagesBuildkitDefault           = "quay.io/bentoml/buildkit:master"
 	InternalImagesBuildkitRootlessDefault   = "quay.io/bentoml/buildkit:master-rootless"
 	InternalImagesBuildahDefault            = "quay.io/bentoml/bentoml-buildah:0.0.1"
+
+	DefaultDockerRegistryBentoRepositoryName = "yatai-bentos"
+	DefaultDockerRegistryModelRepositoryName = "yatai-models"
 )
@@ -20,19 +20,27 @@ const (
 	EnvS3Endpoint   = "S3_ENDPOINT"
 	EnvS3Region     = "S3_REGION"
 	EnvS3BucketName = "S3_BUCKET_NAME"
+	EnvS3Prefix     = "S3_PREFIX"
 	EnvS3AccessKey  = "S3_ACCESS_KEY"
 	// nolint:gosec
 	EnvS3SecretKey = "S3_SECRET_KEY"
 	EnvS3Secure    = "S3_SECURE"
 
+	EnvS3CredentialMode     = "S3_CREDENTIAL_MODE"
+	EnvS3CredentialEndpoint = "S3_CREDENTIAL_ENDPOINT"
+
 	EnvDockerRegistryServer          = "DOCKER_REGISTRY_SERVER"
 	EnvDockerRegistryInClusterServer = "DOCKER_REGISTRY_IN_CLUSTER_SERVER"
 	EnvDockerRegistryUsername        = "DOCKER_REGISTRY_USERNAME"
 	// nolint:gosec
 	EnvDockerRegistryPassword            = "DOCKER_REGISTRY_PASSWORD"
 	EnvDockerRegistrySecure              = "DOCKER_REGISTRY_SECURE"
+	EnvDockerRegistryCABundle            = "DOCKER_REGISTRY_CA_BUNDLE"
+	EnvDockerRegistryInsecureSkipVerify  = "DOCKER_REGISTRY_INSECURE_SKIP_VERIFY"
 	EnvDockerRegistryBentoRepositoryName = "DOCKER_REGISTRY_BENTO_REPOSITORY_NAME"
 	EnvDockerRegistryModelRepositoryName = "DOCKER_REGISTRY_MODEL_REPOSITORY_NAME"
+	EnvDockerRegistries                  = "DOCKER_REGISTRIES"
+	EnvDockerRegistryRoutes              = "DOCKER_REGISTRY_ROUTES"
 
 	EnvInternalImagesBentoDownloader    = "INTERNAL_IMAGES_BENTO_DOWNLOADER"
 	EnvInternalImagesCurl               = "INTERNAL_IMAGES_CURL"
@@ -41,18 +49,34 @@ const (
 	EnvInternalImagesBuildkit           = "INTERNAL_IMAGES_BUILDKIT"
 	EnvInternalImagesBuildkitRootless   = "INTERNAL_IMAGES_BUILDKIT_ROOTLESS"
 	EnvInternalImagesBuildah            = "INTERNAL_IMAGES_BUILDAH"
+	EnvInternalImagesRegistryMirror     = "INTERNAL_IMAGES_REGISTRY_MIRROR"
+	EnvInternalImagesRewriteRules       = "INTERNAL_IMAGES_REWRITE_RULES"
+	EnvInternalImagesDigestsFile        = "INTERNAL_IMAGES_DIGESTS_FILE"
+
+	EnvYataiConfigFile = "YATAI_CONFIG_FILE"
+	// EnvYataiSnapshotRedactionKey keys the HMAC of the secrets redacted in
+	// the config snapshots, so the snapshots of different processes compare
+	EnvYataiSnapshotRedactionKey = "YATAI_SNAPSHOT_REDACTION_KEY"
 
-	EnvYataiSystemNamespace       = "YATAI_SYSTEM_NAMESPACE"
-	EnvYataiImageBuilderNamespace = "YATAI_IMAGE_BUILDER_NAMESPACE"
-	EnvYataiDeploymentNamespace   = "YATAI_DEPLOYMENT_NAMESPACE"
-	EnvBentoDeploymentNamespaces  = "BENTO_DEPLOYMENT_NAMESPACES"
-	EnvImageBuildersNamespace     = "IMAGE_BUILDERS_NAMESPACE"
+	EnvYataiSystemNamespace             = "YATAI_SYSTEM_NAMESPACE"
+	EnvYataiImageBuilderNamespace       = "YATAI_IMAGE_BUILDER_NAMESPACE"
+	EnvYataiDeploymentNamespace         = "YATAI_DEPLOYMENT_NAMESPACE"
+	EnvBentoDeploymentNamespaces        = "BENTO_DEPLOYMENT_NAMESPACES"
+	EnvBentoDeploymentNamespaceSelector = "BENTO_DEPLOYMENT_NAMESPACE_SELECTOR"
+	EnvImageBuildersNamespace           = "IMAGE_BUILDERS_NAMESPACE"
+	// EnvYataiMultiTenancy enables the tenant overlays of the bento
+	// deployment namespaces
+	EnvYataiMultiTenancy = "YATAI_MULTI_TENANCY"
 
 	EnvAWSAccessKeyID     = "AWS_ACCESS_KEY_ID"
 	EnvGCPAccessKeyID     = "GCP_ACCESS_KEY_ID"
 	EnvAWSSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
 	EnvGCPSecretAccessKey = "GCP_SECRET_ACCESS_KEY"
 
+	EnvAWSRegion               = "AWS_REGION"
+	EnvAWSRoleARN              = "AWS_ROLE_ARN"
+	EnvAWSWebIdentityTokenFile = "AWS_WEB_IDENTITY_TOKEN_FILE"
+
 	EnvAWSECRWithIAMRole = "AWS_ECR_WITH_IAM_ROLE"
 	EnvAWSECRRegion      = "AWS_ECR_REGION"
 )
@@ -89,6 +89,13 @@ const (
 	KubeAnnotationGCPAccessKeySecretName               = "yatai.ai/gcp-access-key-secret"
 	KubeAnnotationIsMultiTenancy                       = "yatai.ai/is-multi-tenancy"
 
+	// tenant overlays set on bento deployment namespaces
+	KubeLabelYataiTenantConfig                            = "yatai.ai/tenant-config"
+	KubeAnnotationTenantS3BucketName                      = "yatai.ai/s3-bucket-name"
+	KubeAnnotationTenantS3Prefix                          = "yatai.ai/s3-prefix"
+	KubeAnnotationTenantDockerRegistryBentoRepositoryName = "yatai.ai/docker-registry-bento-repository-name"
+	KubeAnnotationTenantDockerRegistryModelRepositoryName = "yatai.ai/docker-registry-model-repository-name"
+
 	KubeCreator = "yatai"
 
 	KubeResourceGPUNvidia = "nvidia.com/gpu"
@@ -0,0 +1,147 @@
+package imageref
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultRegistry = "docker.io"
+	DefaultTag      = "latest"
+
+	// MaxTagLength is the longest tag the distribution spec allows.
+	MaxTagLength = 128
+
+	// legacy docker hub host, normalized to DefaultRegistry
+	legacyDefaultRegistry    = "index.docker.io"
+	officialRepositoryPrefix = "library/"
+
+	tagHashLength = 16
+)
+
+var ErrInvalidReference = errors.New("invalid image reference")
+
+var (
+	registryRegexp   = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$`)
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*)*$`)
+	tagRegexp        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestRegexp     = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+	invalidTagCharRegexp = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// Reference is an OCI image reference: [registry/]repository[:tag][@digest]
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// Parse splits an image reference into its parts without filling in
+// defaults, Registry is empty when the reference does not name one.
+func Parse(s string) (ref *Reference, err error) {
+	ref = &Reference{}
+	remainder := s
+
+	if i := strings.Index(remainder, "@"); i >= 0 {
+		ref.Digest = remainder[i+1:]
+		remainder = remainder[:i]
+		if !digestRegexp.MatchString(ref.Digest) {
+			err = errors.Wrapf(ErrInvalidReference, "%q: invalid digest %q", s, ref.Digest)
+			return
+		}
+	}
+
+	if i := strings.LastIndex(remainder, ":"); i >= 0 && !strings.Contains(remainder[i+1:], "/") {
+		ref.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			err = errors.Wrapf(ErrInvalidReference, "%q: invalid tag %q", s, ref.Tag)
+			return
+		}
+	}
+
+	// the first component is a registry when it can not be a repository
+	// component: it has a port, a dot or is localhost
+	if i := strings.Index(remainder, "/"); i >= 0 {
+		host := remainder[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" || strings.ToLower(host) != host {
+			ref.Registry = host
+			remainder = remainder[i+1:]
+		}
+	}
+	ref.Repository = remainder
+
+	if ref.Registry != "" && !registryRegexp.MatchString(ref.Registry) {
+		err = errors.Wrapf(ErrInvalidReference, "%q: invalid registry %q", s, ref.Registry)
+		return
+	}
+	if !repositoryRegexp.MatchString(ref.Repository) {
+		err = errors.Wrapf(ErrInvalidReference, "%q: invalid repository %q", s, ref.Repository)
+		return
+	}
+	return
+}
+
+// ParseNormalized parses an image reference the way docker resolves it:
+// docker.io is the default registry, its single component repositories
+// live under library/ and the tag defaults to latest when there is no digest.
+func ParseNormalized(s string) (ref *Reference, err error) {
+	ref, err = Parse(s)
+	if err != nil {
+		return
+	}
+	ref.Normalize()
+	return
+}
+
+func (r *Reference) Normalize() {
+	if r.Registry == "" || r.Registry == legacyDefaultRegistry {
+		r.Registry = DefaultRegistry
+	}
+	if r.Registry == DefaultRegistry && !strings.Contains(r.Repository, "/") {
+		r.Repository = officialRepositoryPrefix + r.Repository
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = DefaultTag
+	}
+}
+
+// Name returns the reference without its tag and digest.
+func (r *Reference) Name() string {
+	if r.Registry == "" {
+		return r.Repository
+	}
+	return r.Registry + "/" + r.Repository
+}
+
+func (r *Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// SanitizeTag turns s into a valid tag: invalid characters are replaced by
+// "-", a leading "." or "-" gets a "_" prefix and tags longer than
+// MaxTagLength are cut and suffixed with a hash of s so they stay unique.
+func SanitizeTag(s string) string {
+	tag := invalidTagCharRegexp.ReplaceAllString(s, "-")
+	if tag == "" || tag[0] == '.' || tag[0] == '-' {
+		tag = "_" + tag
+	}
+	if len(tag) > MaxTagLength {
+		hash := sha256.Sum256([]byte(s))
+		tag = tag[:MaxTagLength-tagHashLength-1] + "." + hex.EncodeToString(hash[:])[:tagHashLength]
+	}
+	return tag
+}
@@ -0,0 +1,63 @@
+package imageref
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseNormalized(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	cases := map[string]string{
+		"nginx":                                "docker.io/library/nginx:latest",
+		"bentoml/yatai:1.0":                    "docker.io/bentoml/yatai:1.0",
+		"index.docker.io/nginx":                "docker.io/library/nginx:latest",
+		"localhost/bentos":                     "localhost/bentos:latest",
+		"registry.example.com:5000/a/b:v1.2":   "registry.example.com:5000/a/b:v1.2",
+		"quay.io/bentoml/curl@" + digest:       "quay.io/bentoml/curl@" + digest,
+		"quay.io/bentoml/curl:0.0.1@" + digest: "quay.io/bentoml/curl:0.0.1@" + digest,
+	}
+	for s, expected := range cases {
+		ref, err := ParseNormalized(s)
+		if err != nil {
+			t.Fatalf("parse %s failed: %v", s, err)
+		}
+		if ref.String() != expected {
+			t.Fatalf("%s normalized to %s, expected %s", s, ref, expected)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"Bentos",
+		"registry.example.com/bentos:-v1",
+		"registry.example.com/bentos:" + strings.Repeat("a", MaxTagLength+1),
+		"registry.example.com/bentos@sha256",
+		"bad_host.example.com/bentos",
+	} {
+		if _, err := Parse(s); !errors.Is(err, ErrInvalidReference) {
+			t.Fatalf("expected %q to be invalid, got %v", s, err)
+		}
+	}
+}
+
+func TestSanitizeTag(t *testing.T) {
+	if tag := SanitizeTag("yatai.iris+classifier.v1/2"); tag != "yatai.iris-classifier.v1-2" {
+		t.Fatalf("tag is %s", tag)
+	}
+	if tag := SanitizeTag(".hidden"); tag != "_.hidden" {
+		t.Fatalf("tag is %s", tag)
+	}
+
+	long := strings.Repeat("a", MaxTagLength+10)
+	tag := SanitizeTag(long)
+	if len(tag) != MaxTagLength || !tagRegexp.MatchString(tag) {
+		t.Fatalf("tag %s is not a valid tag", tag)
+	}
+	if tag == SanitizeTag(long+"b") {
+		t.Fatal("truncated tags of different strings should differ")
+	}
+}
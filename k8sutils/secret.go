@@ -5,7 +5,9 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -15,13 +17,45 @@ import (
 	"github.com/bentoml/yatai-common/consts"
 )
 
-func MakeSureDockerRegcred(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), cliset *kubernetes.Clientset, namespace string) (secret *corev1.Secret, err error) {
-	dockerRegistry, err := config.GetDockerRegistryConfig(ctx, secretGetter)
+const (
+	// DockerRegcredRefreshMargin is how long before the registry credentials
+	// expire the regcred secret is refreshed.
+	DockerRegcredRefreshMargin = time.Hour
+	// DockerRegcredRetryInterval is how long to wait before retrying a failed refresh.
+	DockerRegcredRetryInterval = time.Minute
+)
+
+func MakeSureDockerRegcred(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), cliset kubernetes.Interface, namespace string) (secret *corev1.Secret, err error) {
+	dockerRegistries, err := config.GetDockerRegistrySet(ctx, secretGetter)
 	if err != nil {
 		return
 	}
 
-	if dockerRegistry.Username == "" {
+	return makeSureDockerRegcred(ctx, secretGetter, cliset, namespace, dockerRegistries)
+}
+
+// makeSureDockerRegcred writes the credentials of every registry of the set
+// into the one dockerconfigjson of the regcred secret.
+func makeSureDockerRegcred(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), cliset kubernetes.Interface, namespace string, dockerRegistries *config.DockerRegistrySet) (secret *corev1.Secret, err error) {
+	auths := make(map[string]struct {
+		Auth string `json:"auth"`
+	}, len(dockerRegistries.Registries))
+	for _, dockerRegistry := range dockerRegistries.Registries {
+		if dockerRegistry.Username == "" {
+			continue
+		}
+		auth := struct {
+			Auth string `json:"auth"`
+		}{
+			Auth: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", dockerRegistry.Username, dockerRegistry.Password))),
+		}
+		auths[dockerRegistry.Server] = auth
+		// the pods pull the images pushed through the in-cluster server from it
+		if dockerRegistry.InClusterServer != "" {
+			auths[dockerRegistry.InClusterServer] = auth
+		}
+	}
+	if len(auths) == 0 {
 		return
 	}
 
@@ -36,13 +70,7 @@ func MakeSureDockerRegcred(ctx context.Context, secretGetter func(ctx context.Co
 			Auth string `json:"auth"`
 		} `json:"auths"`
 	}{
-		Auths: map[string]struct {
-			Auth string `json:"auth"`
-		}{
-			dockerRegistry.Server: {
-				Auth: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", dockerRegistry.Username, dockerRegistry.Password))),
-			},
-		},
+		Auths: auths,
 	}
 
 	var dockerConfigContent []byte
@@ -75,3 +103,39 @@ func MakeSureDockerRegcred(ctx context.Context, secretGetter func(ctx context.Co
 	}
 	return
 }
+
+// KeepDockerRegcredFresh makes sure the regcred secret exists and, when the
+// registry credentials expire like ECR authorization tokens do, refreshes it
+// DockerRegcredRefreshMargin before they expire. It returns right away for
+// static credentials, otherwise it blocks until ctx is done.
+func KeepDockerRegcredFresh(ctx context.Context, secretGetter func(ctx context.Context, namespace, name string) (*corev1.Secret, error), cliset kubernetes.Interface, namespace string) error {
+	for {
+		var wait time.Duration
+
+		dockerRegistries, err := config.GetDockerRegistrySet(ctx, secretGetter)
+		if err == nil {
+			_, err = makeSureDockerRegcred(ctx, secretGetter, cliset, namespace, dockerRegistries)
+		}
+
+		if err != nil {
+			logrus.Errorf("failed to refresh secret %s in namespace %s: %v", consts.KubeSecretNameRegcred, namespace, err)
+			wait = DockerRegcredRetryInterval
+		} else {
+			expireAt := dockerRegistries.CredentialsExpireAt()
+			if expireAt.IsZero() {
+				return nil
+			}
+			wait = time.Until(expireAt.Add(-DockerRegcredRefreshMargin))
+			if wait < DockerRegcredRetryInterval {
+				wait = DockerRegcredRetryInterval
+			}
+			logrus.Infof("secret %s in namespace %s refreshed, the credentials expire at %s", consts.KubeSecretNameRegcred, namespace, expireAt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
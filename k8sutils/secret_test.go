@@ -0,0 +1,105 @@
+package k8sutils
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/bentoml/yatai-common/config"
+	"github.com/bentoml/yatai-common/consts"
+)
+
+type fakeECRAuthorizationTokenGetter struct{}
+
+func (fakeECRAuthorizationTokenGetter) GetAuthorizationToken(ctx context.Context, region string) (*config.ECRAuthorizationToken, error) {
+	return &config.ECRAuthorizationToken{
+		Username:  "AWS",
+		Password:  "ecr-password",
+		Server:    "123456789012.dkr.ecr.us-west-2.amazonaws.com",
+		ExpiresAt: time.Now().Add(12 * time.Hour),
+	}, nil
+}
+
+func TestKeepDockerRegcredFreshWithECR(t *testing.T) {
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+	t.Setenv("AWS_ECR_WITH_IAM_ROLE", "true")
+
+	defaultGetter := config.DefaultECRAuthorizationTokenGetter
+	config.DefaultECRAuthorizationTokenGetter = fakeECRAuthorizationTokenGetter{}
+	defer func() {
+		config.DefaultECRAuthorizationTokenGetter = defaultGetter
+	}()
+
+	cliset := fake.NewSimpleClientset()
+	secretGetter := func(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+		return cliset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := KeepDockerRegcredFresh(ctx, secretGetter, cliset, "yatai"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the refresher to run until the context is done, got %v", err)
+	}
+
+	secret, err := cliset.CoreV1().Secrets("yatai").Get(context.Background(), consts.KubeSecretNameRegcred, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dockerConfig := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	if err = json.Unmarshal(secret.Data[".dockerconfigjson"], &dockerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dockerConfig.Auths["123456789012.dkr.ecr.us-west-2.amazonaws.com"]; !ok {
+		t.Fatalf("unexpected docker config %s", secret.Data[".dockerconfigjson"])
+	}
+}
+
+func TestMakeSureDockerRegcredWithRegistrySet(t *testing.T) {
+	t.Setenv("YATAI_CONFIG_FILE", "")
+	t.Setenv("DOCKER_REGISTRY_SERVER", "")
+	t.Setenv("AWS_ECR_WITH_IAM_ROLE", "")
+	t.Setenv("DOCKER_REGISTRIES", `[
+		{"name": "bentos", "server": "bentos.example.com", "username": "bentos", "password": "bentos-password"},
+		{"name": "models", "server": "models.example.com", "in_cluster_server": "models.registry.svc.cluster.local", "username": "models", "password": "models-password"},
+		{"name": "public", "server": "public.example.com"}
+	]`)
+	t.Setenv("DOCKER_REGISTRY_ROUTES", "")
+
+	cliset := fake.NewSimpleClientset()
+	secretGetter := func(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+		return cliset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+
+	secret, err := MakeSureDockerRegcred(context.Background(), secretGetter, cliset, "yatai")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dockerConfig := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	if err = json.Unmarshal(secret.Data[".dockerconfigjson"], &dockerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if len(dockerConfig.Auths) != 3 {
+		t.Fatalf("expected the auths of the registries with credentials, got %s", secret.Data[".dockerconfigjson"])
+	}
+	for _, server := range []string{"bentos.example.com", "models.example.com", "models.registry.svc.cluster.local"} {
+		if _, ok := dockerConfig.Auths[server]; !ok {
+			t.Fatalf("no auth for %s in %s", server, secret.Data[".dockerconfigjson"])
+		}
+	}
+}